@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"net/http"
@@ -12,7 +13,20 @@ import (
 
 	vmmetrics "github.com/VictoriaMetrics/metrics"
 	"github.com/civic-eagle/statsd-http-proxy/proxy"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/cardinality"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/certs"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/dedup"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/defaulttags"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/graphite"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/issuer"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/metrictypes"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/middleware"
 	"github.com/civic-eagle/statsd-http-proxy/proxy/process"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/relabel"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/reports"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/router"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/sampling"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/schema"
 	"github.com/civic-eagle/statsd-http-proxy/proxy/statsdclient"
 	log "github.com/sirupsen/logrus"
 )
@@ -31,11 +45,40 @@ var BuildUser = "Unknown"
 
 // HTTP connection params
 const defaultHTTPHost = "127.0.0.1"
+
+// Graphite TCP listeners don't authenticate, so they stay local unless asked
+const defaultGraphiteHost = "127.0.0.1"
 const defaultHTTPPort = 8825
 const defaultHTTPReadTimeout = 2
 const defaultHTTPWriteTimeout = 2
 const defaultHTTPIdleTimeout = 5
 
+// Websocket streaming params
+const defaultWSIdleTimeout = 60
+
+// TLS params
+const defaultTLSReload = 60
+
+// JWT params
+const defaultJWTKeysReload = 60
+
+// Request signing params
+const defaultSigningWindow = 300
+
+// how often the worst cardinality offenders are exported
+const defaultCardinalityPublish = 60
+
+// how often learn mode writes its draft schema
+const defaultSchemaDraftWrite = 60
+
+// how long, and how many, metric keys' types are remembered
+const defaultTypeConflictsTTL = 3600
+const defaultTypeConflictsSize = 100000
+
+// how long, and how many, batch idempotency keys are remembered
+const defaultBatchDedupTTL = 300
+const defaultBatchDedupSize = 10000
+
 // StatsD connection params
 const defaultStatsDHost = "127.0.0.1"
 const defaultStatsDPort = 8125
@@ -58,15 +101,62 @@ func main() {
 	var httpReadTimeout = flag.Int("http-timeout-read", defaultHTTPReadTimeout, "The maximum duration in seconds for reading the entire request, including the body")
 	var httpWriteTimeout = flag.Int("http-timeout-write", defaultHTTPWriteTimeout, "The maximum duration in seconds before timing out writes of the response")
 	var httpIdleTimeout = flag.Int("http-timeout-idle", defaultHTTPIdleTimeout, "The maximum amount of time in seconds to wait for the next request when keep-alives are enabled")
+	var wsRateLimit = flag.Int("ws-rate-limit", 0, "Maximum metrics per second accepted on a single websocket connection (0 is unlimited)")
+	var wsIdleTimeout = flag.Int("ws-timeout-idle", defaultWSIdleTimeout, "The maximum amount of time in seconds a websocket connection may stay silent before it is closed (0 is unlimited)")
+	var grpcPort = flag.Int("grpc-port", 0, "gRPC Port (0 disables the gRPC server)")
+	var rumRouteTemplates = flag.String("rum-route-templates", "", "Comma-separated route templates (e.g. /product/:slug) used to normalise page paths on /rum/vitals")
+	var reportsLogFile = flag.String("reports-log-file", "", "Append raw browser reports received on /reports to this JSONL file")
+	var graphiteHost = flag.String("graphite-host", defaultGraphiteHost, "Graphite TCP listening address (the listeners don't authenticate)")
+	var graphitePort = flag.Int("graphite-port", 0, "Graphite plaintext protocol TCP port (0 disables the listener)")
+	var graphitePicklePort = flag.Int("graphite-pickle-port", 0, "Graphite pickle protocol TCP port (0 disables the listener)")
+	var graphiteRules = flag.String("graphite-rules", "", "YAML file of rules mapping Graphite paths to metric types (unmatched paths are gauges)")
+	var enrichConfig = flag.String("enrich-config", "", "YAML allowlist of JWT claims and headers to add as tags to every metric of a request")
+	var corsConfig = flag.String("cors-config", "", "YAML policy of browser origins allowed to send metrics (any origin, if not set)")
+	var rateLimitRequests = flag.Float64("rate-limit-requests", 0, "Requests per second allowed per client (0 is unlimited)")
+	var rateLimitRequestsBurst = flag.Int("rate-limit-requests-burst", 0, "Requests a client may send at once (default a second's worth)")
+	var rateLimitMetrics = flag.Float64("rate-limit-metrics", 0, "Metrics per second allowed per client (0 is unlimited)")
+	var rateLimitMetricsBurst = flag.Int("rate-limit-metrics-burst", 0, "Metrics a client may send at once (default a second's worth)")
+	var rateLimitKey = flag.String("rate-limit-key", "sub", "What tells rate limited clients apart: sub (the token subject, else the IP) or ip")
+	var trustedProxies = flag.String("trusted-proxies", "", "Comma-separated addresses or CIDRs of proxies whose X-Forwarded-For and X-Real-IP headers are trusted")
+	var batchDedupTTL = flag.Int("batch-dedup-ttl", defaultBatchDedupTTL, "How long in seconds /batch idempotency keys are remembered (0 disables deduplication)")
+	var batchDedupSize = flag.Int("batch-dedup-size", defaultBatchDedupSize, "How many /batch idempotency keys are remembered at most")
+	var tokenConfig = flag.String("token-config", "", "YAML config for the /token endpoint, which issues short-lived tokens to browsers with a proven session")
 	var tlsCert = flag.String("tls-cert", "", "TLS certificate to enable HTTPS")
 	var tlsKey = flag.String("tls-key", "", "TLS private key  to enable HTTPS")
+	var tlsClientCA = flag.String("tls-client-ca", "", "CA bundle to verify client certificates with, enabling mutual TLS")
+	var tlsClientAuth = flag.String("tls-client-auth", "required", "Whether client certificates are required or optional when tls-client-ca is set")
+	var tlsReload = flag.Int("tls-reload", defaultTLSReload, "How often in seconds to check the TLS certificate, key and client CA files for changes")
 	var statsdHost = flag.String("statsd-host", defaultStatsDHost, "StatsD listening address")
 	var statsdPort = flag.Int("statsd-port", defaultStatsDPort, "StatsD Port")
 	var metricPrefix = flag.String("metric-prefix", "", "Prefix of metric name")
 	var tokenSecret = flag.String("jwt-secret", "", "Secret to encrypt JWT")
+	var jwtSecretsFile = flag.String("jwt-secrets-file", "", "YAML file of HMAC secrets by kid (one marked primary), replacing jwt-secret for zero-downtime rotation")
+	var jwtRevocationsFile = flag.String("jwt-revocations-file", "", "YAML file of revoked JWTs (by jti or sub), reloaded when it changes and updated by /admin/revocations")
+	var jwtPublicKeys = flag.String("jwt-public-keys", "", "Comma-separated PEM public key files for verifying RS256/ES256/EdDSA JWTs (the kid is the file name without extension)")
+	var jwtJWKSFile = flag.String("jwt-jwks-file", "", "JWKS JSON file of public keys for verifying RS256/ES256/EdDSA JWTs")
+	var jwtIssuer = flag.String("jwt-issuer", "", "Required JWT issuer (iss claim)")
+	var jwtAudience = flag.String("jwt-audience", "", "Required JWT audience (aud claim)")
+	var jwtMaxLifetime = flag.Int("jwt-max-lifetime", 0, "Maximum allowed JWT lifetime (exp - iat) in seconds (0 is unlimited)")
+	var jwtLeeway = flag.Int("jwt-leeway", 0, "Allowed clock skew in seconds when checking JWT exp, nbf and iat claims")
+	var apiKeysFile = flag.String("api-keys-file", "", "YAML file of hashed API keys, accepted instead of JWTs")
+	var signingKeysFile = flag.String("signing-keys-file", "", "YAML file of shared keys for verifying HMAC-signed requests")
+	var signingWindow = flag.Int("signing-window", defaultSigningWindow, "How far in seconds a signed request's timestamp may be from now")
+	var jwtKeysReload = flag.Int("jwt-keys-reload", defaultJWTKeysReload, "How often in seconds to check the JWT secrets, public key, revocation, API key and signing key files for changes")
 	var verbose = flag.Bool("verbose", false, "Verbose")
 	var promFilter = flag.Bool("prometheus-compat", false, "Enforce prometheus data model compatibility on incoming metrics")
 	var normalize = flag.Bool("normalize", false, "Ensure all metrics (and tags) are lower case strings")
+	var defaultTags = flag.String("default-tags", "", "Comma-separated key=value tags added to every metric (values may be $ENV_VARS, @hostname, @pod or @region)")
+	var defaultTagsFile = flag.String("default-tags-file", "", "YAML file of tags added to every metric, merged with default-tags")
+	var defaultTagsOverride = flag.Bool("default-tags-override", false, "Let client-supplied tags override default tags with the same key")
+	var schemaFile = flag.String("schema-file", "", "YAML schema declaring the metrics (types, tags, value ranges) clients may send")
+	var schemaMode = flag.String("schema-mode", schema.Enforce, "What happens to metrics not matching the schema: enforce, warn or learn")
+	var schemaDraftFile = flag.String("schema-draft-file", "", "Where learn mode writes the schema of metrics seen so far")
+	var samplingConfig = flag.String("sampling-config", "", "YAML sampling rules for counts and timings, dynamic sampling when the processing queue backs up, and limits on client sample rates")
+	var typeConflicts = flag.String("type-conflicts", "allow", "What happens to metrics sent with a different type than their key was first seen with: off, allow (only counted), reject or rename")
+	var typeConflictsTTL = flag.Int("type-conflicts-ttl", defaultTypeConflictsTTL, "How long in seconds a metric key's first type is remembered after it was last seen")
+	var typeConflictsSize = flag.Int("type-conflicts-size", defaultTypeConflictsSize, "How many metric keys' types are remembered at most")
+	var relabelConfig = flag.String("relabel-config", "", "YAML file of Prometheus-style relabeling rules applied to every metric")
+	var cardinalityConfig = flag.String("cardinality-config", "", "YAML limits on distinct series per metric and values per tag key")
 	var version = flag.Bool("version", false, "Show version")
 	var profilerHTTPort = flag.Int("profiler-http-port", 0, "Start profiler localhost")
 
@@ -119,13 +209,61 @@ func main() {
 	statsdClient.Open()
 	defer statsdClient.Close()
 
+	// limits on distinct series and tag values
+	cardinalityGuard, err := cardinality.Load(*cardinalityConfig)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "file": *cardinalityConfig}).Fatal("Cannot load cardinality limits")
+	}
+	if cardinalityGuard != nil {
+		go cardinalityGuard.Publish(defaultCardinalityPublish * time.Second)
+	}
+
+	// declared metrics
+	schemaRegistry, err := schema.Load(*schemaFile, *schemaMode, *schemaDraftFile)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "file": *schemaFile}).Fatal("Cannot load metric schema")
+	}
+	go schemaRegistry.WriteDrafts(defaultSchemaDraftWrite * time.Second)
+
+	// tags for every metric, resolved once
+	defaults, err := defaulttags.Load(*defaultTagsFile, *defaultTags, *defaultTagsOverride)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "file": *defaultTagsFile}).Fatal("Cannot load default tags")
+	}
+	if defaults != nil {
+		log.WithFields(log.Fields{"tags": defaults.Tags()}).Info("Adding default tags to every metric")
+	}
+
+	// load shedding
+	sampler, err := sampling.Load(*samplingConfig)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "file": *samplingConfig}).Fatal("Cannot load sampling rules")
+	}
+
+	// rewriting and filtering rules
+	relabelRules, err := relabel.Load(*relabelConfig)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "file": *relabelConfig}).Fatal("Cannot load relabeling rules")
+	}
+
+	// first types seen per metric key
+	typeRegistry, err := metrictypes.New(*typeConflicts, time.Duration(*typeConflictsTTL)*time.Second, *typeConflictsSize)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Cannot set up type conflict detection")
+	}
+
 	// build processor
-	processor := processor.NewProcessor(
-		statsdClient,
-		*metricPrefix,
-		*promFilter,
-		*normalize,
-	)
+	processor := processor.NewProcessor(statsdClient, processor.Options{
+		MetricPrefix: *metricPrefix,
+		PromFilter:   *promFilter,
+		Normalize:    *normalize,
+		Cardinality:  cardinalityGuard,
+		Relabel:      relabelRules,
+		Schema:       schemaRegistry,
+		DefaultTags:  defaults,
+		Sampler:      sampler,
+		Types:        typeRegistry,
+	})
 
 	/*
 		Multiple processing threads so we don't get bottle-necked on one processor
@@ -136,18 +274,190 @@ func main() {
 		go processor.Process()
 	}
 
-	// start proxy server
-	proxyServer := proxy.NewServer(
-		*httpHost,
-		*httpPort,
-		*httpReadTimeout,
-		*httpWriteTimeout,
-		*httpIdleTimeout,
-		*tlsCert,
-		*tlsKey,
+	// optionally keep raw browser reports
+	var reportsWriter *reports.Writer
+	if *reportsLogFile != "" {
+		var err error
+		reportsWriter, err = reports.NewWriter(*reportsLogFile)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "file": *reportsLogFile}).Fatal("Cannot open reports log file")
+		}
+		defer reportsWriter.Close()
+	}
+
+	// map graphite paths to metric types
+	graphiteMapper, err := graphite.LoadMapper(*graphiteRules)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "file": *graphiteRules}).Fatal("Cannot load Graphite rules")
+	}
+
+	// HMAC secrets by kid, reloaded as they're rotated
+	var secretSet *middleware.SecretSet
+	if *jwtSecretsFile != "" {
+		if *tokenSecret != "" {
+			log.Fatal("Only one of jwt-secret and jwt-secrets-file may be set")
+		}
+		var err error
+		secretSet, err = middleware.LoadSecretSet(*jwtSecretsFile)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Fatal("Cannot load JWT secrets")
+		}
+		if *jwtKeysReload > 0 {
+			go secretSet.Watch(time.Duration(*jwtKeysReload) * time.Second)
+		}
+	}
+
+	// public keys for asymmetric JWTs, reloaded as they're rotated
+	var keySet *middleware.KeySet
+	if *jwtPublicKeys != "" || *jwtJWKSFile != "" {
+		var err error
+		keySet, err = middleware.LoadKeySet(strings.Split(*jwtPublicKeys, ","), *jwtJWKSFile)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Fatal("Cannot load JWT public keys")
+		}
+		if *jwtKeysReload > 0 {
+			go keySet.Watch(time.Duration(*jwtKeysReload) * time.Second)
+		}
+	}
+	// revoked tokens, reloaded as they change and cleaned up as they expire
+	var revocations *middleware.RevocationList
+	if *jwtRevocationsFile != "" {
+		var err error
+		revocations, err = middleware.LoadRevocationList(*jwtRevocationsFile, time.Duration(*jwtLeeway)*time.Second)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Fatal("Cannot load JWT revocations")
+		}
+		if *jwtKeysReload > 0 {
+			go revocations.Watch(time.Duration(*jwtKeysReload) * time.Second)
+		}
+	}
+
+	// API keys for clients that can't sign tokens, reloaded as they change
+	var apiKeys *middleware.APIKeySet
+	if *apiKeysFile != "" {
+		var err error
+		apiKeys, err = middleware.LoadAPIKeySet(*apiKeysFile)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Fatal("Cannot load API keys")
+		}
+		if *jwtKeysReload > 0 {
+			go apiKeys.Watch(time.Duration(*jwtKeysReload) * time.Second)
+		}
+	}
+
+	// shared keys for servers signing their requests, reloaded as they change
+	var signingKeys *middleware.SigningKeySet
+	if *signingKeysFile != "" {
+		var err error
+		signingKeys, err = middleware.LoadSigningKeySet(*signingKeysFile, time.Duration(*signingWindow)*time.Second)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Fatal("Cannot load signing keys")
+		}
+		if *jwtKeysReload > 0 {
+			go signingKeys.Watch(time.Duration(*jwtKeysReload) * time.Second)
+		}
+	}
+
+	tokenValidator := middleware.NewTokenValidator(
 		*tokenSecret,
-		*verbose,
+		secretSet,
+		keySet,
+		middleware.ClaimsPolicy{
+			Issuer:      *jwtIssuer,
+			Audience:    *jwtAudience,
+			MaxLifetime: time.Duration(*jwtMaxLifetime) * time.Second,
+			Leeway:      time.Duration(*jwtLeeway) * time.Second,
+		},
+		revocations,
+		apiKeys,
+		signingKeys,
 	)
 
+	// short-lived tokens for browsers, signed with our own secret
+	tokenIssuer, err := issuer.Load(*tokenConfig, tokenValidator)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "file": *tokenConfig}).Fatal("Cannot load token issuing config")
+	}
+
+	// trusted tags from tokens and headers
+	enricher, err := middleware.LoadEnricher(*enrichConfig)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "file": *enrichConfig}).Fatal("Cannot load enrichment config")
+	}
+
+	// browser origins allowed to call us
+	corsPolicy, err := middleware.LoadCORSPolicy(*corsConfig)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "file": *corsConfig}).Fatal("Cannot load CORS policy")
+	}
+	if corsPolicy == nil {
+		log.Warn("No CORS policy set, any website may send metrics from its visitors' browsers")
+	}
+
+	// per-client request and metric rate limits
+	var clientLimiter *middleware.ClientLimiter
+	if *rateLimitRequests > 0 || *rateLimitMetrics > 0 {
+		clientLimiter, err = middleware.NewClientLimiter(
+			*rateLimitRequests,
+			*rateLimitRequestsBurst,
+			*rateLimitMetrics,
+			*rateLimitMetricsBurst,
+			*rateLimitKey,
+			strings.Split(*trustedProxies, ","),
+		)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Fatal("Cannot set up rate limits")
+		}
+	}
+
+	// TLS certificates (and client CAs), reloaded as they're rotated
+	var tlsConfig *tls.Config
+	if *tlsCert != "" && *tlsKey != "" {
+		reloader, err := certs.NewReloader(*tlsCert, *tlsKey, *tlsClientCA, *tlsClientAuth)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Fatal("Cannot load TLS certificates")
+		}
+		if *tlsReload > 0 {
+			go reloader.Watch(time.Duration(*tlsReload) * time.Second)
+		}
+		tlsConfig = reloader.TLSConfig()
+	} else if *tlsClientCA != "" {
+		log.Fatal("tls-client-ca needs tls-cert and tls-key")
+	}
+
+	if *wsIdleTimeout < 0 {
+		log.Fatal("ws-timeout-idle can't be negative")
+	}
+
+	// start proxy server
+	proxyServer := proxy.NewServer(proxy.Options{
+		HTTPHost:           *httpHost,
+		HTTPPort:           *httpPort,
+		HTTPReadTimeout:    *httpReadTimeout,
+		HTTPWriteTimeout:   *httpWriteTimeout,
+		HTTPIdleTimeout:    *httpIdleTimeout,
+		TLSConfig:          tlsConfig,
+		GRPCPort:           *grpcPort,
+		GraphiteHost:       *graphiteHost,
+		GraphitePort:       *graphitePort,
+		GraphitePicklePort: *graphitePicklePort,
+		Routes: router.Options{
+			TokenValidator:    tokenValidator,
+			WSRateLimit:       *wsRateLimit,
+			WSIdleTimeout:     time.Duration(*wsIdleTimeout) * time.Second,
+			RUMRouteTemplates: strings.Split(*rumRouteTemplates, ","),
+			ReportsWriter:     reportsWriter,
+			GraphiteMapper:    graphiteMapper,
+			Enricher:          enricher,
+			Revocations:       revocations,
+			TokenIssuer:       tokenIssuer,
+			CORSPolicy:        corsPolicy,
+			ClientLimiter:     clientLimiter,
+			Schema:            schemaRegistry,
+			Batches:           dedup.NewCache(time.Duration(*batchDedupTTL)*time.Second, *batchDedupSize),
+			TypeRegistry:      typeRegistry,
+		},
+	})
+
 	proxyServer.Listen()
 }
@@ -0,0 +1,338 @@
+package cardinality
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	"gopkg.in/yaml.v3"
+)
+
+// Overflow replaces tag values past the limit with the overflow action
+const Overflow = "__overflow__"
+
+const (
+	defaultWindow     = 3600
+	defaultMaxTracked = 10000
+	defaultTop        = 10
+)
+
+// ErrLimited is returned for metrics dropped by the drop action
+var ErrLimited = errors.New("Cardinality limit reached")
+
+// Config is the cardinality limits file
+type Config struct {
+	// seconds a series or tag value is remembered after it's last seen (default 3600)
+	Window int `yaml:"window"`
+	// distinct series (tag combinations) per metric name (unlimited, if 0)
+	MaxSeries int `yaml:"max_series"`
+	// distinct values per tag key, across all metrics (unlimited, if 0)
+	MaxTagValues int `yaml:"max_tag_values"`
+	// metric names and tag keys tracked at all (default 10000); new ones past it are over their limits
+	MaxTracked int `yaml:"max_tracked"`
+	// what happens past a limit: drop the metric, strip the tag(s), or overflow (the default) their values
+	Action string `yaml:"action"`
+	// how many of the worst offenders are exported (default 10)
+	Top int `yaml:"top"`
+}
+
+/*
+tracker remembers distinct hashes over a sliding window with two
+generations: hashes seen this window, and hashes seen last window
+but not (yet) this one. Both are bounded by the limit, as new hashes
+are only added under it
+*/
+type tracker struct {
+	current  map[uint64]struct{}
+	previous map[uint64]struct{}
+}
+
+func newTracker() *tracker {
+	return &tracker{current: map[uint64]struct{}{}, previous: map[uint64]struct{}{}}
+}
+
+// observe returns false if h is new and there's no room for it
+func (t *tracker) observe(h uint64, limit int) bool {
+	if _, ok := t.current[h]; ok {
+		return true
+	}
+	if _, ok := t.previous[h]; ok {
+		delete(t.previous, h)
+		t.current[h] = struct{}{}
+		return true
+	}
+	if limit > 0 && t.len() >= limit {
+		return false
+	}
+	t.current[h] = struct{}{}
+	return true
+}
+
+func (t *tracker) len() int {
+	return len(t.current) + len(t.previous)
+}
+
+func (t *tracker) rotate() {
+	t.previous = t.current
+	t.current = map[uint64]struct{}{}
+}
+
+// Offender is a metric name or tag key and how many distinct series or values it has
+type Offender struct {
+	Name  string
+	Count int
+}
+
+/*
+Guard keeps buggy clients (a user ID in a tag, say) from exploding the
+StatsD backend, by limiting distinct series per metric name and
+distinct values per tag key
+*/
+type Guard struct {
+	window       time.Duration
+	maxSeries    int
+	maxTagValues int
+	maxTracked   int
+	action       string
+	top          int
+
+	mu      sync.Mutex
+	series  map[string]*tracker
+	values  map[string]*tracker
+	rotated time.Time
+
+	published *vmmetrics.Set
+}
+
+/*
+Load reads cardinality limits from a YAML file:
+
+	window: 3600
+	max_series: 1000
+	max_tag_values: 200
+	action: overflow
+
+An empty path disables the limits
+*/
+func Load(path string) (*Guard, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return New(cfg)
+}
+
+// New validates limits, filling in defaults
+func New(cfg Config) (*Guard, error) {
+	if cfg.Window == 0 {
+		cfg.Window = defaultWindow
+	}
+	if cfg.MaxTracked == 0 {
+		cfg.MaxTracked = defaultMaxTracked
+	}
+	if cfg.Top == 0 {
+		cfg.Top = defaultTop
+	}
+	switch cfg.Action {
+	case "":
+		cfg.Action = "overflow"
+	case "drop", "strip", "overflow":
+	default:
+		return nil, fmt.Errorf("Invalid cardinality action %q, must be drop, strip or overflow", cfg.Action)
+	}
+	if cfg.Window < 0 || cfg.MaxSeries < 0 || cfg.MaxTagValues < 0 || cfg.MaxTracked < 0 || cfg.Top < 0 {
+		return nil, fmt.Errorf("Cardinality limits can't be negative")
+	}
+
+	return &Guard{
+		window:       time.Duration(cfg.Window) * time.Second,
+		maxSeries:    cfg.MaxSeries,
+		maxTagValues: cfg.MaxTagValues,
+		maxTracked:   cfg.MaxTracked,
+		action:       cfg.Action,
+		top:          cfg.Top,
+		series:       map[string]*tracker{},
+		values:       map[string]*tracker{},
+		rotated:      time.Now(),
+	}, nil
+}
+
+/*
+Apply checks a metric's comma-separated tags against the limits,
+returning the tags to send it with. Tag values are checked first, so a
+tag that's over its limit is stripped or overflowed before the series is
+counted. ErrLimited means the metric should be dropped
+*/
+func (g *Guard) Apply(metric string, tags string) (string, error) {
+	if g == nil {
+		return tags, nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if now := time.Now(); now.Sub(g.rotated) > g.window {
+		g.rotate()
+		g.rotated = now
+	}
+
+	var pairs [][2]string
+	for _, pair := range strings.Split(tags, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			// malformed tags are the processor's to drop
+			pairs = append(pairs, [2]string{pair, ""})
+			continue
+		}
+		pairs = append(pairs, [2]string{kv[0], kv[1]})
+	}
+
+	if g.maxTagValues > 0 {
+		kept := pairs[:0]
+		for _, p := range pairs {
+			if p[1] == "" || p[1] == Overflow || g.admit(g.values, p[0], p[1], g.maxTagValues) {
+				kept = append(kept, p)
+				continue
+			}
+			vmmetrics.GetOrCreateCounter(`cardinality_limited_total{limit="tag_values"}`).Inc()
+			switch g.action {
+			case "drop":
+				return "", ErrLimited
+			case "overflow":
+				kept = append(kept, [2]string{p[0], Overflow})
+			}
+		}
+		pairs = kept
+	}
+
+	if g.maxSeries > 0 {
+		sorted := make([]string, len(pairs))
+		for i, p := range pairs {
+			sorted[i] = p[0] + "=" + p[1]
+		}
+		sort.Strings(sorted)
+		if !g.admit(g.series, metric, strings.Join(sorted, ","), g.maxSeries) {
+			vmmetrics.GetOrCreateCounter(`cardinality_limited_total{limit="series"}`).Inc()
+			switch g.action {
+			case "drop":
+				return "", ErrLimited
+			case "strip":
+				pairs = nil
+			case "overflow":
+				for i := range pairs {
+					if pairs[i][1] != "" {
+						pairs[i][1] = Overflow
+					}
+				}
+			}
+		}
+	}
+
+	out := make([]string, len(pairs))
+	for i, p := range pairs {
+		if p[1] == "" {
+			out[i] = p[0]
+		} else {
+			out[i] = p[0] + "=" + p[1]
+		}
+	}
+	return strings.Join(out, ","), nil
+}
+
+// admit observes value for name, unless name is new and too many names are tracked already
+func (g *Guard) admit(trackers map[string]*tracker, name string, value string, limit int) bool {
+	t, ok := trackers[name]
+	if !ok {
+		if len(trackers) >= g.maxTracked {
+			return false
+		}
+		t = newTracker()
+		trackers[name] = t
+	}
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return t.observe(h.Sum64(), limit)
+}
+
+// rotate starts a new window, forgetting names not seen for a whole one
+func (g *Guard) rotate() {
+	for _, trackers := range []map[string]*tracker{g.series, g.values} {
+		for name, t := range trackers {
+			if len(t.current) == 0 {
+				delete(trackers, name)
+				continue
+			}
+			t.rotate()
+		}
+	}
+}
+
+// Offenders returns the metric names with the most series, and the tag keys with the most values
+func (g *Guard) Offenders(n int) ([]Offender, []Offender) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return top(g.series, n), top(g.values, n)
+}
+
+func top(trackers map[string]*tracker, n int) []Offender {
+	offenders := make([]Offender, 0, len(trackers))
+	for name, t := range trackers {
+		offenders = append(offenders, Offender{name, t.len()})
+	}
+	sort.Slice(offenders, func(i, j int) bool {
+		if offenders[i].Count != offenders[j].Count {
+			return offenders[i].Count > offenders[j].Count
+		}
+		return offenders[i].Name < offenders[j].Name
+	})
+	if len(offenders) > n {
+		offenders = offenders[:n]
+	}
+	return offenders
+}
+
+/*
+Publish exports the worst offenders as gauges, refreshed every interval.
+They're replaced as a set, so names that drop out of the top disappear
+*/
+func (g *Guard) Publish(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		g.publish()
+	}
+}
+
+func (g *Guard) publish() {
+	series, values := g.Offenders(g.top)
+	set := vmmetrics.NewSet()
+	for _, o := range series {
+		count := float64(o.Count)
+		set.NewGauge(fmt.Sprintf("cardinality_top_series{metric=%q}", o.Name), func() float64 { return count })
+	}
+	for _, o := range values {
+		count := float64(o.Count)
+		set.NewGauge(fmt.Sprintf("cardinality_top_tag_values{tag=%q}", o.Name), func() float64 { return count })
+	}
+
+	vmmetrics.RegisterSet(set)
+	if g.published != nil {
+		vmmetrics.UnregisterSet(g.published)
+	}
+	g.published = set
+}
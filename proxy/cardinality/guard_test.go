@@ -0,0 +1,109 @@
+package cardinality
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagValueLimit(t *testing.T) {
+	for action, expected := range map[string]string{
+		"overflow": "env=prod,user=" + Overflow,
+		"strip":    "env=prod",
+	} {
+		g, err := New(Config{MaxTagValues: 2, Action: action})
+		require.NoError(t, err)
+		rt := require.New(t)
+
+		for _, user := range []string{"1", "2", "1"} {
+			tags, err := g.Apply("logins", "env=prod,user="+user)
+			rt.NoError(err)
+			rt.Equal("env=prod,user="+user, tags)
+		}
+		tags, err := g.Apply("logins", "env=prod,user=3")
+		rt.NoError(err, action)
+		rt.Equal(expected, tags, action)
+		// the limit is per key, across metrics
+		tags, err = g.Apply("logouts", "user=4")
+		rt.NoError(err)
+		rt.NotEqual("user=4", tags)
+	}
+
+	g, _ := New(Config{MaxTagValues: 1, Action: "drop"})
+	_, err := g.Apply("logins", "user=1")
+	require.NoError(t, err)
+	_, err = g.Apply("logins", "user=2")
+	require.ErrorIs(t, err, ErrLimited)
+}
+
+func TestSeriesLimit(t *testing.T) {
+	g, err := New(Config{MaxSeries: 2})
+	require.NoError(t, err)
+	rt := require.New(t)
+
+	for _, tags := range []string{"a=1,b=1", "a=2,b=1", "b=1,a=1"} {
+		out, err := g.Apply("requests", tags)
+		rt.NoError(err)
+		rt.Equal(tags, out)
+	}
+	out, err := g.Apply("requests", "a=3,b=1")
+	rt.NoError(err)
+	rt.Equal("a="+Overflow+",b="+Overflow, out)
+
+	// other metrics have their own limit
+	out, err = g.Apply("errors", "a=3,b=1")
+	rt.NoError(err)
+	rt.Equal("a=3,b=1", out)
+}
+
+func TestWindowForgetsOldValues(t *testing.T) {
+	g, err := New(Config{MaxTagValues: 2, Window: 60})
+	require.NoError(t, err)
+	rt := require.New(t)
+
+	g.Apply("logins", "user=1")
+	g.Apply("logins", "user=2")
+	out, _ := g.Apply("logins", "user=3")
+	rt.Equal("user="+Overflow, out)
+
+	// user 2 comes back, user 1 doesn't
+	g.rotated = g.rotated.Add(-2 * time.Minute)
+	g.Apply("logins", "user=2")
+	out, _ = g.Apply("logins", "user=3")
+	rt.Equal("user="+Overflow, out)
+	g.rotated = g.rotated.Add(-2 * time.Minute)
+	out, _ = g.Apply("logins", "user=3")
+	rt.Equal("user=3", out)
+}
+
+func TestMaxTracked(t *testing.T) {
+	g, err := New(Config{MaxTagValues: 100, MaxTracked: 2, Action: "strip"})
+	require.NoError(t, err)
+
+	out, _ := g.Apply("m", "a=1,b=1,c=1")
+	require.Equal(t, "a=1,b=1", out)
+}
+
+func TestOffenders(t *testing.T) {
+	g, err := New(Config{MaxSeries: 100, MaxTagValues: 100})
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		g.Apply("requests", fmt.Sprintf("path=/%d", i))
+		g.Apply("errors", fmt.Sprintf("path=/%d,code=500", i%2))
+	}
+
+	series, values := g.Offenders(1)
+	require.Equal(t, []Offender{{"requests", 5}}, series)
+	require.Equal(t, []Offender{{"path", 5}}, values)
+	g.publish()
+	g.publish()
+}
+
+func TestNewValidation(t *testing.T) {
+	_, err := New(Config{Action: "explode"})
+	require.Error(t, err)
+	_, err = New(Config{MaxSeries: -1})
+	require.Error(t, err)
+}
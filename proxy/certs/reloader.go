@@ -0,0 +1,154 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/filewatch"
+)
+
+/*
+Reloader serves the TLS certificate (and, for mutual TLS, the client
+CA bundle) from files that are re-read when they change. The tls.Config
+looks both up per handshake, so rotating them doesn't drop connections
+*/
+type Reloader struct {
+	certFile   string
+	keyFile    string
+	caFile     string
+	clientAuth string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	snapshot filewatch.Snapshot
+}
+
+/*
+NewReloader loads a certificate and key, and optionally a CA bundle
+to verify client certificates with. clientAuth is "required" (the
+default) or "optional", and only matters with a CA bundle
+*/
+func NewReloader(certFile string, keyFile string, caFile string, clientAuth string) (*Reloader, error) {
+	switch clientAuth {
+	case "":
+		clientAuth = "required"
+	case "required", "optional":
+	default:
+		return nil, fmt.Errorf("Invalid client auth %q, must be required or optional", clientAuth)
+	}
+	r := &Reloader{
+		certFile:   certFile,
+		keyFile:    keyFile,
+		caFile:     caFile,
+		clientAuth: clientAuth,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the certificate and CA files. On error the current ones are kept
+func (r *Reloader) Reload() error {
+	snapshot, err := filewatch.Take(r.files()...)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		data, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("%s: no certificates found", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.pool = pool
+	r.snapshot = snapshot
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Watch reloads the files whenever they change, checking every interval
+func (r *Reloader) Watch(interval time.Duration) {
+	filewatch.Watcher{What: "TLS certificates", Metric: "tls", Changed: r.changed, Reload: r.Reload}.Watch(interval)
+}
+
+/*
+TLSConfig returns a server config using the current certificate.
+
+With a CA bundle, each handshake gets a config built from the
+current bundle, as crypto/tls can't change a running server's
+ClientCAs. crypto/tls then verifies client certificates itself,
+leaving the chains in ConnectionState.VerifiedChains. Session
+tickets are off, so every connection is verified against the
+current bundle rather than resuming an earlier verification
+*/
+func (r *Reloader) TLSConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.getCertificate,
+	}
+	if r.caFile != "" {
+		config.SessionTicketsDisabled = true
+		config.GetConfigForClient = r.clientConfig
+	}
+	return config
+}
+
+func (r *Reloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// clientConfig verifies client certificates against the current CA bundle
+func (r *Reloader) clientConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.RLock()
+	pool := r.pool
+	r.mu.RUnlock()
+
+	config := &tls.Config{
+		MinVersion:             tls.VersionTLS12,
+		GetCertificate:         r.getCertificate,
+		ClientCAs:              pool,
+		ClientAuth:             tls.RequireAndVerifyClientCert,
+		SessionTicketsDisabled: true,
+		// what our HTTP and gRPC servers both speak, as they'd have set on the base config
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if r.clientAuth == "optional" {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.snapshot.Changed()
+}
@@ -0,0 +1,199 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/middleware"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert, key, der}
+}
+
+func newCA(t *testing.T, name string) *testCert {
+	return newCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newClient(t *testing.T, ca *testCert, spiffeID string) tls.Certificate {
+	id, _ := url.Parse(spiffeID)
+	c := newCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "cron"},
+		URIs:        []*url.URL{id},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func writeCert(t *testing.T, path string, c *testCert) {
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600))
+}
+
+func writeKey(t *testing.T, path string, c *testCert) {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+}
+
+// newTestServer serves the client certificate identity (or "none") over mutual TLS
+func newTestServer(t *testing.T, clientAuth string) (*httptest.Server, *Reloader, string, *testCert) {
+	dir := t.TempDir()
+	ca := newCA(t, "clients")
+	server := newCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil)
+	certFile, keyFile, caFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt")
+	writeCert(t, certFile, server)
+	writeKey(t, keyFile, server)
+	writeCert(t, caFile, ca)
+
+	reloader, err := NewReloader(certFile, keyFile, caFile, clientAuth)
+	require.NoError(t, err)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := middleware.TLSIdentity(r.TLS)
+		if !ok {
+			identity = "none"
+		}
+		fmt.Fprint(w, identity)
+	}))
+	ts.TLS = reloader.TLSConfig()
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts, reloader, caFile, ca
+}
+
+func get(t *testing.T, ts *httptest.Server, cert *tls.Certificate) (string, error) {
+	config := &tls.Config{InsecureSkipVerify: true}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	res, err := client.Get(ts.URL)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body := make([]byte, 1024)
+	n, _ := res.Body.Read(body)
+	return string(body[:n]), nil
+}
+
+func TestRequiredClientCertificates(t *testing.T) {
+	ts, _, _, ca := newTestServer(t, "required")
+	rt := require.New(t)
+
+	client := newClient(t, ca, "spiffe://example.org/cron")
+	identity, err := get(t, ts, &client)
+	rt.NoError(err)
+	rt.Equal("spiffe://example.org/cron", identity)
+
+	_, err = get(t, ts, nil)
+	rt.Error(err)
+
+	stranger := newClient(t, newCA(t, "someone else"), "spiffe://example.org/cron")
+	_, err = get(t, ts, &stranger)
+	rt.Error(err)
+}
+
+func TestOptionalClientCertificates(t *testing.T) {
+	ts, _, _, _ := newTestServer(t, "optional")
+
+	identity, err := get(t, ts, nil)
+
+	require.NoError(t, err)
+	require.Equal(t, "none", identity)
+}
+
+func TestReloadClientCA(t *testing.T) {
+	ts, reloader, caFile, oldCA := newTestServer(t, "required")
+	rt := require.New(t)
+
+	rotated := newCA(t, "new clients")
+	writeCert(t, caFile, rotated)
+	future := time.Now().Add(time.Minute)
+	rt.NoError(os.Chtimes(caFile, future, future))
+	rt.True(reloader.changed())
+	rt.NoError(reloader.Reload())
+
+	client := newClient(t, rotated, "spiffe://example.org/new")
+	identity, err := get(t, ts, &client)
+	rt.NoError(err)
+	rt.Equal("spiffe://example.org/new", identity)
+
+	old := newClient(t, oldCA, "spiffe://example.org/old")
+	_, err = get(t, ts, &old)
+	rt.Error(err)
+}
+
+func TestResumedSessionsAreVerifiedAgain(t *testing.T) {
+	ts, reloader, caFile, oldCA := newTestServer(t, "required")
+	rt := require.New(t)
+
+	old := newClient(t, oldCA, "spiffe://example.org/old")
+	config := &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{old},
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+	res, err := client.Get(ts.URL)
+	rt.NoError(err)
+	res.Body.Close()
+
+	writeCert(t, caFile, newCA(t, "new clients"))
+	future := time.Now().Add(time.Minute)
+	rt.NoError(os.Chtimes(caFile, future, future))
+	rt.NoError(reloader.Reload())
+
+	// a new connection can't skip verification by resuming the old session
+	_, err = client.Get(ts.URL)
+	rt.Error(err)
+}
+
+func TestNewReloaderValidatesClientAuth(t *testing.T) {
+	_, err := NewReloader("a", "b", "", "sometimes")
+	require.Error(t, err)
+}
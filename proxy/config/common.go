@@ -1,26 +1,42 @@
 package config
 
 import (
+	"fmt"
+
 	vmmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/tagformat"
 )
 
 // MetricRequest: internal representation of a metric to be written
 type MetricRequest struct {
-	Metric	string `json:"metric,omitempty"`
-	Value    int64 `json:"value"`
-	Tags string `json:"tags"`
-	MetricType string `json:"metric_type,omitempty"`
+	Metric     string  `json:"metric,omitempty"`
+	Value      int64   `json:"value"`
+	Tags       string  `json:"tags"`
+	MetricType string  `json:"metric_type,omitempty"`
 	SampleRate float64 `json:"sampleRate"`
+	// set once an enforced schema has accepted the metric, so it isn't checked again
+	Validated bool `json:"-"`
 }
 
 // 5 MB
 const MaxBodySize = 5000 * 1024 * 1024
 
 var (
-	ProcessChan chan MetricRequest
+	ProcessChan    chan MetricRequest
 	DroppedMetrics = vmmetrics.NewCounter("metrics_dropped_total")
 )
 
+/*
+CheckMetricName rejects names the processor couldn't tell from tags
+once it appends them (as name,key=value), like "web.paid,tenant=victim"
+*/
+func CheckMetricName(name string) error {
+	if tagformat.Unsafe(name) {
+		return fmt.Errorf("Metric name %q can't contain commas, equals signs or whitespace", name)
+	}
+	return nil
+}
+
 func init() {
 	ProcessChan = make(chan MetricRequest, 10000)
 
@@ -0,0 +1,120 @@
+package dedup
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	hits      = vmmetrics.NewCounter("batch_dedup_hits_total")
+	evictions = vmmetrics.NewCounter("batch_dedup_evictions_total")
+)
+
+type entry struct {
+	key     string
+	expires time.Time
+	// closed once the first attempt is finished
+	done   chan struct{}
+	result []byte
+	ok     bool
+}
+
+/*
+Cache remembers the results of recently seen idempotency keys, so a
+retried request gets the original result instead of being run twice.
+It's bounded by size as well as TTL: past size keys, the oldest are
+forgotten early
+*/
+type Cache struct {
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// oldest first
+	order *list.List
+}
+
+// NewCache creates a cache. A ttl or size of 0 disables deduplication, returning nil
+func NewCache(ttl time.Duration, size int) *Cache {
+	if ttl <= 0 || size <= 0 {
+		return nil
+	}
+	c := &Cache{ttl: ttl, size: size, entries: map[string]*list.Element{}, order: list.New()}
+	vmmetrics.GetOrCreateGauge("batch_dedup_keys", func() float64 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return float64(c.order.Len())
+	})
+	return c
+}
+
+/*
+Do runs fn for the first request with a key, returning its result and
+whether it succeeded. Repeats within the TTL get the same result, with
+hit true, and one that arrives while the first is still running waits
+for it. If fn fails (having answered the request itself), the key is
+forgotten so it can be retried
+*/
+func (c *Cache) Do(key string, fn func() ([]byte, bool)) ([]byte, bool, bool) {
+	for {
+		c.mu.Lock()
+		now := time.Now()
+		c.expire(now)
+		if el, ok := c.entries[key]; ok {
+			e := el.Value.(*entry)
+			c.mu.Unlock()
+			<-e.done
+			if !e.ok {
+				// the first attempt failed, so have another go
+				continue
+			}
+			hits.Inc()
+			return e.result, true, true
+		}
+
+		e := &entry{key: key, expires: now.Add(c.ttl), done: make(chan struct{})}
+		c.entries[key] = c.order.PushBack(e)
+		for c.order.Len() > c.size {
+			c.remove(c.order.Front())
+			evictions.Inc()
+		}
+		c.mu.Unlock()
+
+		e.result, e.ok = fn()
+		if !e.ok {
+			c.mu.Lock()
+			if el, ok := c.entries[key]; ok && el.Value.(*entry) == e {
+				c.remove(el)
+			}
+			c.mu.Unlock()
+		}
+		close(e.done)
+		return e.result, e.ok, false
+	}
+}
+
+// expire forgets keys past their TTL. Entries are in expiry order, as the TTL is fixed
+func (c *Cache) expire(now time.Time) {
+	for el := c.order.Front(); el != nil; el = c.order.Front() {
+		if el.Value.(*entry).expires.After(now) {
+			return
+		}
+		c.remove(el)
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	delete(c.entries, el.Value.(*entry).key)
+	c.order.Remove(el)
+}
+
+// Len is the number of keys remembered
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,98 @@
+package dedup
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDo(t *testing.T) {
+	c := NewCache(time.Minute, 10)
+	runs := 0
+	send := func() ([]byte, bool) {
+		runs++
+		return []byte(`{"accepted":2}`), true
+	}
+
+	result, ok, hit := c.Do("a", send)
+	require.Equal(t, `{"accepted":2}`, string(result))
+	require.True(t, ok)
+	require.False(t, hit)
+
+	result, ok, hit = c.Do("a", send)
+	require.Equal(t, `{"accepted":2}`, string(result))
+	require.True(t, ok)
+	require.True(t, hit)
+	require.Equal(t, 1, runs)
+
+	_, _, hit = c.Do("b", send)
+	require.False(t, hit)
+	require.Equal(t, 2, runs)
+}
+
+func TestDoFailureIsForgotten(t *testing.T) {
+	c := NewCache(time.Minute, 10)
+	_, ok, _ := c.Do("a", func() ([]byte, bool) { return nil, false })
+	require.False(t, ok)
+	require.Equal(t, 0, c.Len())
+
+	_, ok, hit := c.Do("a", func() ([]byte, bool) { return []byte("ok"), true })
+	require.True(t, ok)
+	require.False(t, hit)
+}
+
+func TestDoWaitsForFirstAttempt(t *testing.T) {
+	c := NewCache(time.Minute, 10)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	runs := 0
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.Do("a", func() ([]byte, bool) {
+			runs++
+			close(started)
+			<-release
+			return []byte("first"), true
+		})
+	}()
+	<-started
+
+	done := make(chan []byte)
+	go func() {
+		result, _, _ := c.Do("a", func() ([]byte, bool) {
+			runs++
+			return []byte("second"), true
+		})
+		done <- result
+	}()
+	close(release)
+	require.Equal(t, "first", string(<-done))
+	wg.Wait()
+	require.Equal(t, 1, runs)
+}
+
+func TestExpiryAndSize(t *testing.T) {
+	c := NewCache(50*time.Millisecond, 2)
+	send := func() ([]byte, bool) { return []byte("ok"), true }
+
+	c.Do("a", send)
+	c.Do("b", send)
+	c.Do("c", send)
+	require.Equal(t, 2, c.Len())
+	// a was evicted to make room
+	_, _, hit := c.Do("a", send)
+	require.False(t, hit)
+
+	time.Sleep(60 * time.Millisecond)
+	_, _, hit = c.Do("c", send)
+	require.False(t, hit)
+	require.Equal(t, 1, c.Len())
+
+	require.Nil(t, NewCache(0, 10))
+	require.Nil(t, NewCache(time.Minute, 0))
+}
@@ -0,0 +1,185 @@
+package defaulttags
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/tagformat"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// characters the processor replaces in tag keys for prometheus
+	promTagKeyChars = regexp.MustCompile("[^a-zA-Z0-9_:]")
+)
+
+// environment variables that name the region, in the order they're tried
+var regionVars = []string{"REGION", "AWS_REGION", "AWS_DEFAULT_REGION", "FLY_REGION"}
+
+// Config is the default tags file
+type Config struct {
+	// tag key -> value
+	Tags map[string]string `yaml:"tags"`
+	// let client-supplied tags with the same key win
+	AllowOverride bool `yaml:"allow_override"`
+}
+
+// Defaults are tags added to every metric
+type Defaults struct {
+	tags          [][2]string
+	allowOverride bool
+}
+
+/*
+Load builds the default tags from a YAML file and the --default-tags
+flag (comma-separated key=value pairs), the flag winning for keys in
+both:
+
+	tags:
+	  environment: production
+	  region: "@region"
+	  version: ${APP_VERSION}
+	allow_override: false
+
+Nothing set means no default tags
+*/
+func Load(path string, spec string, allowOverride bool) (*Defaults, error) {
+	cfg := Config{Tags: map[string]string{}, AllowOverride: allowOverride}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, err
+		}
+		// either may allow overrides
+		cfg.AllowOverride = cfg.AllowOverride || allowOverride
+		if cfg.Tags == nil {
+			cfg.Tags = map[string]string{}
+		}
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid default tag %q, must be key=value", pair)
+		}
+		cfg.Tags[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	if len(cfg.Tags) == 0 {
+		return nil, nil
+	}
+	return New(cfg)
+}
+
+// New resolves the tag values, refusing bad keys and values that resolve to nothing
+func New(cfg Config) (*Defaults, error) {
+	d := &Defaults{allowOverride: cfg.AllowOverride}
+	for key, value := range cfg.Tags {
+		if !tagformat.ValidKey(key) {
+			return nil, fmt.Errorf("Invalid default tag key %q", key)
+		}
+		resolved, err := Resolve(value)
+		if err != nil {
+			return nil, fmt.Errorf("Default tag %q: %v", key, err)
+		}
+		if resolved == "" {
+			return nil, fmt.Errorf("Default tag %q resolved to an empty value", key)
+		}
+		d.tags = append(d.tags, [2]string{key, tagformat.Escape(resolved)})
+	}
+
+	// map order is random, keep tags stable
+	sort.Slice(d.tags, func(i, j int) bool { return d.tags[i][0] < d.tags[j][0] })
+	return d, nil
+}
+
+/*
+Resolve works out a tag value once, at startup. @hostname is the
+host's name, @pod the Kubernetes pod (POD_NAME, or HOSTNAME, which
+Kubernetes sets to it) and @region the first of REGION, AWS_REGION,
+AWS_DEFAULT_REGION and FLY_REGION set. Anything else has $VAR and ${VAR}
+replaced by environment variables
+*/
+func Resolve(value string) (string, error) {
+	switch value {
+	case "@hostname":
+		return os.Hostname()
+	case "@pod":
+		if pod := os.Getenv("POD_NAME"); pod != "" {
+			return pod, nil
+		}
+		return os.Getenv("HOSTNAME"), nil
+	case "@region":
+		for _, name := range regionVars {
+			if region := os.Getenv(name); region != "" {
+				return region, nil
+			}
+		}
+		return "", nil
+	}
+	if strings.HasPrefix(value, "@") {
+		return "", fmt.Errorf("Unknown host value %q, must be @hostname, @pod or @region", value)
+	}
+	return os.ExpandEnv(value), nil
+}
+
+// Tags returns the resolved tags, sorted by key
+func (d *Defaults) Tags() [][2]string {
+	if d == nil {
+		return nil
+	}
+	return d.tags
+}
+
+/*
+Apply merges the default tags into a metric's comma-separated tags.
+Client-supplied tags with the same key are replaced, or win over the
+default if overrides are allowed. Keys are compared as the processor
+may rewrite them afterwards (lowercased by --normalize, with characters
+replaced by --prometheus-compat), so a metric never ends up with two
+*/
+func (d *Defaults) Apply(tags string) string {
+	if d == nil {
+		return tags
+	}
+	client := map[string]bool{}
+	pairs := []string{}
+	for _, pair := range strings.Split(tags, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key := canonicalTagKey(strings.TrimSpace(strings.SplitN(pair, "=", 2)[0]))
+		if !d.allowOverride && d.has(key) {
+			continue
+		}
+		client[key] = true
+		pairs = append(pairs, pair)
+	}
+	for _, tag := range d.tags {
+		if !client[canonicalTagKey(tag[0])] {
+			pairs = append(pairs, tag[0]+"="+tag[1])
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (d *Defaults) has(key string) bool {
+	for _, tag := range d.tags {
+		if canonicalTagKey(tag[0]) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalTagKey is a tag key the way the processor could end up sending it
+func canonicalTagKey(key string) string {
+	return strings.ToLower(promTagKeyChars.ReplaceAllString(key, "_"))
+}
@@ -0,0 +1,76 @@
+package defaulttags
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	t.Setenv("APP_VERSION", "1.4.2")
+	t.Setenv("POD_NAME", "proxy-7d9f")
+	t.Setenv("REGION", "")
+	t.Setenv("AWS_REGION", "eu-west-1")
+
+	path := filepath.Join(t.TempDir(), "tags.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+tags:
+  environment: staging
+  version: ${APP_VERSION}
+  pod: "@pod"
+  region: "@region"
+`), 0600))
+
+	defaults, err := Load(path, "environment=production,team=web", false)
+	require.NoError(t, err)
+	require.Equal(t, [][2]string{
+		{"environment", "production"},
+		{"pod", "proxy-7d9f"},
+		{"region", "eu-west-1"},
+		{"team", "web"},
+		{"version", "1.4.2"},
+	}, defaults.Tags())
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	defaults, err = Load("", "host=@hostname", false)
+	require.NoError(t, err)
+	require.Equal(t, [][2]string{{"host", hostname}}, defaults.Tags())
+
+	defaults, err = Load("", "", false)
+	require.NoError(t, err)
+	require.Nil(t, defaults)
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Setenv("MISSING_VAR", "")
+	for _, spec := range []string{
+		"environment",
+		"9lives=yes",
+		"version=$MISSING_VAR",
+		"zone=@zone",
+	} {
+		_, err := Load("", spec, false)
+		require.Error(t, err, spec)
+	}
+}
+
+func TestApply(t *testing.T) {
+	defaults, err := New(Config{Tags: map[string]string{"environment": "production", "team": "web team"}})
+	require.NoError(t, err)
+	require.Equal(t, "route=/cart,environment=production,team=web_team", defaults.Apply("route=/cart,environment=dev"))
+	require.Equal(t, "environment=production,team=web_team", defaults.Apply(""))
+	// keys the processor would turn into a default's are replaced too
+	require.Equal(t, "environment=production,team=web_team", defaults.Apply("Environment=dev"))
+
+	defaults, err = New(Config{Tags: map[string]string{"environment": "production"}, AllowOverride: true})
+	require.NoError(t, err)
+	require.Equal(t, "route=/cart,environment=dev", defaults.Apply("route=/cart,environment=dev"))
+	require.Equal(t, "route=/cart,environment=production", defaults.Apply("route=/cart"))
+	require.Equal(t, "ENVIRONMENT=dev", defaults.Apply("ENVIRONMENT=dev"))
+
+	var none *Defaults
+	require.Equal(t, "a=b", none.Apply("a=b"))
+}
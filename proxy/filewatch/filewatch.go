@@ -0,0 +1,110 @@
+/*
+Package filewatch reloads configuration files when they change, for the
+key, secret and certificate sets that can be rotated without a restart
+*/
+package filewatch
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Snapshot is the modification times of a set of files, as of when they were loaded
+type Snapshot map[string]time.Time
+
+/*
+Take stats files, erroring if any is missing. Loaders take it before
+reading the files, so a change made while they read is seen next time
+*/
+func Take(files ...string) (Snapshot, error) {
+	s := Snapshot{}
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		s[f] = info.ModTime()
+	}
+	return s, nil
+}
+
+// TakeOptional stats a file that doesn't have to exist yet, recording it as never modified if it doesn't
+func TakeOptional(file string) (Snapshot, error) {
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return Snapshot{file: time.Time{}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return Snapshot{file: info.ModTime()}, nil
+}
+
+/*
+Changed is true if any file was modified since the snapshot. A missing
+file is a change (and will fail loudly on reload) if it existed then
+*/
+func (s Snapshot) Changed() bool {
+	for f, modTime := range s {
+		info, err := os.Stat(f)
+		if os.IsNotExist(err) {
+			if !modTime.IsZero() {
+				return true
+			}
+			continue
+		}
+		if err != nil || !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watcher describes what a Watch loop reloads
+type Watcher struct {
+	// what's reloaded, for logs, e.g. "JWT secrets"
+	What string
+	// prefix of the <metric>_reloads_total and <metric>_reload_errors_total counters
+	Metric  string
+	Changed func() bool
+	Reload  func() error
+	// optional, fields to log after a reload
+	Fields func() log.Fields
+	// optional, run every interval after checking for changes
+	Tick func()
+}
+
+/*
+Watch reloads whenever Changed reports a change, checking every
+interval. A failed reload keeps what was loaded before
+*/
+func (w Watcher) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		w.check()
+		if w.Tick != nil {
+			w.Tick()
+		}
+	}
+}
+
+func (w Watcher) check() {
+	if !w.Changed() {
+		return
+	}
+	if err := w.Reload(); err != nil {
+		log.WithFields(log.Fields{"error": err}).Errorf("Failed to reload %s, keeping the current ones", w.What)
+		vmmetrics.GetOrCreateCounter(fmt.Sprintf("%s_reload_errors_total", w.Metric)).Inc()
+		return
+	}
+	fields := log.Fields{}
+	if w.Fields != nil {
+		fields = w.Fields()
+	}
+	log.WithFields(fields).Infof("Reloaded %s", w.What)
+	vmmetrics.GetOrCreateCounter(fmt.Sprintf("%s_reloads_total", w.Metric)).Inc()
+}
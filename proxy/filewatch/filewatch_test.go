@@ -0,0 +1,82 @@
+package filewatch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotChanged(t *testing.T) {
+	rt := require.New(t)
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	rt.NoError(os.WriteFile(a, []byte("a"), 0600))
+	rt.NoError(os.WriteFile(b, []byte("b"), 0600))
+
+	_, err := Take(a, filepath.Join(dir, "missing"))
+	rt.Error(err)
+
+	snapshot, err := Take(a, b)
+	rt.NoError(err)
+	rt.False(snapshot.Changed())
+
+	future := time.Now().Add(time.Hour)
+	rt.NoError(os.Chtimes(b, future, future))
+	rt.True(snapshot.Changed())
+
+	// a missing file is a change once it existed
+	snapshot, err = Take(a, b)
+	rt.NoError(err)
+	rt.NoError(os.Remove(b))
+	rt.True(snapshot.Changed())
+}
+
+func TestTakeOptional(t *testing.T) {
+	rt := require.New(t)
+	path := filepath.Join(t.TempDir(), "optional")
+
+	snapshot, err := TakeOptional(path)
+	rt.NoError(err)
+	rt.False(snapshot.Changed())
+
+	rt.NoError(os.WriteFile(path, []byte("a"), 0600))
+	rt.True(snapshot.Changed())
+
+	snapshot, err = TakeOptional(path)
+	rt.NoError(err)
+	rt.False(snapshot.Changed())
+	rt.NoError(os.Remove(path))
+	rt.True(snapshot.Changed())
+}
+
+func TestWatcherReloadsOnlyWhenChanged(t *testing.T) {
+	rt := require.New(t)
+	changed := false
+	var reloadErr error
+	reloads := 0
+	w := Watcher{
+		What:    "test files",
+		Metric:  "test",
+		Changed: func() bool { return changed },
+		Reload: func() error {
+			reloads++
+			return reloadErr
+		},
+	}
+
+	w.check()
+	rt.Equal(0, reloads)
+
+	changed = true
+	w.check()
+	rt.Equal(1, reloads)
+
+	reloadErr = errors.New("bad file")
+	w.check()
+	rt.Equal(2, reloads)
+}
@@ -0,0 +1,205 @@
+package graphite
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// largest pickle payload we'll accept (16 MB)
+const maxPickleSize = 16 * 1024 * 1024
+
+// longest plaintext line (or pickle opcode argument) we'll accept
+const maxLineLength = 64 * 1024
+
+// how long a sender may sit idle before we hang up
+const connIdleTimeout = 5 * time.Minute
+
+var (
+	graphiteSamples        = vmmetrics.NewCounter("graphite_samples_total")
+	graphiteSamplesInvalid = vmmetrics.NewCounter("graphite_samples_invalid_total")
+)
+
+// ToMetrics converts samples into metric requests, counting them and skipping any that can't be converted
+func (m *Mapper) ToMetrics(samples []Sample) []config.MetricRequest {
+	metrics := make([]config.MetricRequest, 0, len(samples))
+	for _, s := range samples {
+		graphiteSamples.Inc()
+		metric, err := m.ToMetric(s)
+		if err != nil {
+			Invalid([]error{err})
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+// Enqueue hands samples to the processor, skipping (and counting) names that would forge tags
+func (m *Mapper) Enqueue(samples []Sample) {
+	for _, metric := range m.ToMetrics(samples) {
+		if err := config.CheckMetricName(metric.Metric); err != nil {
+			Invalid([]error{err})
+			config.DroppedMetrics.Inc()
+			continue
+		}
+		config.ProcessChan <- metric
+	}
+}
+
+// Invalid records samples we couldn't parse
+func Invalid(errs []error) {
+	for _, err := range errs {
+		graphiteSamplesInvalid.Inc()
+		log.WithFields(log.Fields{"error": err}).Debug("Invalid graphite sample")
+	}
+}
+
+// Listener accepts Graphite plaintext or pickle connections over TCP
+type Listener struct {
+	address  string
+	pickle   bool
+	mapper   *Mapper
+	listener net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// NewListener creates a plaintext (or, if pickle is set, a pickle protocol) listener
+func NewListener(address string, pickle bool, mapper *Mapper) *Listener {
+	return &Listener{
+		address: address,
+		pickle:  pickle,
+		mapper:  mapper,
+		conns:   map[net.Conn]struct{}{},
+	}
+}
+
+// Listen binds the listening socket
+func (l *Listener) Listen() error {
+	listener, err := net.Listen("tcp", l.address)
+	if err != nil {
+		return err
+	}
+	l.listener = listener
+	return nil
+}
+
+// Serve accepts connections until Close is called
+func (l *Listener) Serve() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.WithFields(log.Fields{"error": err}).Error("Failed to accept graphite connection")
+			continue
+		}
+
+		l.mu.Lock()
+		l.conns[conn] = struct{}{}
+		l.wg.Add(1)
+		l.mu.Unlock()
+
+		go func() {
+			defer func() {
+				l.mu.Lock()
+				delete(l.conns, conn)
+				l.mu.Unlock()
+				conn.Close()
+				l.wg.Done()
+			}()
+			if l.pickle {
+				l.servePickle(conn)
+			} else {
+				l.servePlaintext(conn)
+			}
+		}()
+	}
+}
+
+// Close stops accepting connections, hangs up on open ones and waits for them to finish
+func (l *Listener) Close() error {
+	if l.listener == nil {
+		return nil
+	}
+	err := l.listener.Close()
+
+	l.mu.Lock()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+
+	return err
+}
+
+// senders of lines longer than maxLineLength are hung up on, rather than buffered without end
+func (l *Listener) servePlaintext(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineLength)
+	for {
+		conn.SetReadDeadline(time.Now().Add(connIdleTimeout))
+		if !scanner.Scan() {
+			break
+		}
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			if s, err := ParseLine(line); err != nil {
+				Invalid([]error{err})
+			} else {
+				l.mapper.Enqueue([]Sample{s})
+			}
+		}
+	}
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		Invalid([]error{err})
+		log.WithFields(log.Fields{"remote": conn.RemoteAddr().String()}).Error("Graphite line too long, closing connection")
+	} else if err != nil {
+		log.WithFields(log.Fields{"error": err}).Debug("Graphite connection closed")
+	}
+}
+
+// pickle payloads are framed with a 4 byte big-endian length
+func (l *Listener) servePickle(conn net.Conn) {
+	header := make([]byte, 4)
+	for {
+		conn.SetReadDeadline(time.Now().Add(connIdleTimeout))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if err != io.EOF {
+				log.WithFields(log.Fields{"error": err}).Debug("Graphite pickle connection closed")
+			}
+			return
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > maxPickleSize {
+			log.WithFields(log.Fields{"size": size}).Error("Graphite pickle payload too large")
+			return
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			log.WithFields(log.Fields{"error": err}).Debug("Graphite pickle connection closed")
+			return
+		}
+
+		samples, err := ParsePickle(payload)
+		if err != nil {
+			// we can't trust the rest of the stream either
+			Invalid([]error{err})
+			return
+		}
+		l.mapper.Enqueue(samples)
+	}
+}
@@ -0,0 +1,49 @@
+package graphite
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnqueueSkipsForgedTags(t *testing.T) {
+	mapper, err := NewMapper(nil)
+	require.NoError(t, err)
+
+	mapper.Enqueue([]Sample{{Path: "web.paid,tenant=victim", Value: 1}, {Path: "web.paid", Value: 1}})
+	m := <-config.ProcessChan
+	require.Equal(t, "web.paid", m.Metric)
+	require.Empty(t, config.ProcessChan)
+}
+
+func TestPlaintextLineTooLong(t *testing.T) {
+	mapper, err := NewMapper(nil)
+	require.NoError(t, err)
+	listener := NewListener("127.0.0.1:0", false, mapper)
+	require.NoError(t, listener.Listen())
+	go listener.Serve()
+	defer listener.Close()
+	rt := require.New(t)
+
+	conn, err := net.Dial("tcp", listener.listener.Addr().String())
+	rt.NoError(err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("web.ok 1 1700000000\n"))
+	rt.NoError(err)
+	m := <-config.ProcessChan
+	rt.Equal("web.ok", m.Metric)
+
+	// the server hangs up rather than buffering the line
+	go conn.Write([]byte(strings.Repeat("a", maxLineLength+1)))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = bufio.NewReader(conn).ReadByte()
+	rt.Error(err)
+	rt.False(errors.Is(err, os.ErrDeadlineExceeded), "connection still open")
+}
@@ -0,0 +1,123 @@
+package graphite
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/tagformat"
+	"gopkg.in/yaml.v3"
+)
+
+// Graphite only has one kind of metric, so anything unmatched is a gauge
+const defaultMetricType = "gauge"
+
+// Rule maps matching Graphite paths to a StatsD metric type
+type Rule struct {
+	// Graphite-style glob, where * matches within a single path node
+	Match string `yaml:"match"`
+	// or a regular expression against the whole path
+	Regex string `yaml:"regex"`
+	// count, gauge, timing or set
+	Type string `yaml:"type"`
+
+	pattern *regexp.Regexp
+}
+
+// Mapper turns Graphite samples into metrics using the first matching rule
+type Mapper struct {
+	rules []Rule
+}
+
+/*
+LoadMapper reads mapping rules from a YAML file:
+
+  - match: "cron.*.runs"
+    type: count
+  - regex: "^cron\\..*\\.duration_ms$"
+    type: timing
+
+An empty path maps everything to gauges
+*/
+func LoadMapper(path string) (*Mapper, error) {
+	if path == "" {
+		return &Mapper{}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	return NewMapper(rules)
+}
+
+// NewMapper validates and compiles a list of rules
+func NewMapper(rules []Rule) (*Mapper, error) {
+	for i := range rules {
+		r := &rules[i]
+		switch r.Type {
+		case "count", "gauge", "timing", "set":
+		default:
+			return nil, fmt.Errorf("Rule %d: invalid metric type %q", i, r.Type)
+		}
+
+		var err error
+		switch {
+		case r.Match != "" && r.Regex != "":
+			return nil, fmt.Errorf("Rule %d: only one of match and regex may be set", i)
+		case r.Match != "":
+			r.pattern, err = regexp.Compile(globToRegex(r.Match))
+		case r.Regex != "":
+			r.pattern, err = regexp.Compile(r.Regex)
+		default:
+			return nil, fmt.Errorf("Rule %d: one of match or regex is required", i)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Rule %d: %v", i, err)
+		}
+	}
+	return &Mapper{rules: rules}, nil
+}
+
+// ToMetric converts a sample into a metric request. StatsD values are integers, so it fails for values that can't be one
+func (m *Mapper) ToMetric(s Sample) (config.MetricRequest, error) {
+	value := math.Round(s.Value)
+	// float64(math.MaxInt64) rounds up to 2^63, which is already out of range
+	if math.IsNaN(value) || value >= math.MaxInt64 || value < math.MinInt64 {
+		return config.MetricRequest{}, fmt.Errorf("Value %v of %q is out of range", s.Value, s.Path)
+	}
+
+	metricType := defaultMetricType
+	for _, r := range m.rules {
+		if r.pattern.MatchString(s.Path) {
+			metricType = r.Type
+			break
+		}
+	}
+
+	tags := make([]string, 0, len(s.Tags))
+	for _, t := range s.Tags {
+		tags = append(tags, tagformat.Escape(t[0])+"="+tagformat.Escape(t[1]))
+	}
+
+	return config.MetricRequest{
+		Metric:     s.Path,
+		Value:      int64(value),
+		Tags:       strings.Join(tags, ","),
+		MetricType: metricType,
+	}, nil
+}
+
+func globToRegex(glob string) string {
+	parts := strings.Split(glob, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	return "^" + strings.Join(parts, `[^.]*`) + "$"
+}
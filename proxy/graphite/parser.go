@@ -0,0 +1,99 @@
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Sample is a single Graphite datapoint
+type Sample struct {
+	Path  string
+	Tags  [][2]string
+	Value float64
+	// StatsD has no notion of timestamps, so this is informational only
+	Timestamp float64
+}
+
+/*
+ParseLine parses a plaintext protocol line: `path value timestamp`.
+
+The path may carry Graphite 1.1 tags: `path;tag1=value1;tag2=value2`
+*/
+func ParseLine(line string) (Sample, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 && len(fields) != 2 {
+		return Sample{}, fmt.Errorf("Expected 'path value timestamp', got %d fields", len(fields))
+	}
+
+	value, err := parseValue(fields[1])
+	if err != nil {
+		return Sample{}, err
+	}
+	var timestamp float64
+	if len(fields) == 3 {
+		timestamp, err = strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return Sample{}, fmt.Errorf("Invalid timestamp %q", fields[2])
+		}
+	}
+
+	path, tags, err := parsePath(fields[0])
+	if err != nil {
+		return Sample{}, err
+	}
+
+	return Sample{Path: path, Tags: tags, Value: value, Timestamp: timestamp}, nil
+}
+
+// ParsePlaintext parses every line in a plaintext payload, returning the errors for any bad lines
+func ParsePlaintext(data []byte) ([]Sample, []error) {
+	samples := []Sample{}
+	errs := []error{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		s, err := ParseLine(line)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		samples = append(samples, s)
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return samples, errs
+}
+
+func parsePath(raw string) (string, [][2]string, error) {
+	parts := strings.Split(raw, ";")
+	path := parts[0]
+	if path == "" {
+		return "", nil, fmt.Errorf("Empty metric path")
+	}
+
+	tags := [][2]string{}
+	for _, t := range parts[1:] {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return "", nil, fmt.Errorf("Invalid tag %q", t)
+		}
+		tags = append(tags, [2]string{kv[0], kv[1]})
+	}
+	return path, tags, nil
+}
+
+func parseValue(raw string) (float64, error) {
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("Invalid value %q", raw)
+	}
+	return value, nil
+}
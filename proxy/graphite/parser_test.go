@@ -0,0 +1,75 @@
+package graphite
+
+import (
+	"math"
+	"testing"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	rt := require.New(t)
+
+	s, err := ParseLine("cron.backup.runs 1 1666000000")
+	rt.NoError(err)
+	rt.Equal(Sample{Path: "cron.backup.runs", Tags: [][2]string{}, Value: 1, Timestamp: 1666000000}, s)
+
+	s, err = ParseLine("cron.backup.duration;host=db1;env=prod 12.5 1666000000")
+	rt.NoError(err)
+	rt.Equal("cron.backup.duration", s.Path)
+	rt.Equal([][2]string{{"host", "db1"}, {"env", "prod"}}, s.Tags)
+	rt.Equal(12.5, s.Value)
+
+	for _, bad := range []string{"only.path", "a.b nope 1", "a.b 1 nope", "a.b;host 1 1", ";host=x 1 1", "a.b NaN 1"} {
+		_, err := ParseLine(bad)
+		rt.Error(err, bad)
+	}
+}
+
+func TestParsePlaintextCollectsErrors(t *testing.T) {
+	samples, errs := ParsePlaintext([]byte("a.b 1 1666000000\n\nbroken\nc.d 2 1666000000\n"))
+
+	rt := require.New(t)
+	rt.Len(samples, 2)
+	rt.Len(errs, 1)
+}
+
+func TestMapperRules(t *testing.T) {
+	rt := require.New(t)
+
+	mapper, err := NewMapper([]Rule{
+		{Match: "cron.*.runs", Type: "count"},
+		{Regex: `\.duration_ms$`, Type: "timing"},
+	})
+	rt.NoError(err)
+
+	toMetric := func(s Sample) config.MetricRequest {
+		m, err := mapper.ToMetric(s)
+		rt.NoError(err)
+		return m
+	}
+	m := toMetric(Sample{Path: "cron.backup.runs", Value: 1.4})
+	rt.Equal("count", m.MetricType)
+	rt.Equal(int64(1), m.Value)
+	rt.Equal("timing", toMetric(Sample{Path: "cron.backup.duration_ms"}).MetricType)
+	// * doesn't cross path nodes
+	rt.Equal("gauge", toMetric(Sample{Path: "cron.backup.nightly.runs"}).MetricType)
+
+	m = toMetric(Sample{Path: "disk.free", Tags: [][2]string{{"host", "db1"}, {"mount", "/var lib"}}})
+	rt.Equal("host=db1,mount=/var_lib", m.Tags)
+
+	// values StatsD can't take as an integer
+	for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), 1e19, -1e19, math.MaxInt64} {
+		_, err := mapper.ToMetric(Sample{Path: "disk.free", Value: v})
+		rt.Error(err, v)
+	}
+	rt.Equal(int64(-1<<63), toMetric(Sample{Path: "disk.free", Value: math.MinInt64}).Value)
+
+	_, err = NewMapper([]Rule{{Match: "a.*", Type: "histogram"}})
+	rt.Error(err)
+	_, err = NewMapper([]Rule{{Type: "count"}})
+	rt.Error(err)
+	_, err = NewMapper([]Rule{{Regex: "(", Type: "count"}})
+	rt.Error(err)
+}
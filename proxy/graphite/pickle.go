@@ -0,0 +1,483 @@
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+A minimal unpickler for the carbon pickle protocol:
+
+	[(path, (timestamp, value)), ...]
+
+Only the opcodes needed to build lists, tuples, strings and numbers
+are supported. Anything that could construct arbitrary objects
+(GLOBAL, REDUCE, BUILD, ...) is rejected outright.
+*/
+
+// pickleMark separates items on the stack for MARK-based opcodes
+type pickleMark struct{}
+
+// pickleList is mutable (APPEND/APPENDS), unlike tuples
+type pickleList struct {
+	items []interface{}
+}
+
+type unpickler struct {
+	r     *bufio.Reader
+	stack []interface{}
+	memo  map[int]interface{}
+}
+
+// ParsePickle decodes a single pickled list of datapoints
+func ParsePickle(data []byte) ([]Sample, error) {
+	u := &unpickler{r: bufio.NewReaderSize(bytes.NewReader(data), maxLineLength), memo: map[int]interface{}{}}
+	value, err := u.load()
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := value.(*pickleList)
+	if !ok {
+		return nil, fmt.Errorf("Expected a list of datapoints")
+	}
+
+	samples := make([]Sample, 0, len(list.items))
+	for _, item := range list.items {
+		s, err := toSample(item)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+func toSample(item interface{}) (Sample, error) {
+	outer, ok := item.([]interface{})
+	if !ok || len(outer) != 2 {
+		return Sample{}, fmt.Errorf("Expected (path, (timestamp, value))")
+	}
+	rawPath, ok := outer[0].(string)
+	if !ok {
+		return Sample{}, fmt.Errorf("Expected a string path")
+	}
+	point, ok := outer[1].([]interface{})
+	if !ok || len(point) != 2 {
+		return Sample{}, fmt.Errorf("Expected (timestamp, value) for %s", rawPath)
+	}
+	timestamp, ok := toFloat(point[0])
+	if !ok {
+		return Sample{}, fmt.Errorf("Invalid timestamp for %s", rawPath)
+	}
+	value, ok := toFloat(point[1])
+	if !ok || math.IsNaN(value) || math.IsInf(value, 0) {
+		return Sample{}, fmt.Errorf("Invalid value for %s", rawPath)
+	}
+
+	path, tags, err := parsePath(rawPath)
+	if err != nil {
+		return Sample{}, err
+	}
+	return Sample{Path: path, Tags: tags, Value: value, Timestamp: timestamp}, nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		// protocol 0 senders occasionally quote values
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, fmt.Errorf("Pickle stack underflow")
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+func (u *unpickler) top() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, fmt.Errorf("Pickle stack underflow")
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+// popMark pops everything back to the most recent MARK
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(pickleMark); ok {
+			items := make([]interface{}, len(u.stack)-i-1)
+			copy(items, u.stack[i+1:])
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, fmt.Errorf("Pickle mark not found")
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || n > maxPickleSize {
+		return nil, fmt.Errorf("Invalid pickle length %d", n)
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(u.r, buf)
+	return buf, err
+}
+
+// readLine reads a text opcode's argument, which can't be longer than the reader's buffer
+func (u *unpickler) readLine() (string, error) {
+	line, err := u.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", fmt.Errorf("Pickle line longer than %d bytes", maxLineLength)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(line), "\n"), nil
+}
+
+func (u *unpickler) readUint(n int) (uint64, error) {
+	b, err := u.read(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := n - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+func (u *unpickler) appendTo(target interface{}, items ...interface{}) error {
+	list, ok := target.(*pickleList)
+	if !ok {
+		return fmt.Errorf("Pickle append to non-list")
+	}
+	list.items = append(list.items, items...)
+	return nil
+}
+
+func (u *unpickler) load() (interface{}, error) {
+	for {
+		op, err := u.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case 0x80: // PROTO
+			if _, err := u.r.ReadByte(); err != nil {
+				return nil, err
+			}
+		case 0x95: // FRAME
+			if _, err := u.read(8); err != nil {
+				return nil, err
+			}
+		case '.': // STOP
+			return u.pop()
+		case '(': // MARK
+			u.push(pickleMark{})
+		case '0': // POP
+			if _, err := u.pop(); err != nil {
+				return nil, err
+			}
+		case '1': // POP_MARK
+			if _, err := u.popMark(); err != nil {
+				return nil, err
+			}
+		case '2': // DUP
+			v, err := u.top()
+			if err != nil {
+				return nil, err
+			}
+			u.push(v)
+
+		// containers
+		case ']': // EMPTY_LIST
+			u.push(&pickleList{})
+		case 'l': // LIST
+			items, err := u.popMark()
+			if err != nil {
+				return nil, err
+			}
+			u.push(&pickleList{items: items})
+		case 'a': // APPEND
+			v, err := u.pop()
+			if err != nil {
+				return nil, err
+			}
+			target, err := u.top()
+			if err != nil {
+				return nil, err
+			}
+			if err := u.appendTo(target, v); err != nil {
+				return nil, err
+			}
+		case 'e': // APPENDS
+			items, err := u.popMark()
+			if err != nil {
+				return nil, err
+			}
+			target, err := u.top()
+			if err != nil {
+				return nil, err
+			}
+			if err := u.appendTo(target, items...); err != nil {
+				return nil, err
+			}
+		case ')': // EMPTY_TUPLE
+			u.push([]interface{}{})
+		case 't': // TUPLE
+			items, err := u.popMark()
+			if err != nil {
+				return nil, err
+			}
+			u.push(items)
+		case 0x85, 0x86, 0x87: // TUPLE1, TUPLE2, TUPLE3
+			n := int(op-0x85) + 1
+			if len(u.stack) < n {
+				return nil, fmt.Errorf("Pickle stack underflow")
+			}
+			items := make([]interface{}, n)
+			copy(items, u.stack[len(u.stack)-n:])
+			u.stack = u.stack[:len(u.stack)-n]
+			u.push(items)
+
+		// numbers
+		case 'N': // NONE
+			u.push(nil)
+		case 0x88: // NEWTRUE
+			u.push(true)
+		case 0x89: // NEWFALSE
+			u.push(false)
+		case 'K': // BININT1
+			v, err := u.readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			u.push(int64(v))
+		case 'M': // BININT2
+			v, err := u.readUint(2)
+			if err != nil {
+				return nil, err
+			}
+			u.push(int64(v))
+		case 'J': // BININT
+			v, err := u.readUint(4)
+			if err != nil {
+				return nil, err
+			}
+			u.push(int64(int32(uint32(v))))
+		case 0x8a: // LONG1
+			n, err := u.readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			if n > 8 {
+				return nil, fmt.Errorf("Pickle integer too large")
+			}
+			v, err := u.readUint(int(n))
+			if err != nil {
+				return nil, err
+			}
+			// sign extend the little-endian two's complement value
+			if n > 0 && n < 8 && v&(1<<(8*n-1)) != 0 {
+				v |= ^uint64(0) << (8 * n)
+			}
+			u.push(int64(v))
+		case 'I', 'L': // INT, LONG
+			line, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			switch line {
+			case "01":
+				u.push(true)
+			case "00":
+				u.push(false)
+			default:
+				v, err := strconv.ParseInt(strings.TrimSuffix(line, "L"), 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				u.push(v)
+			}
+		case 'G': // BINFLOAT
+			b, err := u.read(8)
+			if err != nil {
+				return nil, err
+			}
+			u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+		case 'F': // FLOAT
+			line, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			v, err := strconv.ParseFloat(line, 64)
+			if err != nil {
+				return nil, err
+			}
+			u.push(v)
+
+		// strings
+		case 'S': // STRING
+			line, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			v, err := strconv.Unquote(line)
+			if err != nil {
+				// python may single-quote strings
+				v = strings.Trim(line, `'"`)
+			}
+			u.push(v)
+		case 'V': // UNICODE
+			line, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			u.push(line)
+		case 'U', 'C', 0x8c: // SHORT_BINSTRING, SHORT_BINBYTES, SHORT_BINUNICODE
+			n, err := u.readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			b, err := u.read(int(n))
+			if err != nil {
+				return nil, err
+			}
+			u.push(string(b))
+		case 'T', 'B', 'X': // BINSTRING, BINBYTES, BINUNICODE
+			n, err := u.readUint(4)
+			if err != nil {
+				return nil, err
+			}
+			b, err := u.read(int(n))
+			if err != nil {
+				return nil, err
+			}
+			u.push(string(b))
+		case 0x8d: // BINUNICODE8
+			n, err := u.readUint(8)
+			if err != nil {
+				return nil, err
+			}
+			if n > maxPickleSize {
+				return nil, fmt.Errorf("Invalid pickle length %d", n)
+			}
+			b, err := u.read(int(n))
+			if err != nil {
+				return nil, err
+			}
+			u.push(string(b))
+
+		// memo
+		case 'p': // PUT
+			line, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			idx, err := strconv.Atoi(line)
+			if err != nil {
+				return nil, err
+			}
+			if err := u.put(idx); err != nil {
+				return nil, err
+			}
+		case 'q': // BINPUT
+			idx, err := u.readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			if err := u.put(int(idx)); err != nil {
+				return nil, err
+			}
+		case 'r': // LONG_BINPUT
+			idx, err := u.readUint(4)
+			if err != nil {
+				return nil, err
+			}
+			if err := u.put(int(idx)); err != nil {
+				return nil, err
+			}
+		case 0x94: // MEMOIZE
+			if err := u.put(len(u.memo)); err != nil {
+				return nil, err
+			}
+		case 'g': // GET
+			line, err := u.readLine()
+			if err != nil {
+				return nil, err
+			}
+			idx, err := strconv.Atoi(line)
+			if err != nil {
+				return nil, err
+			}
+			if err := u.get(idx); err != nil {
+				return nil, err
+			}
+		case 'h': // BINGET
+			idx, err := u.readUint(1)
+			if err != nil {
+				return nil, err
+			}
+			if err := u.get(int(idx)); err != nil {
+				return nil, err
+			}
+		case 'j': // LONG_BINGET
+			idx, err := u.readUint(4)
+			if err != nil {
+				return nil, err
+			}
+			if err := u.get(int(idx)); err != nil {
+				return nil, err
+			}
+
+		default:
+			return nil, fmt.Errorf("Unsupported pickle opcode 0x%02x", op)
+		}
+	}
+}
+
+func (u *unpickler) put(idx int) error {
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	u.memo[idx] = v
+	return nil
+}
+
+func (u *unpickler) get(idx int) error {
+	v, ok := u.memo[idx]
+	if !ok {
+		return fmt.Errorf("Pickle memo %d not found", idx)
+	}
+	u.push(v)
+	return nil
+}
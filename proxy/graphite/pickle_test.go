@@ -0,0 +1,55 @@
+package graphite
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// the same samples pickled with each protocol N, from
+//
+//	pickle.dumps([("cron.backup.runs", (1666000000, 1)), ("cron.backup.duration;host=db1", (1666000000.5, 1234.6)),
+//	              ("big", (1666000000, 2**40)), ("neg", (1666000000, -3))], protocol=N)
+var pickles = map[int]string{
+	0: "(lp0\x0a(Vcron.backup.runs\x0ap1\x0a(I1666000000\x0aI1\x0atp2\x0atp3\x0aa(Vcron.backup.duration;host=db1\x0ap4\x0a(F1666000000.5\x0aF1234.6\x0atp5\x0atp6\x0aa(Vbig\x0ap7\x0a(I1666000000\x0aL1099511627776L\x0atp8\x0atp9\x0aa(Vneg\x0ap10\x0a(I1666000000\x0aI-3\x0atp11\x0atp12\x0aa.",
+	2: "\x80\x02]q\x00(X\x10\x00\x00\x00cron.backup.runsq\x01J\x80$McK\x01\x86q\x02\x86q\x03X\x1d\x00\x00\x00cron.backup.duration;host=db1q\x04GA\xd8\xd3I  \x00\x00G@\x93Jfffff\x86q\x05\x86q\x06X\x03\x00\x00\x00bigq\x07J\x80$Mc\x8a\x06\x00\x00\x00\x00\x00\x01\x86q\x08\x86q\x09X\x03\x00\x00\x00negq\x0aJ\x80$McJ\xfd\xff\xff\xff\x86q\x0b\x86q\x0ce.",
+	4: "\x80\x04\x95\x84\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x10cron.backup.runs\x94J\x80$McK\x01\x86\x94\x86\x94\x8c\x1dcron.backup.duration;host=db1\x94GA\xd8\xd3I  \x00\x00G@\x93Jfffff\x86\x94\x86\x94\x8c\x03big\x94J\x80$Mc\x8a\x06\x00\x00\x00\x00\x00\x01\x86\x94\x86\x94\x8c\x03neg\x94J\x80$McJ\xfd\xff\xff\xff\x86\x94\x86\x94e.",
+}
+
+func TestParsePickleProtocols(t *testing.T) {
+	for protocol, data := range pickles {
+		samples, err := ParsePickle([]byte(data))
+		rt := require.New(t)
+		rt.NoError(err, "protocol %d", protocol)
+		rt.Len(samples, 4)
+
+		rt.Equal(Sample{Path: "cron.backup.runs", Tags: [][2]string{}, Value: 1, Timestamp: 1666000000}, samples[0])
+		rt.Equal("cron.backup.duration", samples[1].Path)
+		rt.Equal([][2]string{{"host", "db1"}}, samples[1].Tags)
+		rt.Equal(1234.6, samples[1].Value)
+		rt.Equal(float64(1<<40), samples[2].Value)
+		rt.Equal(float64(-3), samples[3].Value)
+	}
+}
+
+func TestParsePickleRejectsGlobals(t *testing.T) {
+	// pickle.dumps of an os.system call
+	_, err := ParsePickle([]byte("cos\x0asystem\x0a(S'echo hi'\x0atR."))
+
+	require.Error(t, err)
+}
+
+func TestParsePickleRejectsTruncated(t *testing.T) {
+	data := pickles[2]
+	_, err := ParsePickle([]byte(data[:len(data)-10]))
+
+	require.Error(t, err)
+}
+
+func TestParsePickleRejectsLongLines(t *testing.T) {
+	// a protocol 0 string argument with no end in sight
+	_, err := ParsePickle([]byte("(lp0\x0a(V" + strings.Repeat("a", maxLineLength+1)))
+
+	require.ErrorContains(t, err, "longer than")
+}
@@ -0,0 +1,244 @@
+package issuer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/middleware"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/ratelimit"
+	"github.com/golang-jwt/jwt"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultTTL       = 5 * time.Minute
+	defaultRateLimit = 1
+	defaultBurst     = 5
+	// how long the session check may take
+	verifyTimeout = 2 * time.Second
+	// prefix of the subject for sessions the verify URL doesn't name
+	anonymousSubjectPrefix = "browser:"
+)
+
+var tokensIssued = vmmetrics.NewCounter("tokens_issued_total")
+
+// Config describes how browsers prove their session, and what they get for it
+type Config struct {
+	// lifetime of issued tokens, in seconds
+	TTL     int           `yaml:"ttl"`
+	Session SessionConfig `yaml:"session"`
+	// the scope every issued token carries
+	Scope middleware.Scope `yaml:"scope"`
+	// issued tokens per second per session, and how many may be issued at once
+	RateLimit float64 `yaml:"rate_limit"`
+	Burst     int     `yaml:"burst"`
+}
+
+// SessionConfig is the session proof: a trusted header, or a cookie our app can vouch for
+type SessionConfig struct {
+	// header set (and stripped from client requests) by a trusted upstream, holding the user
+	Header string `yaml:"header"`
+	// session cookie, checked by forwarding it to VerifyURL
+	Cookie    string `yaml:"cookie"`
+	VerifyURL string `yaml:"verify_url"`
+}
+
+// Issuer mints short-lived, narrowly scoped tokens for proven sessions
+type Issuer struct {
+	config    Config
+	ttl       time.Duration
+	validator *middleware.TokenValidator
+	limiter   *ratelimit.Limiter
+	client    *http.Client
+}
+
+// IssueError is a refused token request
+type IssueError struct {
+	// short, low-cardinality reason for internal metrics
+	Reason string
+	// HTTP status for the response
+	Status int
+	// for rate limited requests
+	RetryAfter time.Duration
+	msg        string
+}
+
+func (e *IssueError) Error() string {
+	return e.msg
+}
+
+/*
+Load reads the issuer config from a YAML file:
+
+	ttl: 300
+	session:
+	  header: X-Authenticated-User
+	scope:
+	  metrics: ["web.*"]
+	  types: ["count", "timing"]
+	rate_limit: 1
+	burst: 5
+
+An empty path disables issuing
+*/
+func Load(path string, validator *middleware.TokenValidator) (*Issuer, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return New(config, validator)
+}
+
+// New validates the config against the token policy
+func New(config Config, validator *middleware.TokenValidator) (*Issuer, error) {
+	s := config.Session
+	switch {
+	case s.Header != "" && s.Cookie != "":
+		return nil, fmt.Errorf("Only one of session header and cookie may be set")
+	case s.Header == "" && s.Cookie == "":
+		return nil, fmt.Errorf("One of session header or cookie is required")
+	case s.Cookie != "" && s.VerifyURL == "":
+		return nil, fmt.Errorf("A session cookie needs a verify_url")
+	}
+
+	ttl := time.Duration(config.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	if max := validator.MaxLifetime(); max > 0 && ttl > max {
+		return nil, fmt.Errorf("Token ttl %s is longer than the maximum lifetime %s", ttl, max)
+	}
+	// make sure we can actually sign
+	if _, err := validator.Sign(jwt.MapClaims{}); err != nil {
+		return nil, err
+	}
+
+	if config.RateLimit <= 0 {
+		config.RateLimit = defaultRateLimit
+	}
+	if config.Burst <= 0 {
+		config.Burst = defaultBurst
+	}
+	idle := time.Duration(float64(config.Burst)/config.RateLimit*float64(time.Second)) + time.Minute
+
+	return &Issuer{
+		config:    config,
+		ttl:       ttl,
+		validator: validator,
+		limiter:   ratelimit.NewLimiter(config.RateLimit, config.Burst, idle),
+		client:    &http.Client{Timeout: verifyTimeout},
+	}, nil
+}
+
+// Issue checks the request's session and mints a token for it, returning the token and its expiry
+func (i *Issuer) Issue(r *http.Request) (string, time.Time, error) {
+	subject, key, err := i.session(r)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if ok, wait := i.limiter.Reserve(key, 1); !ok {
+		return "", time.Time{}, &IssueError{
+			Reason:     "rate_limited",
+			Status:     http.StatusTooManyRequests,
+			RetryAfter: wait,
+			msg:        "Too many token requests",
+		}
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	expires := now.Add(i.ttl)
+	claims := jwt.MapClaims{
+		"sub": subject,
+		"jti": hex.EncodeToString(jti),
+		"iat": now.Unix(),
+		"exp": expires.Unix(),
+	}
+	if len(i.config.Scope.Metrics) > 0 || len(i.config.Scope.Types) > 0 {
+		claims["scope"] = i.config.Scope
+	}
+
+	token, err := i.validator.Sign(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	tokensIssued.Inc()
+	return token, expires, nil
+}
+
+/*
+session returns the proven subject, and the key to rate limit it by.
+Sessions the verify URL doesn't name get a subject (and rate limit)
+of their own from a hash of their cookie, so they aren't all one client
+*/
+func (i *Issuer) session(r *http.Request) (string, string, error) {
+	if i.config.Session.Header != "" {
+		subject := strings.TrimSpace(r.Header.Get(i.config.Session.Header))
+		if subject == "" {
+			return "", "", noSession("Session header missing")
+		}
+		return subject, subject, nil
+	}
+
+	cookie, err := r.Cookie(i.config.Session.Cookie)
+	if err != nil || cookie.Value == "" {
+		return "", "", noSession("Session cookie missing")
+	}
+	subject, err := i.verify(r, cookie)
+	if err != nil {
+		return "", "", err
+	}
+	if subject != "" {
+		return subject, subject, nil
+	}
+	sum := sha256.Sum256([]byte(cookie.Value))
+	subject = anonymousSubjectPrefix + hex.EncodeToString(sum[:])[:16]
+	return subject, subject, nil
+}
+
+// verify asks our app whether a session cookie is valid. A 2xx is valid, and may name the subject ({"sub": "..."})
+func (i *Issuer) verify(r *http.Request, cookie *http.Cookie) (string, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, i.config.Session.VerifyURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.AddCookie(cookie)
+	res, err := i.client.Do(req)
+	if err != nil {
+		return "", &IssueError{Reason: "verify_failed", Status: http.StatusBadGateway, msg: "Cannot verify session"}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return "", noSession("Session is not valid")
+	}
+	var session struct {
+		Sub string `json:"sub"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	json.Unmarshal(body, &session)
+	return session.Sub, nil
+}
+
+func noSession(msg string) error {
+	return &IssueError{Reason: "no_session", Status: http.StatusUnauthorized, msg: msg}
+}
@@ -0,0 +1,133 @@
+package issuer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/middleware"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecret = "somesecret"
+
+func newValidator() *middleware.TokenValidator {
+	return middleware.NewTokenValidator(testSecret, nil, nil, middleware.ClaimsPolicy{Issuer: "statsd-proxy", MaxLifetime: time.Hour}, nil, nil, nil)
+}
+
+func TestIssueForTrustedHeader(t *testing.T) {
+	validator := newValidator()
+	issuer, err := New(Config{
+		Session: SessionConfig{Header: "X-Authenticated-User"},
+		Scope:   middleware.Scope{Metrics: []string{"web.*"}, Types: []string{"count"}},
+	}, validator)
+	require.NoError(t, err)
+	rt := require.New(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/token", nil)
+	req.Header.Set("X-Authenticated-User", "someone")
+	token, expires, err := issuer.Issue(req)
+	rt.NoError(err)
+	rt.WithinDuration(time.Now().Add(defaultTTL), expires, time.Second)
+
+	claims, err := validator.Parse(token)
+	rt.NoError(err)
+	rt.Equal("someone", claims["sub"])
+	rt.Equal("statsd-proxy", claims["iss"])
+	rt.NotEmpty(claims["jti"])
+	scope, err := middleware.ScopeFromContext(middleware.ContextWithClaims(req.Context(), claims))
+	rt.NoError(err)
+	rt.Equal(&middleware.Scope{Metrics: []string{"web.*"}, Types: []string{"count"}}, scope)
+
+	_, _, err = issuer.Issue(httptest.NewRequest(http.MethodPost, "/token", nil))
+	rt.Equal("no_session", err.(*IssueError).Reason)
+}
+
+func TestIssueRateLimitsPerSession(t *testing.T) {
+	issuer, err := New(Config{Session: SessionConfig{Header: "X-Authenticated-User"}, RateLimit: 1, Burst: 2}, newValidator())
+	require.NoError(t, err)
+	rt := require.New(t)
+
+	issue := func(user string) error {
+		req := httptest.NewRequest(http.MethodPost, "/token", nil)
+		req.Header.Set("X-Authenticated-User", user)
+		_, _, err := issuer.Issue(req)
+		return err
+	}
+	rt.NoError(issue("a"))
+	rt.NoError(issue("a"))
+	err = issue("a")
+	rt.Equal("rate_limited", err.(*IssueError).Reason)
+	rt.Greater(err.(*IssueError).RetryAfter, time.Duration(0))
+	rt.NoError(issue("b"))
+}
+
+func TestIssueVerifiesCookie(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err == nil && c.Value == "good" {
+			w.Write([]byte(`{"sub": "user-1"}`))
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer app.Close()
+	validator := newValidator()
+	issuer, err := New(Config{Session: SessionConfig{Cookie: "session", VerifyURL: app.URL}}, validator)
+	require.NoError(t, err)
+	rt := require.New(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/token", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "good"})
+	token, _, err := issuer.Issue(req)
+	rt.NoError(err)
+	claims, err := validator.Parse(token)
+	rt.NoError(err)
+	rt.Equal("user-1", claims["sub"])
+
+	req = httptest.NewRequest(http.MethodPost, "/token", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "forged"})
+	_, _, err = issuer.Issue(req)
+	rt.Equal("no_session", err.(*IssueError).Reason)
+}
+
+func TestAnonymousSessionsHaveTheirOwnSubject(t *testing.T) {
+	// the app vouches for the session without naming it
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer app.Close()
+	validator := newValidator()
+	issuer, err := New(Config{Session: SessionConfig{Cookie: "session", VerifyURL: app.URL}}, validator)
+	require.NoError(t, err)
+	rt := require.New(t)
+
+	subject := func(session string) string {
+		req := httptest.NewRequest(http.MethodPost, "/token", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: session})
+		token, _, err := issuer.Issue(req)
+		rt.NoError(err)
+		claims, err := validator.Parse(token)
+		rt.NoError(err)
+		return claims["sub"].(string)
+	}
+	a := subject("session-a")
+	rt.True(strings.HasPrefix(a, "browser:"), a)
+	rt.Len(a, len("browser:")+16)
+	rt.Equal(a, subject("session-a"))
+	rt.NotEqual(a, subject("session-b"))
+}
+
+func TestNewValidatesConfig(t *testing.T) {
+	rt := require.New(t)
+
+	_, err := New(Config{}, newValidator())
+	rt.Error(err)
+	_, err = New(Config{Session: SessionConfig{Cookie: "session"}}, newValidator())
+	rt.Error(err)
+	_, err = New(Config{Session: SessionConfig{Header: "X-User"}, TTL: 7200}, newValidator())
+	rt.Error(err)
+	// nothing to sign with
+	noSecret := middleware.NewTokenValidator("", nil, nil, middleware.ClaimsPolicy{}, nil, nil, nil)
+	_, err = New(Config{Session: SessionConfig{Header: "X-User"}}, noSecret)
+	rt.Error(err)
+}
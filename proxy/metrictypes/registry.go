@@ -0,0 +1,203 @@
+package metrictypes
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+)
+
+// at most this many conflicting keys are listed
+const maxConflicts = 1000
+
+// ErrConflict is returned for metrics rejected for changing type
+var ErrConflict = errors.New("Metric type conflict")
+
+// Conflict is a metric key sent with more than one type
+type Conflict struct {
+	Key string `json:"key"`
+	// the type it was first seen with
+	Type string `json:"type"`
+	// the other types it was sent with
+	ConflictingTypes []string  `json:"conflicting_types"`
+	Count            int64     `json:"count"`
+	LastSeen         time.Time `json:"last_seen"`
+}
+
+type entry struct {
+	key        string
+	metricType string
+	seen       time.Time
+}
+
+/*
+Registry remembers the first type each final metric key (name and
+tags, as sent to StatsD) was seen with, since StatsD silently mixes up
+a count and a gauge of the same name. Keys are forgotten once they
+haven't been seen with that type for the TTL, or when there are more
+than size keys, least recently seen first
+*/
+type Registry struct {
+	policy string
+	ttl    time.Duration
+	size   int
+
+	mu   sync.Mutex
+	keys map[string]*list.Element
+	// least recently seen first
+	order     *list.List
+	conflicts map[string]*Conflict
+}
+
+/*
+New creates a registry. The policy on conflicts is allow (send the
+metric anyway, only counting it), reject, or rename (append the type
+to the name). "off" disables the registry, returning nil
+*/
+func New(policy string, ttl time.Duration, size int) (*Registry, error) {
+	switch policy {
+	case "off":
+		return nil, nil
+	case "allow", "reject", "rename":
+	default:
+		return nil, fmt.Errorf("Invalid type conflict policy %q, must be off, allow, reject or rename", policy)
+	}
+	if ttl <= 0 || size <= 0 {
+		return nil, fmt.Errorf("Type conflict TTL and size must be above 0")
+	}
+
+	r := &Registry{
+		policy:    policy,
+		ttl:       ttl,
+		size:      size,
+		keys:      map[string]*list.Element{},
+		order:     list.New(),
+		conflicts: map[string]*Conflict{},
+	}
+	vmmetrics.GetOrCreateGauge("metric_types_tracked", func() float64 {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return float64(r.order.Len())
+	})
+	return r, nil
+}
+
+/*
+Apply checks a metric's type against the first one its key (name plus
+the tags suffix) was seen with, returning the name to send it with.
+ErrConflict means the metric should be dropped
+*/
+func (r *Registry) Apply(name string, tags string, metricType string) (string, error) {
+	if r == nil {
+		return name, nil
+	}
+	key := name + tags
+
+	r.mu.Lock()
+	now := time.Now()
+	r.expire(now)
+	el, ok := r.keys[key]
+	if !ok {
+		r.keys[key] = r.order.PushBack(&entry{key: key, metricType: metricType, seen: now})
+		for r.order.Len() > r.size {
+			r.remove(r.order.Front())
+		}
+		r.mu.Unlock()
+		return name, nil
+	}
+	e := el.Value.(*entry)
+	if e.metricType == metricType {
+		e.seen = now
+		r.order.MoveToBack(el)
+		r.mu.Unlock()
+		return name, nil
+	}
+	r.record(key, e.metricType, metricType, now)
+	r.mu.Unlock()
+
+	vmmetrics.GetOrCreateCounter(fmt.Sprintf("metric_type_conflicts_total{policy=%q}", r.policy)).Inc()
+	switch r.policy {
+	case "reject":
+		return "", ErrConflict
+	case "rename":
+		return name + "_" + metricType, nil
+	}
+	return name, nil
+}
+
+// record notes a conflict for the debug listing
+func (r *Registry) record(key string, first string, metricType string, now time.Time) {
+	c, ok := r.conflicts[key]
+	if !ok {
+		if len(r.conflicts) >= maxConflicts {
+			r.expireConflicts(now)
+		}
+		if len(r.conflicts) >= maxConflicts {
+			return
+		}
+		c = &Conflict{Key: key}
+		r.conflicts[key] = c
+	}
+	c.Type = first
+	c.Count++
+	c.LastSeen = now
+	for _, t := range c.ConflictingTypes {
+		if t == metricType {
+			return
+		}
+	}
+	c.ConflictingTypes = append(c.ConflictingTypes, metricType)
+	sort.Strings(c.ConflictingTypes)
+}
+
+// expire forgets keys not seen for the TTL
+func (r *Registry) expire(now time.Time) {
+	for el := r.order.Front(); el != nil; el = r.order.Front() {
+		if now.Sub(el.Value.(*entry).seen) < r.ttl {
+			return
+		}
+		r.remove(el)
+	}
+}
+
+// expireConflicts forgets conflicts not seen for the TTL
+func (r *Registry) expireConflicts(now time.Time) {
+	for key, c := range r.conflicts {
+		if now.Sub(c.LastSeen) >= r.ttl {
+			delete(r.conflicts, key)
+		}
+	}
+}
+
+func (r *Registry) remove(el *list.Element) {
+	delete(r.keys, el.Value.(*entry).key)
+	r.order.Remove(el)
+}
+
+// Conflicts lists the keys sent with conflicting types within the TTL, most frequent first
+func (r *Registry) Conflicts() []Conflict {
+	if r == nil {
+		return []Conflict{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expireConflicts(time.Now())
+
+	conflicts := make([]Conflict, 0, len(r.conflicts))
+	for _, c := range r.conflicts {
+		copied := *c
+		copied.ConflictingTypes = append([]string{}, c.ConflictingTypes...)
+		conflicts = append(conflicts, copied)
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Count != conflicts[j].Count {
+			return conflicts[i].Count > conflicts[j].Count
+		}
+		return conflicts[i].Key < conflicts[j].Key
+	})
+	return conflicts
+}
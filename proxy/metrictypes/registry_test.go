@@ -0,0 +1,95 @@
+package metrictypes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApply(t *testing.T) {
+	rt := require.New(t)
+
+	allow, err := New("allow", time.Minute, 10)
+	rt.NoError(err)
+	name, err := allow.Apply("checkout.total", ",env=prod", "count")
+	rt.NoError(err)
+	rt.Equal("checkout.total", name)
+	name, err = allow.Apply("checkout.total", ",env=prod", "gauge")
+	rt.NoError(err)
+	rt.Equal("checkout.total", name)
+	// other tags are another key
+	_, err = allow.Apply("checkout.total", ",env=dev", "gauge")
+	rt.NoError(err)
+	rt.Len(allow.Conflicts(), 1)
+
+	reject, err := New("reject", time.Minute, 10)
+	rt.NoError(err)
+	reject.Apply("checkout.total", "", "count")
+	_, err = reject.Apply("checkout.total", "", "gauge")
+	rt.ErrorIs(err, ErrConflict)
+	_, err = reject.Apply("checkout.total", "", "count")
+	rt.NoError(err)
+
+	rename, err := New("rename", time.Minute, 10)
+	rt.NoError(err)
+	rename.Apply("checkout.total", ",env=prod", "count")
+	name, err = rename.Apply("checkout.total", ",env=prod", "gauge")
+	rt.NoError(err)
+	rt.Equal("checkout.total_gauge", name)
+
+	var none *Registry
+	name, err = none.Apply("checkout.total", "", "gauge")
+	rt.NoError(err)
+	rt.Equal("checkout.total", name)
+	rt.Empty(none.Conflicts())
+}
+
+func TestConflicts(t *testing.T) {
+	r, err := New("allow", time.Minute, 10)
+	require.NoError(t, err)
+	r.Apply("a", "", "count")
+	r.Apply("a", "", "gauge")
+	r.Apply("a", "", "timing")
+	r.Apply("a", "", "gauge")
+	r.Apply("b", ",env=prod", "set")
+	r.Apply("b", ",env=prod", "count")
+
+	conflicts := r.Conflicts()
+	require.Len(t, conflicts, 2)
+	require.Equal(t, "a", conflicts[0].Key)
+	require.Equal(t, "count", conflicts[0].Type)
+	require.Equal(t, []string{"gauge", "timing"}, conflicts[0].ConflictingTypes)
+	require.Equal(t, int64(3), conflicts[0].Count)
+	require.Equal(t, "b,env=prod", conflicts[1].Key)
+	require.Equal(t, "set", conflicts[1].Type)
+}
+
+func TestExpiryAndSize(t *testing.T) {
+	r, err := New("reject", 50*time.Millisecond, 2)
+	require.NoError(t, err)
+
+	r.Apply("a", "", "count")
+	r.Apply("b", "", "count")
+	r.Apply("c", "", "count")
+	// a was forgotten to make room
+	_, err = r.Apply("a", "", "gauge")
+	require.NoError(t, err)
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = r.Apply("c", "", "gauge")
+	require.NoError(t, err)
+}
+
+func TestNewValidation(t *testing.T) {
+	r, err := New("off", time.Minute, 10)
+	require.NoError(t, err)
+	require.Nil(t, r)
+
+	_, err = New("ignore", time.Minute, 10)
+	require.Error(t, err)
+	_, err = New("allow", 0, 10)
+	require.Error(t, err)
+	_, err = New("allow", time.Minute, 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"net/http"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+RequireAdmin only lets through requests whose (already validated)
+token carries `"admin": true`. It must run after ValidateToken, and
+without token validation there are no claims, so nothing gets through
+*/
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := ClaimsFromContext(r.Context())
+		if admin, _ := claims["admin"].(bool); !admin {
+			log.WithFields(log.Fields{"path": r.URL.Path, "sub": claims["sub"]}).Error("Admin request without admin token")
+			http.Error(w, "Admin token required", http.StatusForbidden)
+			vmmetrics.GetOrCreateCounter("auth_reqs_not_admin_total").Inc()
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
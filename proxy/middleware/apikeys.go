@@ -0,0 +1,198 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/filewatch"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/ratelimit"
+	"github.com/golang-jwt/jwt"
+	"gopkg.in/yaml.v3"
+)
+
+const APIKeyHeaderName = "X-API-Key"
+
+// only sha256 for now, but the prefix leaves room for slower hashes
+const apiKeyHashPrefix = "sha256:"
+
+// APIKey is a single entry of the API keys file
+type APIKey struct {
+	Name string `yaml:"name"`
+	// sha256:<hex> of the key
+	Hash string `yaml:"hash"`
+	// metric name prefixes the key may write (any, if empty)
+	Prefixes []string `yaml:"prefixes"`
+	// metric types the key may write (any, if empty)
+	Types []string `yaml:"types"`
+	// requests per second, and how many at once (unlimited, if 0)
+	RateLimit float64 `yaml:"rate_limit"`
+	Burst     int     `yaml:"burst"`
+}
+
+// APIKeyError is a refused API key
+type APIKeyError struct {
+	// short, low-cardinality reason for internal metrics
+	Reason string
+	// for rate limited keys
+	RetryAfter time.Duration
+	msg        string
+}
+
+func (e *APIKeyError) Error() string {
+	return e.msg
+}
+
+/*
+APIKeySet holds API keys for clients that can't sign JWTs, from a
+YAML file that's re-read when it changes:
+
+  - name: nightly-report
+    hash: "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+    prefixes: ["cron.report."]
+    rate_limit: 10
+
+Only hashes are stored, so the file isn't a secret
+*/
+type APIKeySet struct {
+	file string
+
+	mu       sync.RWMutex
+	byHash   map[string]APIKey
+	buckets  map[string]*ratelimit.Bucket
+	snapshot filewatch.Snapshot
+}
+
+// LoadAPIKeySet reads API keys from a file
+func LoadAPIKeySet(path string) (*APIKeySet, error) {
+	s := &APIKeySet{file: path, buckets: map[string]*ratelimit.Bucket{}}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// HashAPIKey returns the hash of a key, as stored in the API keys file
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return apiKeyHashPrefix + hex.EncodeToString(sum[:])
+}
+
+// Reload re-reads the API keys file. On error the current keys are kept
+func (s *APIKeySet) Reload() error {
+	files, err := filewatch.Take(s.file)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	var keys []APIKey
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("%s: %v", s.file, err)
+	}
+
+	byHash := map[string]APIKey{}
+	names := map[string]bool{}
+	for i, k := range keys {
+		if k.Name == "" {
+			return fmt.Errorf("%s: API key %d: name is required", s.file, i)
+		}
+		if names[k.Name] {
+			return fmt.Errorf("%s: API key %q: duplicate name", s.file, k.Name)
+		}
+		names[k.Name] = true
+		hash := strings.ToLower(k.Hash)
+		if !strings.HasPrefix(hash, apiKeyHashPrefix) || len(hash) != len(apiKeyHashPrefix)+sha256.Size*2 {
+			return fmt.Errorf("%s: API key %q: hash must be sha256:<hex>", s.file, k.Name)
+		}
+		// one key can't stand for two names
+		if other, ok := byHash[hash]; ok {
+			return fmt.Errorf("%s: API key %q: same hash as %q", s.file, k.Name, other.Name)
+		}
+		byHash[hash] = k
+	}
+
+	s.mu.Lock()
+	s.byHash = byHash
+	s.snapshot = files
+	// rate limits may have changed, start the buckets over
+	s.buckets = map[string]*ratelimit.Bucket{}
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Watch reloads the API keys file whenever it changes, checking every interval
+func (s *APIKeySet) Watch(interval time.Duration) {
+	filewatch.Watcher{What: "API keys", Metric: "api_key", Changed: s.changed, Reload: s.Reload}.Watch(interval)
+}
+
+/*
+Claims authenticates an API key, returning claims standing in for a
+token's: the key's name (as `apikey:<name>`) is the subject, and its
+prefixes and types are its scope
+*/
+func (s *APIKeySet) Claims(key string) (jwt.MapClaims, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.byHash[HashAPIKey(key)]
+	if !ok {
+		return nil, &APIKeyError{Reason: "unknown", msg: "Invalid API key"}
+	}
+
+	if k.RateLimit > 0 {
+		bucket, ok := s.buckets[k.Name]
+		if !ok {
+			bucket = ratelimit.NewBucket(k.RateLimit, k.Burst)
+			s.buckets[k.Name] = bucket
+		}
+		if ok, wait := bucket.Reserve(1); !ok {
+			vmmetrics.GetOrCreateCounter(fmt.Sprintf("api_key_rate_limited_total{name=%q}", k.Name)).Inc()
+			return nil, &APIKeyError{Reason: "rate_limited", RetryAfter: wait, msg: "API key rate limit exceeded"}
+		}
+	}
+	vmmetrics.GetOrCreateCounter(fmt.Sprintf("api_key_requests_total{name=%q}", k.Name)).Inc()
+
+	claims := jwt.MapClaims{"sub": "apikey:" + k.Name}
+	if scope := keyScope(k.Prefixes, k.Types); scope != nil {
+		claims["scope"] = scope
+	}
+	return claims, nil
+}
+
+// keyScope is a scope claim allowing metric name prefixes and types (either may be empty)
+func keyScope(prefixes []string, types []string) map[string]interface{} {
+	if len(prefixes) == 0 && len(types) == 0 {
+		return nil
+	}
+	scope := map[string]interface{}{}
+	if len(prefixes) > 0 {
+		patterns := make([]interface{}, len(prefixes))
+		for i, p := range prefixes {
+			patterns[i] = p + "*"
+		}
+		scope["metrics"] = patterns
+	}
+	if len(types) > 0 {
+		allowed := make([]interface{}, len(types))
+		for i, t := range types {
+			allowed[i] = t
+		}
+		scope["types"] = allowed
+	}
+	return scope
+}
+
+func (s *APIKeySet) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.snapshot.Changed()
+}
@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func loadTestAPIKeys(t *testing.T) *APIKeySet {
+	path := filepath.Join(t.TempDir(), "api-keys.yaml")
+	content := fmt.Sprintf(`
+- name: nightly-report
+  hash: %q
+  prefixes: ["cron.report."]
+  rate_limit: 1
+  burst: 2
+- name: backfill
+  hash: %q
+`, HashAPIKey("report-key"), HashAPIKey("backfill-key"))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	keys, err := LoadAPIKeySet(path)
+	require.NoError(t, err)
+	return keys
+}
+
+func TestAPIKeySetValidation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api-keys.yaml")
+	for _, content := range []string{
+		"- name: plain\n  hash: report-key\n",
+		"- hash: " + HashAPIKey("a") + "\n",
+		"- name: twice\n  hash: " + HashAPIKey("a") + "\n- name: twice\n  hash: " + HashAPIKey("b") + "\n",
+		"- name: one\n  hash: " + HashAPIKey("a") + "\n- name: other\n  hash: " + strings.ToUpper(HashAPIKey("a")) + "\n",
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		_, err := LoadAPIKeySet(path)
+		require.Error(t, err, content)
+	}
+}
+
+func TestAPIKeyClaims(t *testing.T) {
+	keys := loadTestAPIKeys(t)
+	rt := require.New(t)
+
+	claims, err := keys.Claims("report-key")
+	rt.NoError(err)
+	rt.Equal("apikey:nightly-report", claims["sub"])
+	scope, err := ScopeFromContext(ContextWithClaims(httptest.NewRequest("GET", "/", nil).Context(), claims))
+	rt.NoError(err)
+	rt.NoError(scope.Check("cron.report.rows", "c"))
+	rt.Error(scope.Check("billing.rows", "c"))
+
+	// burst of 2, then rate limited
+	_, err = keys.Claims("report-key")
+	rt.NoError(err)
+	_, err = keys.Claims("report-key")
+	rt.Equal("rate_limited", err.(*APIKeyError).Reason)
+
+	claims, err = keys.Claims("backfill-key")
+	rt.NoError(err)
+	rt.Nil(claims["scope"])
+
+	_, err = keys.Claims("guessed-key")
+	rt.Equal("unknown", err.(*APIKeyError).Reason)
+}
+
+func TestValidateTokenAcceptsAPIKeys(t *testing.T) {
+	v := NewTokenValidator(VALID_TOKEN_SECTET, nil, nil, ClaimsPolicy{}, nil, loadTestAPIKeys(t), nil)
+	handler := ValidateToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := ClaimsFromContext(r.Context())
+		fmt.Fprint(w, claims["sub"])
+	}), v)
+	rt := require.New(t)
+
+	serve := func(header string, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/count/cron.report.rows", nil)
+		req.Header.Set(header, value)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(APIKeyHeaderName, "backfill-key")
+	rt.Equal(200, rr.Code)
+	rt.Equal("apikey:backfill", rr.Body.String())
+	rt.Equal(200, serve("Authorization", "Bearer backfill-key").Code)
+	rt.Equal(403, serve(APIKeyHeaderName, "guessed-key").Code)
+
+	serve(APIKeyHeaderName, "report-key")
+	serve(APIKeyHeaderName, "report-key")
+	rr = serve(APIKeyHeaderName, "report-key")
+	rt.Equal(429, rr.Code)
+	rt.Equal("1", rr.Header().Get("Retry-After"))
+
+	// JWTs still work on the same routes, bearer or not
+	rt.Equal(200, serve(JwtHeaderName, VALID_TOKEN).Code)
+	rr = serve("Authorization", "Bearer "+VALID_TOKEN)
+	rt.Equal(200, rr.Code)
+	rt.Equal("sokil", rr.Body.String())
+}
+
+func TestCredentialsFrom(t *testing.T) {
+	creds := func(headers map[string]string) Credentials {
+		return CredentialsFrom(func(name string) string { return headers[name] })
+	}
+	rt := require.New(t)
+
+	rt.Equal(Credentials{Token: "a.b.c"}, creds(map[string]string{"Authorization": "Bearer a.b.c"}))
+	rt.Equal(Credentials{APIKey: "some-key"}, creds(map[string]string{"Authorization": "bearer some-key"}))
+	rt.Equal(Credentials{Token: "x.y.z", APIKey: "some-key"}, creds(map[string]string{JwtHeaderName: "x.y.z", "Authorization": "Bearer some-key"}))
+	// the dedicated headers win over a bearer
+	rt.Equal(Credentials{Token: "x.y.z"}, creds(map[string]string{JwtHeaderName: "x.y.z", "Authorization": "Bearer a.b.c"}))
+	rt.Equal(Credentials{APIKey: "key"}, creds(map[string]string{APIKeyHeaderName: "key", "Authorization": "Bearer other"}))
+	rt.Equal(Credentials{}, creds(map[string]string{"Authorization": "Basic dXNlcjpwYXNz"}))
+}
@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+type contextKey string
+
+const claimsContextKey contextKey = "jwt-claims"
+
+// ClaimsPolicy describes which standard claims a token must carry to be accepted
+type ClaimsPolicy struct {
+	// required `iss`, if set
+	Issuer string
+	// required `aud` (or one of them, for a list), if set
+	Audience string
+	// longest allowed `exp` - `iat`, if set. Tokens must then carry both
+	MaxLifetime time.Duration
+	// clock skew allowed when checking `exp`, `nbf` and `iat`
+	Leeway time.Duration
+}
+
+// ClaimsError is returned when a correctly signed token fails the claims policy
+type ClaimsError struct {
+	// short, low-cardinality reason for internal metrics
+	Reason string
+	msg    string
+}
+
+func (e *ClaimsError) Error() string {
+	return e.msg
+}
+
+func claimsError(reason string, format string, args ...interface{}) error {
+	return &ClaimsError{Reason: reason, msg: fmt.Sprintf(format, args...)}
+}
+
+/*
+Validate checks a token's claims against the policy.
+
+This replaces the jwt package's own time checks, which have
+no notion of leeway, so exp/nbf/iat are always checked here
+*/
+func (p ClaimsPolicy) Validate(claims jwt.MapClaims, now time.Time) error {
+	exp, hasExp, err := numericClaim(claims, "exp")
+	if err != nil {
+		return err
+	}
+	iat, hasIat, err := numericClaim(claims, "iat")
+	if err != nil {
+		return err
+	}
+	nbf, hasNbf, err := numericClaim(claims, "nbf")
+	if err != nil {
+		return err
+	}
+
+	if hasExp && now.After(exp.Add(p.Leeway)) {
+		return claimsError("expired", "Token is expired")
+	}
+	if hasNbf && now.Add(p.Leeway).Before(nbf) {
+		return claimsError("not_yet_valid", "Token is not valid yet")
+	}
+	if hasIat && now.Add(p.Leeway).Before(iat) {
+		return claimsError("issued_in_future", "Token used before issued")
+	}
+
+	if p.Issuer != "" && !claims.VerifyIssuer(p.Issuer, true) {
+		return claimsError("issuer", "Token issuer is not accepted")
+	}
+	if p.Audience != "" && !verifyAudience(claims, p.Audience) {
+		return claimsError("audience", "Token audience is not accepted")
+	}
+
+	if p.MaxLifetime > 0 {
+		if !hasExp || !hasIat {
+			return claimsError("lifetime", "Token must have exp and iat claims")
+		}
+		if exp.Sub(iat) > p.MaxLifetime {
+			return claimsError("lifetime", "Token lifetime is longer than %s", p.MaxLifetime)
+		}
+	}
+
+	return nil
+}
+
+// ClaimsFromContext returns the claims of the token that authenticated a request, if any
+func ClaimsFromContext(ctx context.Context) (jwt.MapClaims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(jwt.MapClaims)
+	return claims, ok
+}
+
+// ContextWithClaims stores validated claims for later stages of the pipeline
+func ContextWithClaims(ctx context.Context, claims jwt.MapClaims) context.Context {
+	return context.WithValue(ctx, claimsContextKey, claims)
+}
+
+// ExpiresAt returns the time in a token's exp claim, if it has a valid one
+func ExpiresAt(claims jwt.MapClaims) (time.Time, bool) {
+	exp, ok, err := numericClaim(claims, "exp")
+	return exp, ok && err == nil
+}
+
+// aud may be a single string or a list
+func verifyAudience(claims jwt.MapClaims, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func numericClaim(claims jwt.MapClaims, name string) (time.Time, bool, error) {
+	var seconds float64
+	switch v := claims[name].(type) {
+	case nil:
+		return time.Time{}, false, nil
+	case float64:
+		seconds = v
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, false, claimsError("malformed", "Invalid %s claim", name)
+		}
+		seconds = f
+	default:
+		return time.Time{}, false, claimsError("malformed", "Invalid %s claim", name)
+	}
+	return time.Unix(int64(seconds), 0), true, nil
+}
@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimsPolicyTimes(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	rt := require.New(t)
+
+	rt.NoError(ClaimsPolicy{}.Validate(jwt.MapClaims{}, now))
+	rt.Error(ClaimsPolicy{}.Validate(jwt.MapClaims{"exp": float64(now.Unix() - 10)}, now))
+	rt.NoError(ClaimsPolicy{Leeway: 30 * time.Second}.Validate(jwt.MapClaims{"exp": float64(now.Unix() - 10)}, now))
+	rt.Error(ClaimsPolicy{}.Validate(jwt.MapClaims{"nbf": float64(now.Unix() + 10)}, now))
+	rt.NoError(ClaimsPolicy{Leeway: 30 * time.Second}.Validate(jwt.MapClaims{"nbf": float64(now.Unix() + 10)}, now))
+	rt.Error(ClaimsPolicy{}.Validate(jwt.MapClaims{"iat": json.Number("1700000010")}, now))
+	rt.Error(ClaimsPolicy{}.Validate(jwt.MapClaims{"exp": "tomorrow"}, now))
+}
+
+func TestClaimsPolicyIssuerAndAudience(t *testing.T) {
+	now := time.Now()
+	policy := ClaimsPolicy{Issuer: "auth.example.com", Audience: "statsd-proxy"}
+	rt := require.New(t)
+
+	rt.NoError(policy.Validate(jwt.MapClaims{"iss": "auth.example.com", "aud": "statsd-proxy"}, now))
+	rt.NoError(policy.Validate(jwt.MapClaims{"iss": "auth.example.com", "aud": []interface{}{"other", "statsd-proxy"}}, now))
+	rt.Error(policy.Validate(jwt.MapClaims{"aud": "statsd-proxy"}, now))
+	rt.Error(policy.Validate(jwt.MapClaims{"iss": "evil.example.com", "aud": "statsd-proxy"}, now))
+
+	err := policy.Validate(jwt.MapClaims{"iss": "auth.example.com", "aud": []interface{}{"other"}}, now)
+	rt.Equal("audience", err.(*ClaimsError).Reason)
+}
+
+func TestClaimsPolicyMaxLifetime(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	policy := ClaimsPolicy{MaxLifetime: time.Hour}
+	rt := require.New(t)
+
+	rt.NoError(policy.Validate(jwt.MapClaims{"iat": float64(now.Unix()), "exp": float64(now.Unix() + 3600)}, now))
+	rt.Error(policy.Validate(jwt.MapClaims{"iat": float64(now.Unix()), "exp": float64(now.Unix() + 3601)}, now))
+	// can't tell the lifetime without both
+	rt.Error(policy.Validate(jwt.MapClaims{"exp": float64(now.Unix() + 60)}, now))
+}
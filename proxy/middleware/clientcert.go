@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+)
+
+const identityContextKey contextKey = "client-identity"
+
+/*
+CertificateIdentity names the holder of a client certificate: its
+first URI SAN (e.g. a SPIFFE ID), else its first DNS SAN, else
+its subject common name
+*/
+func CertificateIdentity(cert *x509.Certificate) string {
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.CommonName
+}
+
+/*
+TLSIdentity returns the identity of a connection's client certificate,
+read from the chain it was verified with during the handshake.
+Certificates that weren't verified (there are none without a client
+CA bundle configured) don't have an identity
+*/
+func TLSIdentity(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	identity := CertificateIdentity(state.VerifiedChains[0][0])
+	return identity, identity != ""
+}
+
+// ClientIdentityFromContext returns the client certificate identity of a request, if any
+func ClientIdentityFromContext(ctx context.Context) (string, bool) {
+	identity, ok := ctx.Value(identityContextKey).(string)
+	return identity, ok
+}
+
+// ContextWithClientIdentity stores a verified client certificate identity
+func ContextWithClientIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityContextKey, identity)
+}
@@ -1,32 +1,206 @@
 package middleware
 
 import (
+	"fmt"
 	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
-// validate CORS headers
-func ValidateCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-		if origin != "" {
-			// allow any origin
-			w.Header().Add("Access-Control-Allow-Origin", origin)
+const corsAllowedHeaders = JwtHeaderName + ", X-Requested-With, Origin, Accept, Content-Type, Authentication, Idempotency-Key"
+const corsAllowedMethods = "GET, POST, HEAD, OPTIONS"
 
-			// handle pre-flight OPTIONS request
-			if r.Method == http.MethodOptions {
-				if r.Header.Get("Access-Control-Request-Method") != "" {
-					w.Header().Add("Access-Control-Allow-Methods", "GET, POST, HEAD, OPTIONS")
-				}
+// CORSConfig is the origin policy file
+type CORSConfig struct {
+	// exact origins (https://app.example.com), or wildcard subdomains (https://*.example.com)
+	Origins []string `yaml:"origins"`
+	// regular expressions matched against the whole origin (they're anchored for you)
+	OriginRegexes []string `yaml:"origin_regexes"`
+	// seconds browsers may cache a preflight response (not sent, if 0)
+	MaxAge int `yaml:"max_age"`
+	// let browsers send cookies and auth headers along
+	AllowCredentials bool `yaml:"allow_credentials"`
+}
 
-				if r.Header.Get("Access-Control-Request-Headers") != "" {
-					w.Header().Add("Access-Control-Allow-Headers", JwtHeaderName+", X-Requested-With, Origin, Accept, Content-Type, Authentication")
-				}
+// CORSPolicy decides which browser origins may call us. A nil policy allows any origin
+type CORSPolicy struct {
+	exact            map[string]bool
+	wildcards        [][2]string
+	regexes          []*regexp.Regexp
+	maxAge           int
+	allowCredentials bool
+}
+
+/*
+LoadCORSPolicy reads an origin policy from a YAML file:
+
+	origins:
+	  - https://app.example.com
+	  - https://*.example.com
+	origin_regexes:
+	  - https://pr-[0-9]+\.preview\.example\.com
+	max_age: 600
+	allow_credentials: false
+
+An empty path allows any origin, as before origin policies existed
+*/
+func LoadCORSPolicy(path string) (*CORSPolicy, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg CORSConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return NewCORSPolicy(cfg)
+}
 
-				w.WriteHeader(http.StatusNoContent)
+// NewCORSPolicy validates an origin policy
+func NewCORSPolicy(cfg CORSConfig) (*CORSPolicy, error) {
+	p := &CORSPolicy{
+		exact:            map[string]bool{},
+		maxAge:           cfg.MaxAge,
+		allowCredentials: cfg.AllowCredentials,
+	}
+	for _, origin := range cfg.Origins {
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+		scheme, host, ok := strings.Cut(origin, "://")
+		if !ok || host == "" || strings.Contains(host, "/") {
+			return nil, fmt.Errorf("Invalid CORS origin %q, must be scheme://host[:port]", origin)
+		}
+		if strings.HasPrefix(host, "*.") {
+			p.wildcards = append(p.wildcards, [2]string{scheme + "://", host[1:]})
+		} else if strings.Contains(host, "*") {
+			return nil, fmt.Errorf("Invalid CORS origin %q, wildcards must be a leading *.", origin)
+		} else {
+			p.exact[origin] = true
+		}
+	}
+	for _, expr := range cfg.OriginRegexes {
+		// a regex that matched part of the origin would let in anyone who registers a matching domain
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CORS origin regex %q: %v", expr, err)
+		}
+		p.regexes = append(p.regexes, re)
+	}
+	if p.maxAge < 0 {
+		return nil, fmt.Errorf("Invalid CORS max_age %d", p.maxAge)
+	}
+	return p, nil
+}
 
-				return
+// Allowed is true if an origin may call us
+func (p *CORSPolicy) Allowed(origin string) bool {
+	if p == nil {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.exact[origin] {
+		return true
+	}
+	for _, w := range p.wildcards {
+		// *.example.com is any subdomain, but not example.com itself
+		if strings.HasPrefix(origin, w[0]) && strings.HasSuffix(origin, w[1]) {
+			sub := origin[len(w[0]) : len(origin)-len(w[1])]
+			if sub != "" && !strings.ContainsAny(sub, "/:@") {
+				return true
 			}
 		}
+	}
+	for _, re := range p.regexes {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+allowOrigin sets the headers for a request's origin, returning false
+(and counting it) if the origin isn't allowed. Requests without an
+Origin aren't from browsers and are always allowed
+*/
+func (p *CORSPolicy) allowOrigin(w http.ResponseWriter, r *http.Request) bool {
+	// the response depends on the origin, so caches must keep them apart
+	w.Header().Add("Vary", "Origin")
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if !p.Allowed(origin) {
+		log.WithFields(log.Fields{"origin": origin, "path": r.URL.Path}).Warn("CORS origin rejected")
+		vmmetrics.GetOrCreateCounter("cors_rejected_origins_total").Inc()
+		return false
+	}
+	w.Header().Add("Access-Control-Allow-Origin", origin)
+	if p != nil && p.allowCredentials {
+		w.Header().Add("Access-Control-Allow-Credentials", "true")
+	}
+	return true
+}
+
+// preflight answers a pre-flight OPTIONS request
+func (p *CORSPolicy) preflight(w http.ResponseWriter, r *http.Request) {
+	if !p.allowOrigin(w, r) {
+		http.Error(w, "Origin not allowed", 403)
+		return
+	}
+	if r.Header.Get("Origin") != "" {
+		if r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Access-Control-Allow-Methods", corsAllowedMethods)
+		}
+		if r.Header.Get("Access-Control-Request-Headers") != "" {
+			w.Header().Add("Access-Control-Allow-Headers", corsAllowedHeaders)
+		}
+		if p != nil && p.maxAge > 0 {
+			w.Header().Add("Access-Control-Max-Age", strconv.Itoa(p.maxAge))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Preflight handles pre-flight OPTIONS requests for routes that don't, with the same policy as ValidateOrigin
+func Preflight(policy *CORSPolicy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.WithFields(log.Fields{"path": r.URL.Path}).Debug("Pre-flight function")
+		if r.Header.Get("Access-Control-Request-Method") == "" {
+			return
+		}
+		policy.preflight(w, r)
+	})
+}
+
+// validate CORS headers, allowing any origin
+func ValidateCORS(next http.Handler) http.Handler {
+	return ValidateOrigin(next, nil)
+}
+
+// validate CORS headers against an origin policy, refusing requests from other origins
+func ValidateOrigin(next http.Handler, policy *CORSPolicy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// handle pre-flight OPTIONS request
+		if r.Method == http.MethodOptions && r.Header.Get("Origin") != "" {
+			policy.preflight(w, r)
+			return
+		}
+
+		// browsers send simple requests without asking first, so they're refused here
+		if !policy.allowOrigin(w, r) {
+			http.Error(w, "Origin not allowed", 403)
+			return
+		}
 
 		next.ServeHTTP(w, r)
 	})
@@ -0,0 +1,245 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/tagformat"
+	"github.com/golang-jwt/jwt"
+	"gopkg.in/yaml.v3"
+)
+
+const tagsContextKey contextKey = "enrichment-tags"
+
+var (
+	// characters the processor replaces in tag keys for prometheus
+	promTagKeyChars = regexp.MustCompile("[^a-zA-Z0-9_:]")
+)
+
+// EnrichConfig is the allowlist of request metadata that may become tags
+type EnrichConfig struct {
+	// claim name -> tag key
+	Claims map[string]string `yaml:"claims"`
+	// header name -> tag key
+	Headers map[string]string `yaml:"headers"`
+	// tag key for the coarse User-Agent family, if set
+	UserAgent string `yaml:"user_agent"`
+	// tag key for the client certificate identity, if set
+	ClientCert string `yaml:"client_cert"`
+}
+
+// Tags are trusted key/value pairs attached to every metric of a request
+type Tags [][2]string
+
+// Enricher derives trusted tags from a request's token and headers
+type Enricher struct {
+	claims     [][2]string
+	headers    [][2]string
+	userAgent  string
+	clientCert string
+}
+
+/*
+LoadEnricher reads the enrichment allowlist from a YAML file:
+
+	claims:
+	  tenant: tenant
+	  app_id: app
+	headers:
+	  CF-IPCountry: country
+	user_agent: ua_family
+	client_cert: service
+
+An empty path disables enrichment
+*/
+func LoadEnricher(path string) (*Enricher, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg EnrichConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return NewEnricher(cfg)
+}
+
+// NewEnricher validates an allowlist, refusing bad or duplicate tag keys
+func NewEnricher(cfg EnrichConfig) (*Enricher, error) {
+	seen := map[string]bool{}
+	checkKey := func(key string) error {
+		if !tagformat.ValidKey(key) {
+			return fmt.Errorf("Invalid enrichment tag key %q", key)
+		}
+		if seen[key] {
+			return fmt.Errorf("Duplicate enrichment tag key %q", key)
+		}
+		seen[key] = true
+		return nil
+	}
+
+	e := &Enricher{userAgent: cfg.UserAgent, clientCert: cfg.ClientCert}
+	for claim, key := range cfg.Claims {
+		if err := checkKey(key); err != nil {
+			return nil, err
+		}
+		e.claims = append(e.claims, [2]string{claim, key})
+	}
+	for header, key := range cfg.Headers {
+		if err := checkKey(key); err != nil {
+			return nil, err
+		}
+		e.headers = append(e.headers, [2]string{http.CanonicalHeaderKey(header), key})
+	}
+	if e.userAgent != "" {
+		if err := checkKey(e.userAgent); err != nil {
+			return nil, err
+		}
+	}
+	if e.clientCert != "" {
+		if err := checkKey(e.clientCert); err != nil {
+			return nil, err
+		}
+	}
+
+	// map order is random, keep tags stable
+	sort.Slice(e.claims, func(i, j int) bool { return e.claims[i][1] < e.claims[j][1] })
+	sort.Slice(e.headers, func(i, j int) bool { return e.headers[i][1] < e.headers[j][1] })
+	return e, nil
+}
+
+/*
+Tags returns the tags for a request. header looks up a (canonical)
+header name, so gRPC metadata can be used as well as HTTP headers.
+Missing claims, headers and identities are skipped, as are claims
+that aren't plain values
+*/
+func (e *Enricher) Tags(claims jwt.MapClaims, identity string, header func(string) string) Tags {
+	if e == nil {
+		return nil
+	}
+	tags := Tags{}
+	for _, c := range e.claims {
+		var value string
+		switch v := claims[c[0]].(type) {
+		case string:
+			value = v
+		case float64, bool:
+			value = fmt.Sprint(v)
+		}
+		if value != "" {
+			tags = append(tags, [2]string{c[1], tagformat.Escape(value)})
+		}
+	}
+	for _, h := range e.headers {
+		if value := strings.TrimSpace(header(h[0])); value != "" {
+			tags = append(tags, [2]string{h[1], tagformat.Escape(value)})
+		}
+	}
+	if e.userAgent != "" {
+		tags = append(tags, [2]string{e.userAgent, UserAgentFamily(header("User-Agent"))})
+	}
+	if e.clientCert != "" && identity != "" {
+		tags = append(tags, [2]string{e.clientCert, tagformat.Escape(identity)})
+	}
+	return tags
+}
+
+/*
+UserAgentFamily reduces a User-Agent to a handful of values, enough to
+split browsers from scripts without exploding tag cardinality.
+Order matters: most browsers claim to be several others
+*/
+func UserAgentFamily(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case ua == "":
+		return "unknown"
+	case strings.Contains(ua, "bot") || strings.Contains(ua, "crawler") || strings.Contains(ua, "spider"):
+		return "bot"
+	case strings.Contains(ua, "edg/") || strings.Contains(ua, "edga/") || strings.Contains(ua, "edgios/"):
+		return "edge"
+	case strings.Contains(ua, "opr/") || strings.Contains(ua, "opera"):
+		return "opera"
+	case strings.Contains(ua, "firefox/") || strings.Contains(ua, "fxios/"):
+		return "firefox"
+	case strings.Contains(ua, "chrome/") || strings.Contains(ua, "crios/") || strings.Contains(ua, "chromium/"):
+		return "chrome"
+	case strings.Contains(ua, "safari/"):
+		return "safari"
+	case strings.HasPrefix(ua, "curl/") || strings.HasPrefix(ua, "wget/") ||
+		strings.HasPrefix(ua, "python") || strings.HasPrefix(ua, "go-http-client/"):
+		return "script"
+	}
+	return "other"
+}
+
+/*
+Apply adds the tags to a metric's comma-separated tags. Our tags
+replace any client-supplied tag with the same key, so they can't be
+forged. Keys are compared as the processor may rewrite them (lowercased
+by --normalize, with characters replaced by --prometheus-compat), so TENANT
+can't turn into a second tenant later
+*/
+func (t Tags) Apply(tags string) string {
+	if len(t) == 0 {
+		return tags
+	}
+	trusted := map[string]bool{}
+	for _, tag := range t {
+		trusted[canonicalTagKey(tag[0])] = true
+	}
+
+	pairs := []string{}
+	for _, pair := range strings.Split(tags, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key := strings.TrimSpace(strings.SplitN(pair, "=", 2)[0])
+		if !trusted[canonicalTagKey(key)] {
+			pairs = append(pairs, pair)
+		}
+	}
+	for _, tag := range t {
+		pairs = append(pairs, tag[0]+"="+tag[1])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// canonicalTagKey is a tag key the way the processor could end up sending it
+func canonicalTagKey(key string) string {
+	return strings.ToLower(promTagKeyChars.ReplaceAllString(key, "_"))
+}
+
+// TagsFromContext returns the enrichment tags for a request, if any
+func TagsFromContext(ctx context.Context) Tags {
+	tags, _ := ctx.Value(tagsContextKey).(Tags)
+	return tags
+}
+
+// ContextWithTags stores enrichment tags for the handlers that queue metrics
+func ContextWithTags(ctx context.Context, tags Tags) context.Context {
+	return context.WithValue(ctx, tagsContextKey, tags)
+}
+
+// enrichment middleware, run after the token (and its claims) are validated
+func Enrich(next http.Handler, enricher *Enricher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if enricher == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		claims, _ := ClaimsFromContext(r.Context())
+		identity, _ := ClientIdentityFromContext(r.Context())
+		tags := enricher.Tags(claims, identity, r.Header.Get)
+		next.ServeHTTP(w, r.WithContext(ContextWithTags(r.Context(), tags)))
+	})
+}
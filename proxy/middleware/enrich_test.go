@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEnricher(t *testing.T) *Enricher {
+	enricher, err := NewEnricher(EnrichConfig{
+		Claims:    map[string]string{"tenant": "tenant", "app_id": "app"},
+		Headers:   map[string]string{"cf-ipcountry": "country"},
+		UserAgent: "ua_family",
+	})
+	require.NoError(t, err)
+	return enricher
+}
+
+func TestNewEnricherRejectsBadKeys(t *testing.T) {
+	rt := require.New(t)
+
+	_, err := NewEnricher(EnrichConfig{Claims: map[string]string{"tenant": "ten ant"}})
+	rt.Error(err)
+	_, err = NewEnricher(EnrichConfig{
+		Claims:  map[string]string{"tenant": "tenant"},
+		Headers: map[string]string{"X-Tenant": "tenant"},
+	})
+	rt.Error(err)
+}
+
+func TestEnricherTags(t *testing.T) {
+	enricher := newTestEnricher(t)
+	header := http.Header{}
+	header.Set("CF-IPCountry", "NZ")
+	header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36")
+	claims := jwt.MapClaims{"tenant": "acme corp", "app_id": float64(42), "email": "someone@example.com"}
+
+	tags := enricher.Tags(claims, "", header.Get)
+
+	require.Equal(t, Tags{{"app", "42"}, {"tenant", "acme_corp"}, {"country", "NZ"}, {"ua_family", "chrome"}}, tags)
+}
+
+func TestTagsApplyOverridesClientTags(t *testing.T) {
+	tags := Tags{{"tenant", "acme"}, {"country", "NZ"}}
+	rt := require.New(t)
+
+	rt.Equal("page=home,tenant=acme,country=NZ", tags.Apply("tenant=evil,page=home"))
+	rt.Equal("tenant=acme,country=NZ", tags.Apply(""))
+
+	// keys the processor would turn into ours are replaced too
+	rt.Equal("page=home,tenant=acme,country=NZ", tags.Apply("TENANT=evil,page=home,Country=XX"))
+	rt.Equal("app_id=42", Tags{{"app_id", "42"}}.Apply("App-Id=7"))
+
+	var none Tags
+	rt.Equal("tenant=evil", none.Apply("tenant=evil"))
+}
+
+func TestUserAgentFamily(t *testing.T) {
+	rt := require.New(t)
+
+	rt.Equal("edge", UserAgentFamily("Mozilla/5.0 (Windows NT 10.0) AppleWebKit/537.36 Chrome/118.0 Safari/537.36 Edg/118.0.2088.46"))
+	rt.Equal("firefox", UserAgentFamily("Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/119.0"))
+	rt.Equal("safari", UserAgentFamily("Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Version/17.0 Mobile/15E148 Safari/604.1"))
+	rt.Equal("bot", UserAgentFamily("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"))
+	rt.Equal("script", UserAgentFamily("curl/8.4.0"))
+	rt.Equal("unknown", UserAgentFamily(""))
+}
+
+func TestEnrichStoresTags(t *testing.T) {
+	var tags Tags
+	handler := Enrich(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tags = TagsFromContext(r.Context())
+	}), newTestEnricher(t))
+
+	req := httptest.NewRequest(http.MethodPost, "/count", nil)
+	req.Header.Set("CF-IPCountry", "DE")
+	req = req.WithContext(ContextWithClaims(req.Context(), jwt.MapClaims{"tenant": "acme"}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.Equal(t, Tags{{"tenant", "acme"}, {"country", "DE"}, {"ua_family", "unknown"}}, tags)
+}
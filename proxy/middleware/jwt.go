@@ -1,32 +1,318 @@
 package middleware
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
+	vmmetrics "github.com/VictoriaMetrics/metrics"
 	"github.com/golang-jwt/jwt"
 	log "github.com/sirupsen/logrus"
-    vmmetrics "github.com/VictoriaMetrics/metrics"
 )
 
 const jwtQueryStringKeyName = "token"
 
 const JwtHeaderName = "X-JWT-Token"
 
+// TokenValidator verifies JWTs signed with our shared secret(s) and/or by holders of known public keys
+type TokenValidator struct {
+	tokenSecret string
+	secrets     *SecretSet
+	keys        *KeySet
+	policy      ClaimsPolicy
+	revocations *RevocationList
+	apiKeys     *APIKeySet
+	signingKeys *SigningKeySet
+	parser      *jwt.Parser
+}
+
+/*
+NewTokenValidator creates a validator. Any of tokenSecret, secrets and
+keys may be empty; when secrets are set they replace tokenSecret.
+revocations, apiKeys and signingKeys may be nil
+*/
+func NewTokenValidator(tokenSecret string, secrets *SecretSet, keys *KeySet, policy ClaimsPolicy, revocations *RevocationList, apiKeys *APIKeySet, signingKeys *SigningKeySet) *TokenValidator {
+	return &TokenValidator{
+		tokenSecret: tokenSecret,
+		secrets:     secrets,
+		keys:        keys,
+		policy:      policy,
+		revocations: revocations,
+		apiKeys:     apiKeys,
+		signingKeys: signingKeys,
+		// the claims policy does the time checks, with leeway
+		parser: &jwt.Parser{SkipClaimsValidation: true},
+	}
+}
+
+// Enabled is false when nothing is configured to verify tokens with (or there's no validator), in which case every request is accepted
+func (v *TokenValidator) Enabled() bool {
+	return v != nil && (v.tokenSecret != "" || v.secrets != nil || v.keys != nil || v.apiKeys != nil || v.signingKeys != nil)
+}
+
+// Parse verifies a JWT and its claims, returning the claims
+func (v *TokenValidator) Parse(tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	token, err := v.parser.ParseWithClaims(tokenString, claims, v.keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.policy.Validate(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	if v.revocations != nil {
+		if err := v.revocations.Check(claims); err != nil {
+			return nil, err
+		}
+	}
+
+	// per-kid counts tell us when an old secret is no longer used and can be retired
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok && v.secrets != nil {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			kid, _ = v.secrets.Primary()
+		}
+		vmmetrics.GetOrCreateCounter(fmt.Sprintf("jwt_secret_accepted_total{kid=%q}", kid)).Inc()
+	}
+	return claims, nil
+}
+
+/*
+Revoked returns a ClaimsError if claims validated earlier have been
+revoked since, for connections that outlive a single request
+*/
+func (v *TokenValidator) Revoked(claims jwt.MapClaims) error {
+	if v == nil || v.revocations == nil {
+		return nil
+	}
+	return v.revocations.Check(claims)
+}
+
+/*
+CertificateClaims stands in for the claims of a client that authenticated
+with a verified certificate instead of a token. Its identity is the
+subject, so it can be revoked like any other
+*/
+func (v *TokenValidator) CertificateClaims(identity string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{"sub": identity}
+	if v.revocations != nil {
+		if err := v.revocations.Check(claims); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+/*
+APIKeyClaims stands in for the claims of a client that authenticated
+with an API key instead of a token, see APIKeySet.Claims. Keys are
+revoked by their subject, apikey:<name>
+*/
+func (v *TokenValidator) APIKeyClaims(key string) (jwt.MapClaims, error) {
+	if v.apiKeys == nil {
+		return nil, &APIKeyError{Reason: "disabled", msg: "API keys are not accepted"}
+	}
+	claims, err := v.apiKeys.Claims(key)
+	if err != nil {
+		return nil, err
+	}
+	if v.revocations != nil {
+		if err := v.revocations.Check(claims); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+/*
+SignedRequestClaims stands in for the claims of a server that signed its
+request instead of sending a token, see SigningKeySet.Verify. Signing
+keys are revoked by their subject, signed:<id>
+*/
+func (v *TokenValidator) SignedRequestClaims(r *http.Request) (jwt.MapClaims, error) {
+	if v.signingKeys == nil {
+		return nil, &SignatureError{Reason: "disabled", msg: "Signed requests are not accepted"}
+	}
+	claims, err := v.signingKeys.Verify(r, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if v.revocations != nil {
+		if err := v.revocations.Check(claims); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+/*
+Sign creates an HS256 token the validator will accept, signed with the
+primary secret (and naming it by kid). The policy's issuer and audience
+are filled in, so the token passes our own claims checks
+*/
+func (v *TokenValidator) Sign(claims jwt.MapClaims) (string, error) {
+	var kid string
+	var secret []byte
+	if v.secrets != nil {
+		kid, secret = v.secrets.Primary()
+	} else if v.tokenSecret != "" {
+		secret = []byte(v.tokenSecret)
+	} else {
+		return "", fmt.Errorf("No HMAC secret to sign tokens with")
+	}
+
+	if v.policy.Issuer != "" {
+		claims["iss"] = v.policy.Issuer
+	}
+	if v.policy.Audience != "" {
+		claims["aud"] = v.policy.Audience
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	return token.SignedString(secret)
+}
+
+// MaxLifetime is the longest token lifetime the claims policy allows (0 is unlimited)
+func (v *TokenValidator) MaxLifetime() time.Duration {
+	return v.policy.MaxLifetime
+}
+
+/*
+keyfunc picks the verification key by the token's algorithm family:
+HMAC tokens use the shared secret (or the one named by their kid), and
+asymmetric tokens use the public key named by their kid. The jwt package refuses to verify with a key of
+the wrong type, so a public key can never be (ab)used as an HMAC secret
+*/
+func (v *TokenValidator) keyfunc(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if v.secrets != nil {
+			kid, _ := token.Header["kid"].(string)
+			secret, _, err := v.secrets.Secret(kid)
+			return secret, err
+		}
+		if v.tokenSecret == "" {
+			return nil, fmt.Errorf("HMAC signed tokens are not accepted")
+		}
+		return []byte(v.tokenSecret), nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA, *jwt.SigningMethodEd25519:
+		if v.keys == nil {
+			return nil, fmt.Errorf("Asymmetrically signed tokens are not accepted")
+		}
+		kid, _ := token.Header["kid"].(string)
+		return v.keys.Key(kid)
+	}
+	log.Error("Bad signing format")
+	return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+}
+
+// Credentials are the token and API key a client sent, if any
+type Credentials struct {
+	Token  string
+	APIKey string
+}
+
+/*
+CredentialsFrom reads a client's credentials from HTTP headers or gRPC
+metadata, looked up by get. Tokens and API keys have their own headers,
+and an Authorization bearer is a token if it's shaped like a JWT (three
+dot-separated parts), otherwise an API key
+*/
+func CredentialsFrom(get func(name string) string) Credentials {
+	creds := Credentials{Token: get(JwtHeaderName), APIKey: get(APIKeyHeaderName)}
+	auth := get("Authorization")
+	if len(auth) <= 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return creds
+	}
+	bearer := strings.TrimSpace(auth[7:])
+	if strings.Count(bearer, ".") == 2 {
+		if creds.Token == "" {
+			creds.Token = bearer
+		}
+	} else if creds.APIKey == "" {
+		creds.APIKey = bearer
+	}
+	return creds
+}
+
 // validate JWT middleware
 func ValidateJWT(next http.Handler, tokenSecret string) http.Handler {
+	return ValidateToken(next, NewTokenValidator(tokenSecret, nil, nil, ClaimsPolicy{}, nil, nil, nil))
+}
+
+/*
+validate JWT middleware, for any configured secret or public key.
+A request signature, an API key or a verified client certificate can be
+used instead of a token
+*/
+func ValidateToken(next http.Handler, validator *TokenValidator) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if tokenSecret == "" {
+		identity, hasIdentity := TLSIdentity(r.TLS)
+		if hasIdentity {
+			r = r.WithContext(ContextWithClientIdentity(r.Context(), identity))
+		}
+
+		if !validator.Enabled() {
 			next.ServeHTTP(w, r)
 		} else {
-			// get JWT from header
-			tokenString := r.Header.Get(JwtHeaderName)
+			// get JWT (or API key) from headers
+			creds := CredentialsFrom(r.Header.Get)
+			tokenString := creds.Token
 
 			// get JWT from query string
 			if tokenString == "" {
 				tokenString = r.URL.Query().Get(jwtQueryStringKeyName)
 			}
 
+			if tokenString == "" && IsSignedRequest(r) {
+				claims, err := validator.SignedRequestClaims(r)
+				if err != nil {
+					log.WithFields(log.Fields{"error": err}).Error("Request signature rejected")
+					http.Error(w, err.Error(), 403)
+					vmmetrics.GetOrCreateCounter("auth_reqs_bad_signature_total").Inc()
+					return
+				}
+				vmmetrics.GetOrCreateCounter("auth_reqs_signed_total").Inc()
+				next.ServeHTTP(w, r.WithContext(ContextWithClaims(r.Context(), claims)))
+				return
+			}
+
+			if tokenString == "" {
+				if key := creds.APIKey; key != "" {
+					claims, err := validator.APIKeyClaims(key)
+					var keyErr *APIKeyError
+					if errors.As(err, &keyErr) && keyErr.Reason == "rate_limited" {
+						TooManyRequests(w, keyErr.Error(), keyErr.RetryAfter)
+						return
+					} else if err != nil {
+						log.WithFields(log.Fields{"error": err}).Error("API key rejected")
+						http.Error(w, err.Error(), 403)
+						vmmetrics.GetOrCreateCounter("auth_reqs_bad_api_key_total").Inc()
+						return
+					}
+					vmmetrics.GetOrCreateCounter("auth_reqs_api_key_total").Inc()
+					next.ServeHTTP(w, r.WithContext(ContextWithClaims(r.Context(), claims)))
+					return
+				}
+			}
+
+			if tokenString == "" && hasIdentity {
+				claims, err := validator.CertificateClaims(identity)
+				if err != nil {
+					log.WithFields(log.Fields{"error": err, "identity": identity}).Error("Client certificate rejected")
+					http.Error(w, err.Error(), 403)
+					vmmetrics.GetOrCreateCounter("auth_reqs_bad_client_cert_total").Inc()
+					return
+				}
+				vmmetrics.GetOrCreateCounter("auth_reqs_client_cert_total").Inc()
+				next.ServeHTTP(w, r.WithContext(ContextWithClaims(r.Context(), claims)))
+				return
+			}
+
 			if tokenString == "" {
 				log.Error("Token not specified")
 				http.Error(w, "Token not specified", 401)
@@ -35,23 +321,23 @@ func ValidateJWT(next http.Handler, tokenSecret string) http.Handler {
 			}
 
 			// parse JWT
-			_, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-					log.Error("Bad signing format")
-					return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-				}
-				return []byte(tokenSecret), nil
-			})
+			claims, err := validator.Parse(tokenString)
 
-			if err != nil {
+			var claimsErr *ClaimsError
+			if errors.As(err, &claimsErr) {
+				log.WithFields(log.Fields{"error": err}).Error("Token claims rejected")
+				http.Error(w, claimsErr.Error(), 403)
+				vmmetrics.GetOrCreateCounter(fmt.Sprintf("auth_reqs_rejected_claims_total{reason=%q}", claimsErr.Reason)).Inc()
+				return
+			} else if err != nil {
 				log.Error("Error parsing token")
 				http.Error(w, "Error parsing token", 403)
 				vmmetrics.GetOrCreateCounter("auth_reqs_bad_token_total").Inc()
 				return
 			}
 
-			// accept request
-			next.ServeHTTP(w, r)
+			// accept request, keeping the claims for later stages
+			next.ServeHTTP(w, r.WithContext(ContextWithClaims(r.Context(), claims)))
 		}
 	})
 }
@@ -1,11 +1,15 @@
 package middleware
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/require"
 )
 
@@ -121,3 +125,75 @@ func TestValidateJWTWithValidTokenInQuery(t *testing.T) {
 	require.Equal(200, response.StatusCode)
 	require.Equal("", string(responseBody))
 }
+
+func TestValidateTokenStoresClaimsInContext(t *testing.T) {
+	var claims jwt.MapClaims
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ = ClaimsFromContext(r.Context())
+	})
+
+	handlerWithJWTValidation := ValidateJWT(nextHandler, VALID_TOKEN_SECTET)
+
+	request := httptest.NewRequest("GET", "http://testing", nil)
+	responseWriter := httptest.NewRecorder()
+
+	request.Header.Add("X-JWT-Token", VALID_TOKEN)
+
+	handlerWithJWTValidation.ServeHTTP(responseWriter, request)
+
+	require := require.New(t)
+
+	require.Equal(200, responseWriter.Result().StatusCode)
+	require.Equal("sokil", claims["sub"])
+}
+
+func TestValidateTokenWithRejectedClaims(t *testing.T) {
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	validator := NewTokenValidator(VALID_TOKEN_SECTET, nil, nil, ClaimsPolicy{Issuer: "someone-else"}, nil, nil, nil)
+	handlerWithJWTValidation := ValidateToken(nextHandler, validator)
+
+	request := httptest.NewRequest("GET", "http://testing", nil)
+	responseWriter := httptest.NewRecorder()
+
+	request.Header.Add("X-JWT-Token", VALID_TOKEN)
+
+	handlerWithJWTValidation.ServeHTTP(responseWriter, request)
+
+	response := responseWriter.Result()
+	responseBody, _ := io.ReadAll(response.Body)
+
+	require := require.New(t)
+
+	require.Equal(403, response.StatusCode)
+	require.Equal("Token issuer is not accepted\n", string(responseBody))
+}
+
+func TestValidateTokenAcceptsClientCertificate(t *testing.T) {
+	var claims jwt.MapClaims
+	var identity string
+	handler := ValidateJWT(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ = ClaimsFromContext(r.Context())
+		identity, _ = ClientIdentityFromContext(r.Context())
+	}), VALID_TOKEN_SECTET)
+
+	request := httptest.NewRequest("GET", "http://testing", nil)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "cron"}}
+	request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	responseWriter := httptest.NewRecorder()
+	handler.ServeHTTP(responseWriter, request)
+
+	require := require.New(t)
+	require.Equal(200, responseWriter.Code)
+	require.Equal("cron", identity)
+	require.Equal(jwt.MapClaims{"sub": "cron"}, claims)
+
+	// a certificate nothing verified isn't an identity
+	identity = ""
+	request = httptest.NewRequest("GET", "http://testing", nil)
+	request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	responseWriter = httptest.NewRecorder()
+	handler.ServeHTTP(responseWriter, request)
+	require.Equal(401, responseWriter.Code)
+	require.Empty(identity)
+}
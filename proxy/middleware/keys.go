@@ -0,0 +1,283 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/filewatch"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+KeySet holds the public keys used to verify asymmetrically signed
+(RS256/ES256/EdDSA) tokens, indexed by `kid`.
+
+Keys come from PEM files (the kid is the file name without its
+extension) and/or a JWKS JSON file, and are re-read periodically
+by Watch so they can be rotated without a restart.
+*/
+type KeySet struct {
+	pemFiles []string
+	jwksFile string
+
+	mu       sync.RWMutex
+	keys     map[string]interface{}
+	snapshot filewatch.Snapshot
+}
+
+// jwk is the subset of RFC 7517 we need for public keys
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadKeySet reads public keys from PEM files and/or a JWKS file
+func LoadKeySet(pemFiles []string, jwksFile string) (*KeySet, error) {
+	k := &KeySet{jwksFile: jwksFile}
+	for _, f := range pemFiles {
+		if f = strings.TrimSpace(f); f != "" {
+			k.pemFiles = append(k.pemFiles, f)
+		}
+	}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload re-reads every key file. On error the current keys are kept
+func (k *KeySet) Reload() error {
+	files, err := filewatch.Take(k.files()...)
+	if err != nil {
+		return err
+	}
+	keys := map[string]interface{}{}
+
+	for _, f := range k.pemFiles {
+		key, err := readPEMKey(f)
+		if err != nil {
+			return fmt.Errorf("%s: %v", f, err)
+		}
+		kid := strings.TrimSuffix(filepath.Base(f), filepath.Ext(f))
+		if _, ok := keys[kid]; ok {
+			return fmt.Errorf("%s: key %q: duplicate kid", f, kid)
+		}
+		keys[kid] = key
+	}
+
+	if k.jwksFile != "" {
+		jwks, err := readJWKS(k.jwksFile)
+		if err != nil {
+			return fmt.Errorf("%s: %v", k.jwksFile, err)
+		}
+		for kid, key := range jwks {
+			// which of the two a token meant can't be told apart
+			if _, ok := keys[kid]; ok {
+				return fmt.Errorf("%s: key %q: duplicate kid", k.jwksFile, kid)
+			}
+			keys[kid] = key
+		}
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.snapshot = files
+	k.mu.Unlock()
+
+	return nil
+}
+
+// Watch reloads the key files whenever they change, checking every interval
+func (k *KeySet) Watch(interval time.Duration) {
+	filewatch.Watcher{
+		What:    "JWT public keys",
+		Metric:  "jwt_key",
+		Changed: k.changed,
+		Reload:  k.Reload,
+		Fields:  func() log.Fields { return log.Fields{"keys": k.Len()} },
+	}.Watch(interval)
+}
+
+// Len returns the number of keys loaded
+func (k *KeySet) Len() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return len(k.keys)
+}
+
+/*
+Key returns the public key for a kid. Tokens without a kid are
+only accepted when there's exactly one key to choose from
+*/
+func (k *KeySet) Key(kid string) (interface{}, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if kid == "" {
+		if len(k.keys) == 1 {
+			for _, key := range k.keys {
+				return key, nil
+			}
+		}
+		return nil, fmt.Errorf("Token has no kid")
+	}
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("Unknown kid %q", kid)
+	}
+	return key, nil
+}
+
+func (k *KeySet) files() []string {
+	files := append([]string{}, k.pemFiles...)
+	if k.jwksFile != "" {
+		files = append(files, k.jwksFile)
+	}
+	return files
+}
+
+func (k *KeySet) changed() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.snapshot.Changed()
+}
+
+func readPEMKey(path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found")
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unsupported public key type %T", key)
+}
+
+func readJWKS(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for i, j := range jwks.Keys {
+		key, err := j.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %d (%s): %v", i, j.Kid, err)
+		}
+		if _, ok := keys[j.Kid]; ok {
+			return nil, fmt.Errorf("key %q: duplicate kid", j.Kid)
+		}
+		keys[j.Kid] = key
+	}
+	return keys, nil
+}
+
+func (j jwk) publicKey() (interface{}, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve %q", j.Crv)
+		}
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("Point is not on curve %s", j.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, fmt.Errorf("Unsupported curve %q", j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %q", j.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
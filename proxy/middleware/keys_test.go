@@ -0,0 +1,161 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, dir string, name string, pub interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+	path := filepath.Join(dir, name+".pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+	return path
+}
+
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0600))
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+	token := jwt.NewWithClaims(method, jwt.MapClaims{"sub": "tester", "exp": time.Now().Add(time.Hour).Unix()})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	require.NoError(t, err)
+	return s
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestKeySetVerifiesPEMKeys(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	keys, err := LoadKeySet([]string{
+		writePEM(t, dir, "rsa", &rsaKey.PublicKey),
+		writePEM(t, dir, "ec", &ecKey.PublicKey),
+		writePEM(t, dir, "ed", edPub),
+	}, "")
+	rt := require.New(t)
+	rt.NoError(err)
+	rt.Equal(3, keys.Len())
+
+	v := NewTokenValidator("", nil, keys, ClaimsPolicy{}, nil, nil, nil)
+	_, err = v.Parse(signToken(t, jwt.SigningMethodRS256, "rsa", rsaKey))
+	rt.NoError(err)
+	_, err = v.Parse(signToken(t, jwt.SigningMethodES256, "ec", ecKey))
+	rt.NoError(err)
+	_, err = v.Parse(signToken(t, jwt.SigningMethodEdDSA, "ed", edKey))
+	rt.NoError(err)
+
+	// wrong kid, missing kid with several keys, and HMAC without a secret
+	_, err = v.Parse(signToken(t, jwt.SigningMethodRS256, "ec", rsaKey))
+	rt.Error(err)
+	_, err = v.Parse(signToken(t, jwt.SigningMethodRS256, "", rsaKey))
+	rt.Error(err)
+	_, err = v.Parse(VALID_TOKEN)
+	rt.Error(err)
+}
+
+func TestKeySetVerifiesJWKS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	writeJWKS(t, path,
+		map[string]string{"kty": "RSA", "kid": "r1", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+		map[string]string{"kty": "EC", "kid": "e1", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		map[string]string{"kty": "OKP", "kid": "o1", "crv": "Ed25519", "x": b64(edPub)},
+	)
+
+	keys, err := LoadKeySet(nil, path)
+	rt := require.New(t)
+	rt.NoError(err)
+
+	// a shared secret and public keys can be used together
+	v := NewTokenValidator(VALID_TOKEN_SECTET, nil, keys, ClaimsPolicy{}, nil, nil, nil)
+	_, err = v.Parse(signToken(t, jwt.SigningMethodRS256, "r1", rsaKey))
+	rt.NoError(err)
+	_, err = v.Parse(signToken(t, jwt.SigningMethodES256, "e1", ecKey))
+	rt.NoError(err)
+	_, err = v.Parse(signToken(t, jwt.SigningMethodEdDSA, "o1", edKey))
+	rt.NoError(err)
+	_, err = v.Parse(VALID_TOKEN)
+	rt.NoError(err)
+}
+
+func TestKeySetRejectsDuplicateKids(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "jwks.json")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwk := map[string]string{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"}
+	rt := require.New(t)
+
+	// the same kid from a PEM file and the JWKS
+	writeJWKS(t, path, jwk)
+	_, err := LoadKeySet([]string{writePEM(t, dir, "rsa", &rsaKey.PublicKey)}, path)
+	rt.ErrorContains(err, `key "rsa": duplicate kid`)
+
+	// twice in the JWKS
+	writeJWKS(t, path, jwk, jwk)
+	_, err = LoadKeySet(nil, path)
+	rt.ErrorContains(err, `key "rsa": duplicate kid`)
+
+	// two PEM files with the same name
+	other := filepath.Join(dir, "other")
+	rt.NoError(os.Mkdir(other, 0700))
+	_, err = LoadKeySet([]string{writePEM(t, dir, "rsa", &rsaKey.PublicKey), writePEM(t, other, "rsa", &rsaKey.PublicKey)}, "")
+	rt.ErrorContains(err, `key "rsa": duplicate kid`)
+}
+
+func TestKeySetReloadsRotatedKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	writeJWKS(t, path, map[string]string{"kty": "EC", "kid": "old", "crv": "P-256", "x": b64(oldKey.X.Bytes()), "y": b64(oldKey.Y.Bytes())})
+
+	keys, err := LoadKeySet(nil, path)
+	rt := require.New(t)
+	rt.NoError(err)
+	rt.False(keys.changed())
+
+	writeJWKS(t, path, map[string]string{"kty": "EC", "kid": "new", "crv": "P-256", "x": b64(newKey.X.Bytes()), "y": b64(newKey.Y.Bytes())})
+	future := time.Now().Add(time.Minute)
+	rt.NoError(os.Chtimes(path, future, future))
+	rt.True(keys.changed())
+	rt.NoError(keys.Reload())
+
+	v := NewTokenValidator("", nil, keys, ClaimsPolicy{}, nil, nil, nil)
+	_, err = v.Parse(signToken(t, jwt.SigningMethodES256, "new", newKey))
+	rt.NoError(err)
+	_, err = v.Parse(signToken(t, jwt.SigningMethodES256, "old", oldKey))
+	rt.Error(err)
+
+	// a broken file keeps the current keys
+	rt.NoError(os.WriteFile(path, []byte("{"), 0600))
+	rt.Error(keys.Reload())
+	_, err = v.Parse(signToken(t, jwt.SigningMethodES256, "new", newKey))
+	rt.NoError(err)
+}
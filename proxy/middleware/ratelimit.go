@@ -0,0 +1,243 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/ratelimit"
+	log "github.com/sirupsen/logrus"
+)
+
+const quotaContextKey contextKey = "metric-quota"
+
+// buckets are kept at least this long after their last use
+const minBucketIdle = time.Minute
+
+/*
+ClientLimiter limits how fast each client may send requests, and how
+many metrics per second, with a token bucket per client for each.
+Clients are told apart by their token's subject (API keys, signed
+requests and client certificates all have one) or by IP
+*/
+type ClientLimiter struct {
+	requests       *ratelimit.Limiter
+	metrics        *ratelimit.Limiter
+	keyBy          string
+	trustedProxies []*net.IPNet
+}
+
+/*
+NewClientLimiter creates a limiter. A rate of 0 leaves that limit off.
+keyBy is "sub" (the default, using the IP when there's no subject) or
+"ip". A burst below 1 is a second's worth. trustedProxies are the addresses (or CIDRs) of proxies whose
+X-Forwarded-For and X-Real-IP headers are believed
+*/
+func NewClientLimiter(requestRate float64, requestBurst int, metricRate float64, metricBurst int, keyBy string, trustedProxies []string) (*ClientLimiter, error) {
+	switch keyBy {
+	case "":
+		keyBy = "sub"
+	case "sub", "ip":
+	default:
+		return nil, fmt.Errorf("Invalid rate limit key %q, must be sub or ip", keyBy)
+	}
+	if requestRate < 0 || metricRate < 0 {
+		return nil, fmt.Errorf("Rate limits can't be negative")
+	}
+
+	l := &ClientLimiter{keyBy: keyBy}
+	for _, p := range trustedProxies {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p += "/128"
+			} else {
+				p += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy %q: %v", p, err)
+		}
+		l.trustedProxies = append(l.trustedProxies, network)
+	}
+	if requestRate > 0 {
+		if requestBurst < 1 {
+			requestBurst = int(math.Ceil(requestRate))
+		}
+		l.requests = ratelimit.NewLimiter(requestRate, requestBurst, bucketIdle(requestRate, requestBurst))
+	}
+	if metricRate > 0 {
+		if metricBurst < 1 {
+			metricBurst = int(math.Ceil(metricRate))
+		}
+		l.metrics = ratelimit.NewLimiter(metricRate, metricBurst, bucketIdle(metricRate, metricBurst))
+	}
+
+	vmmetrics.GetOrCreateGauge("rate_limit_buckets", func() float64 {
+		var n int
+		if l.requests != nil {
+			n += l.requests.Len()
+		}
+		if l.metrics != nil {
+			n += l.metrics.Len()
+		}
+		return float64(n)
+	})
+	return l, nil
+}
+
+// an idle bucket can only be forgotten once it would have refilled
+func bucketIdle(rate float64, burst int) time.Duration {
+	refill := time.Duration(float64(burst) / rate * float64(time.Second))
+	if refill < minBucketIdle {
+		return minBucketIdle
+	}
+	return refill
+}
+
+// Key names the client of a request
+func (l *ClientLimiter) Key(r *http.Request) string {
+	if sub := l.subject(r.Context()); sub != "" {
+		return "sub:" + sub
+	}
+	return "ip:" + l.ClientIP(r)
+}
+
+// subject is the token's subject, if clients are told apart by it
+func (l *ClientLimiter) subject(ctx context.Context) string {
+	if l.keyBy != "sub" {
+		return ""
+	}
+	claims, _ := ClaimsFromContext(ctx)
+	sub, _ := claims["sub"].(string)
+	return sub
+}
+
+/*
+ClientIP is the address of a request's client. Forwarding headers are
+only believed from trusted proxies, and X-Forwarded-For is read from
+the right, skipping our own proxies, since clients can prepend to it
+*/
+func (l *ClientLimiter) ClientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if !l.trusted(remote) {
+		return remote
+	}
+
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if !l.trusted(hop) || i == 0 {
+				return hop
+			}
+		}
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return remote
+}
+
+func (l *ClientLimiter) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range l.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// metricQuota consumes a client's metric tokens
+type metricQuota func(n int) (bool, time.Duration)
+
+/*
+ReserveMetrics takes n metrics from the request client's metric rate
+limit, returning how long to wait if they're over it. Handlers call
+it once they know how many metrics a request holds, so one huge batch
+counts for all its metrics. Without a limit it always succeeds
+*/
+func ReserveMetrics(ctx context.Context, n int) (bool, time.Duration) {
+	quota, ok := ctx.Value(quotaContextKey).(metricQuota)
+	if !ok || n == 0 {
+		return true, 0
+	}
+	ok, wait := quota(n)
+	if !ok {
+		vmmetrics.GetOrCreateCounter(`rate_limited_total{limit="metrics"}`).Inc()
+	}
+	return ok, wait
+}
+
+// TooManyRequests responds 429, telling the client when to retry
+func TooManyRequests(w http.ResponseWriter, msg string, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+/*
+Limit applies the request rate limit to a call that isn't an HTTP
+request (like a gRPC one) from ip, returning a context that carries
+the client's metric quota for ReserveMetrics
+*/
+func (l *ClientLimiter) Limit(ctx context.Context, ip string) (context.Context, bool, time.Duration) {
+	key := "ip:" + ip
+	if sub := l.subject(ctx); sub != "" {
+		key = "sub:" + sub
+	}
+	return l.limit(ctx, key)
+}
+
+func (l *ClientLimiter) limit(ctx context.Context, key string) (context.Context, bool, time.Duration) {
+	if l.requests != nil {
+		if ok, wait := l.requests.Reserve(key, 1); !ok {
+			log.WithFields(log.Fields{"client": key}).Debug("Request rate limited")
+			vmmetrics.GetOrCreateCounter(`rate_limited_total{limit="requests"}`).Inc()
+			return ctx, false, wait
+		}
+	}
+
+	if l.metrics != nil {
+		quota := metricQuota(func(n int) (bool, time.Duration) {
+			return l.metrics.Reserve(key, n)
+		})
+		ctx = context.WithValue(ctx, quotaContextKey, quota)
+	}
+	return ctx, true, 0
+}
+
+// rate limiting middleware, run after the token is validated so clients can be told apart by subject
+func RateLimit(next http.Handler, limiter *ClientLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, ok, wait := limiter.limit(r.Context(), limiter.Key(r))
+		if !ok {
+			TooManyRequests(w, "Request rate limit exceeded", wait)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
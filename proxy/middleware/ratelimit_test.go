@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	l, err := NewClientLimiter(1, 1, 0, 0, "ip", []string{"10.0.0.0/8", "192.168.1.1"})
+	require.NoError(t, err)
+	rt := require.New(t)
+
+	clientIP := func(remote string, forwarded string, realIP string) string {
+		r := httptest.NewRequest("POST", "/batch", nil)
+		r.RemoteAddr = remote + ":1234"
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+		if realIP != "" {
+			r.Header.Set("X-Real-IP", realIP)
+		}
+		return l.ClientIP(r)
+	}
+
+	// headers from untrusted peers are ignored
+	rt.Equal("203.0.113.9", clientIP("203.0.113.9", "198.51.100.1", ""))
+	// the rightmost address that isn't one of our proxies
+	rt.Equal("198.51.100.1", clientIP("10.1.1.1", "1.2.3.4, 198.51.100.1, 10.2.2.2", ""))
+	rt.Equal("198.51.100.1", clientIP("192.168.1.1", "198.51.100.1", ""))
+	rt.Equal("10.3.3.3", clientIP("10.1.1.1", "10.3.3.3, 10.2.2.2", ""))
+	rt.Equal("198.51.100.2", clientIP("10.1.1.1", "", "198.51.100.2"))
+	rt.Equal("10.1.1.1", clientIP("10.1.1.1", "not-an-ip", ""))
+}
+
+func TestNewClientLimiterValidation(t *testing.T) {
+	_, err := NewClientLimiter(1, 1, 0, 0, "header", nil)
+	require.Error(t, err)
+	_, err = NewClientLimiter(-1, 1, 0, 0, "ip", nil)
+	require.Error(t, err)
+	_, err = NewClientLimiter(1, 1, 0, 0, "ip", []string{"10.0.0.0/33"})
+	require.Error(t, err)
+}
+
+func TestRateLimitRequests(t *testing.T) {
+	l, err := NewClientLimiter(0.5, 2, 0, 0, "sub", nil)
+	require.NoError(t, err)
+	handler := RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), l)
+	rt := require.New(t)
+
+	serve := func(sub string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/batch", nil)
+		if sub != "" {
+			r = r.WithContext(ContextWithClaims(r.Context(), jwt.MapClaims{"sub": sub}))
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rt.Equal(200, serve("cron").Code)
+	rt.Equal(200, serve("cron").Code)
+	rr := serve("cron")
+	rt.Equal(http.StatusTooManyRequests, rr.Code)
+	rt.Equal("2", rr.Header().Get("Retry-After"))
+
+	// other subjects, and clients without one, have their own buckets
+	rt.Equal(200, serve("web").Code)
+	rt.Equal(200, serve("").Code)
+}
+
+func TestReserveMetrics(t *testing.T) {
+	l, err := NewClientLimiter(0, 0, 10, 100, "ip", nil)
+	require.NoError(t, err)
+	var results []bool
+	handler := RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, _ := ReserveMetrics(r.Context(), 150)
+		results = append(results, ok)
+	}), l)
+
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/batch", nil))
+	}
+	// a full bucket lets one oversized batch through, then the client waits
+	require.Equal(t, []bool{true, false, false}, results)
+
+	ok, wait := ReserveMetrics(httptest.NewRequest("POST", "/batch", nil).Context(), 1000)
+	require.True(t, ok)
+	require.Zero(t, wait)
+}
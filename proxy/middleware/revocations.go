@@ -0,0 +1,253 @@
+package middleware
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/filewatch"
+	"github.com/golang-jwt/jwt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Revocation blocks a single token (by jti) or a subject's tokens (by sub)
+type Revocation struct {
+	Jti string `yaml:"jti,omitempty" json:"jti,omitempty"`
+	Sub string `yaml:"sub,omitempty" json:"sub,omitempty"`
+	// sub revocations block tokens issued (iat) up to this time, including the same second
+	RevokedAt int64 `yaml:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	// unix time after which the revoked tokens have expired anyway, so the revocation can go (0 is never)
+	Expires int64 `yaml:"expires,omitempty" json:"expires,omitempty"`
+}
+
+/*
+RevocationList holds revoked tokens, from a YAML file that's
+re-read when it changes:
+
+  - jti: "5f0c1a"
+    expires: 1767225600
+  - sub: "web-frontend"
+    revoked_at: 1760000000
+
+Revocations added at runtime are written back to the file, and
+revocations are dropped once the tokens they block have expired
+*/
+type RevocationList struct {
+	file  string
+	grace time.Duration
+
+	mu       sync.RWMutex
+	byJti    map[string]Revocation
+	bySub    map[string]Revocation
+	snapshot filewatch.Snapshot
+}
+
+/*
+LoadRevocationList reads revocations from a file, which doesn't
+have to exist yet. grace keeps revocations around a little past
+their tokens' expiry, to cover the leeway tokens are allowed
+*/
+func LoadRevocationList(path string, grace time.Duration) (*RevocationList, error) {
+	l := &RevocationList{file: path, grace: grace}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload re-reads the revocations file. On error the current revocations are kept
+func (l *RevocationList) Reload() error {
+	var revocations []Revocation
+
+	snapshot, err := filewatch.TakeOptional(l.file)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(l.file)
+	if err == nil {
+		if err := yaml.Unmarshal(data, &revocations); err != nil {
+			return fmt.Errorf("%s: %v", l.file, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	byJti := map[string]Revocation{}
+	bySub := map[string]Revocation{}
+	for i, r := range revocations {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("%s: revocation %d: %v", l.file, i, err)
+		}
+		if r.Jti != "" {
+			byJti[r.Jti] = r
+		} else {
+			bySub[r.Sub] = r
+		}
+	}
+
+	l.mu.Lock()
+	l.byJti = byJti
+	l.bySub = bySub
+	l.snapshot = snapshot
+	l.mu.Unlock()
+
+	return nil
+}
+
+// Validate checks a revocation names exactly one of a jti or a sub
+func (r Revocation) Validate() error {
+	if (r.Jti == "") == (r.Sub == "") {
+		return fmt.Errorf("Exactly one of jti and sub is required")
+	}
+	return nil
+}
+
+// Add revokes a token (or subject) and saves the list
+func (l *RevocationList) Add(r Revocation) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	if r.Sub != "" && r.RevokedAt == 0 {
+		r.RevokedAt = time.Now().Unix()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if r.Jti != "" {
+		l.byJti[r.Jti] = r
+	} else {
+		l.bySub[r.Sub] = r
+	}
+	return l.save()
+}
+
+// List returns every revocation, ordered for stable output
+func (l *RevocationList) List() []Revocation {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.list()
+}
+
+/*
+Check returns a ClaimsError for revoked tokens. A sub revocation
+only blocks tokens issued up to it, so the subject can be given
+new tokens straight away. iat is in whole seconds, so a token issued
+in the same second as the revocation is treated as issued before it
+*/
+func (l *RevocationList) Check(claims jwt.MapClaims) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if jti, ok := claims["jti"].(string); ok && jti != "" {
+		if _, revoked := l.byJti[jti]; revoked {
+			vmmetrics.GetOrCreateCounter(`auth_reqs_revoked_total{by="jti"}`).Inc()
+			return claimsError("revoked", "Token has been revoked")
+		}
+	}
+	if sub, ok := claims["sub"].(string); ok && sub != "" {
+		if r, revoked := l.bySub[sub]; revoked {
+			iat, hasIat, _ := numericClaim(claims, "iat")
+			if !hasIat || iat.Unix() <= r.RevokedAt {
+				vmmetrics.GetOrCreateCounter(`auth_reqs_revoked_total{by="sub"}`).Inc()
+				return claimsError("revoked", "Token has been revoked")
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Watch reloads the revocations file whenever it changes, and drops
+expired revocations, checking every interval
+*/
+func (l *RevocationList) Watch(interval time.Duration) {
+	filewatch.Watcher{
+		What:    "JWT revocations",
+		Metric:  "jwt_revocation",
+		Changed: l.changed,
+		Reload:  l.Reload,
+		Tick: func() {
+			if err := l.Expire(time.Now()); err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Failed to save JWT revocations")
+			}
+		},
+	}.Watch(interval)
+}
+
+// Expire drops revocations for tokens that have expired by now, saving the list if any were dropped
+func (l *RevocationList) Expire(now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expired := 0
+	for _, revocations := range []map[string]Revocation{l.byJti, l.bySub} {
+		for key, r := range revocations {
+			if r.Expires > 0 && now.After(time.Unix(r.Expires, 0).Add(l.grace)) {
+				delete(revocations, key)
+				expired++
+			}
+		}
+	}
+	if expired == 0 {
+		return nil
+	}
+	vmmetrics.GetOrCreateCounter("jwt_revocations_expired_total").Add(expired)
+	return l.save()
+}
+
+func (l *RevocationList) list() []Revocation {
+	revocations := make([]Revocation, 0, len(l.byJti)+len(l.bySub))
+	for _, r := range l.byJti {
+		revocations = append(revocations, r)
+	}
+	for _, r := range l.bySub {
+		revocations = append(revocations, r)
+	}
+	sort.Slice(revocations, func(i, j int) bool {
+		if revocations[i].Jti != revocations[j].Jti {
+			return revocations[i].Jti < revocations[j].Jti
+		}
+		return revocations[i].Sub < revocations[j].Sub
+	})
+	return revocations
+}
+
+// save writes the list out (through a temp file, so a reload never sees half a file). Callers hold the lock
+func (l *RevocationList) save() error {
+	data, err := yaml.Marshal(l.list())
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.file), ".revocations-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), l.file); err != nil {
+		return err
+	}
+
+	// we already have what's in the file, don't reload it
+	if snapshot, err := filewatch.Take(l.file); err == nil {
+		l.snapshot = snapshot
+	}
+	return nil
+}
+
+func (l *RevocationList) changed() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.snapshot.Changed()
+}
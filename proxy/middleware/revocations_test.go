@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevocationListCheck(t *testing.T) {
+	list, err := LoadRevocationList(filepath.Join(t.TempDir(), "revocations.yaml"), 0)
+	require.NoError(t, err)
+	rt := require.New(t)
+
+	rt.NoError(list.Add(Revocation{Jti: "leaked"}))
+	rt.NoError(list.Add(Revocation{Sub: "web-frontend", RevokedAt: 1000}))
+	rt.Error(list.Add(Revocation{Jti: "both", Sub: "both"}))
+
+	err = list.Check(jwt.MapClaims{"jti": "leaked", "sub": "cron"})
+	rt.Equal("revoked", err.(*ClaimsError).Reason)
+	rt.NoError(list.Check(jwt.MapClaims{"jti": "fine", "sub": "cron"}))
+
+	// only tokens issued up to a sub revocation are blocked
+	rt.Error(list.Check(jwt.MapClaims{"sub": "web-frontend", "iat": float64(999)}))
+	rt.Error(list.Check(jwt.MapClaims{"sub": "web-frontend"}))
+	rt.NoError(list.Check(jwt.MapClaims{"sub": "web-frontend", "iat": float64(1001)}))
+}
+
+func TestRevocationListBlocksTokensFromTheSameSecond(t *testing.T) {
+	list, err := LoadRevocationList(filepath.Join(t.TempDir(), "revocations.yaml"), 0)
+	require.NoError(t, err)
+
+	// iat has no fractions, so a token minted just before the revocation has the same time
+	require.NoError(t, list.Add(Revocation{Sub: "web-frontend", RevokedAt: 1000}))
+	err = list.Check(jwt.MapClaims{"sub": "web-frontend", "iat": float64(1000)})
+	require.Equal(t, "revoked", err.(*ClaimsError).Reason)
+}
+
+func TestRevocationListPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations.yaml")
+	list, err := LoadRevocationList(path, time.Minute)
+	require.NoError(t, err)
+	rt := require.New(t)
+	rt.False(list.changed())
+
+	now := time.Now()
+	rt.NoError(list.Add(Revocation{Jti: "old", Expires: now.Add(-2 * time.Minute).Unix()}))
+	rt.NoError(list.Add(Revocation{Jti: "within-grace", Expires: now.Add(-30 * time.Second).Unix()}))
+	rt.NoError(list.Add(Revocation{Jti: "new", Expires: now.Add(time.Hour).Unix()}))
+	rt.False(list.changed())
+
+	rt.NoError(list.Expire(now))
+	rt.Equal([]Revocation{
+		{Jti: "new", Expires: now.Add(time.Hour).Unix()},
+		{Jti: "within-grace", Expires: now.Add(-30 * time.Second).Unix()},
+	}, list.List())
+
+	reloaded, err := LoadRevocationList(path, time.Minute)
+	rt.NoError(err)
+	rt.Equal(list.List(), reloaded.List())
+}
+
+func TestRevokedTokenRejected(t *testing.T) {
+	list, err := LoadRevocationList(filepath.Join(t.TempDir(), "revocations.yaml"), 0)
+	require.NoError(t, err)
+	require.NoError(t, list.Add(Revocation{Sub: "tester"}))
+	v := NewTokenValidator(VALID_TOKEN_SECTET, nil, nil, ClaimsPolicy{}, list, nil, nil)
+
+	_, err = v.Parse(signToken(t, jwt.SigningMethodHS256, "", []byte(VALID_TOKEN_SECTET)))
+
+	require.Equal(t, "revoked", err.(*ClaimsError).Reason)
+}
+
+func TestRequireAdmin(t *testing.T) {
+	handler := RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rt := require.New(t)
+
+	for claims, code := range map[*jwt.MapClaims]int{
+		nil:                             http.StatusForbidden,
+		{"sub": "web-frontend"}:         http.StatusForbidden,
+		{"sub": "ops", "admin": "true"}: http.StatusForbidden,
+		{"sub": "ops", "admin": true}:   http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/admin/revocations", nil)
+		if claims != nil {
+			req = req.WithContext(ContextWithClaims(req.Context(), *claims))
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		rt.Equal(code, res.Code, claims)
+	}
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+/*
+Scope restricts what a token may write, from its `scope` claim:
+
+	"scope": {"metrics": ["web.checkout.*"], "types": ["count", "timing"]}
+
+`*` in a metric pattern matches any run of characters. An empty
+list places no restriction on that dimension
+*/
+type Scope struct {
+	Metrics []string `json:"metrics"`
+	Types   []string `json:"types"`
+}
+
+// ScopeError is returned for metrics outside a token's scope
+type ScopeError struct {
+	// short, low-cardinality reason for internal metrics
+	Reason string
+	msg    string
+}
+
+func (e *ScopeError) Error() string {
+	return e.msg
+}
+
+/*
+ScopeFromContext returns the scope of the token that authenticated a
+request. A nil scope (no token, or no scope claim) is unrestricted.
+
+A plain string scope is an OAuth-style scope meant for someone else,
+so it's ignored rather than treated as malformed
+*/
+func ScopeFromContext(ctx context.Context) (*Scope, error) {
+	claims, ok := ClaimsFromContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+	switch raw := claims["scope"].(type) {
+	case nil, string:
+		return nil, nil
+	case map[string]interface{}:
+		// round-trip through JSON rather than picking apart interface{}s
+		data, err := json.Marshal(raw)
+		if err != nil {
+			return nil, &ScopeError{Reason: "scope_invalid", msg: "Invalid scope claim"}
+		}
+		var scope Scope
+		if err := json.Unmarshal(data, &scope); err != nil {
+			return nil, &ScopeError{Reason: "scope_invalid", msg: "Invalid scope claim"}
+		}
+		return &scope, nil
+	}
+	return nil, &ScopeError{Reason: "scope_invalid", msg: "Invalid scope claim"}
+}
+
+// Check returns a ScopeError if the scope doesn't allow the metric
+func (s *Scope) Check(metric string, metricType string) error {
+	if s == nil {
+		return nil
+	}
+	if len(s.Types) > 0 && !contains(s.Types, metricType) {
+		return &ScopeError{
+			Reason: "scope_type",
+			msg:    fmt.Sprintf("Metric type %q is outside the token's scope", metricType),
+		}
+	}
+	if len(s.Metrics) > 0 {
+		for _, pattern := range s.Metrics {
+			if matchGlob(pattern, metric) {
+				return nil
+			}
+		}
+		return &ScopeError{
+			Reason: "scope_metric",
+			msg:    fmt.Sprintf("Metric %q is outside the token's scope", metric),
+		}
+	}
+	return nil
+}
+
+func contains(list []string, item string) bool {
+	for _, l := range list {
+		if l == item {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches name against a pattern where `*` matches any run of characters
+func matchGlob(pattern string, name string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+
+	// anchor the first and last literal parts, then find the middle ones in order
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(name, part)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(part):]
+	}
+	return len(name) >= len(last) && strings.HasSuffix(name, last)
+}
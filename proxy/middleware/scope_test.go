@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchGlob(t *testing.T) {
+	rt := require.New(t)
+
+	rt.True(matchGlob("web.checkout.*", "web.checkout.total"))
+	rt.True(matchGlob("web.checkout.*", "web.checkout.step.one"))
+	rt.False(matchGlob("web.checkout.*", "web.cart.total"))
+	rt.True(matchGlob("web.*.latency", "web.checkout.latency"))
+	rt.False(matchGlob("web.*.latency", "web.checkout.latency.p99"))
+	rt.True(matchGlob("*", "anything"))
+	rt.True(matchGlob("web.total", "web.total"))
+	rt.False(matchGlob("web.total", "web.totals"))
+	rt.False(matchGlob("a*a", "a"))
+}
+
+func TestScopeCheck(t *testing.T) {
+	scope := &Scope{Metrics: []string{"web.checkout.*"}, Types: []string{"count", "timing"}}
+	rt := require.New(t)
+
+	rt.NoError(scope.Check("web.checkout.total", "count"))
+	err := scope.Check("web.checkout.total", "gauge")
+	rt.Equal("scope_type", err.(*ScopeError).Reason)
+	err = scope.Check("backend.queue", "count")
+	rt.Equal("scope_metric", err.(*ScopeError).Reason)
+
+	// no scope is no restriction
+	var unrestricted *Scope
+	rt.NoError(unrestricted.Check("backend.queue", "gauge"))
+	rt.NoError((&Scope{Types: []string{"gauge"}}).Check("backend.queue", "gauge"))
+}
+
+func TestScopeFromContext(t *testing.T) {
+	rt := require.New(t)
+
+	scope, err := ScopeFromContext(context.Background())
+	rt.NoError(err)
+	rt.Nil(scope)
+
+	ctx := ContextWithClaims(context.Background(), jwt.MapClaims{"scope": "openid profile"})
+	scope, err = ScopeFromContext(ctx)
+	rt.NoError(err)
+	rt.Nil(scope)
+
+	ctx = ContextWithClaims(context.Background(), jwt.MapClaims{"scope": map[string]interface{}{
+		"metrics": []interface{}{"web.*"},
+		"types":   []interface{}{"count"},
+	}})
+	scope, err = ScopeFromContext(ctx)
+	rt.NoError(err)
+	rt.Equal(&Scope{Metrics: []string{"web.*"}, Types: []string{"count"}}, scope)
+
+	ctx = ContextWithClaims(context.Background(), jwt.MapClaims{"scope": map[string]interface{}{"metrics": "web.*"}})
+	_, err = ScopeFromContext(ctx)
+	rt.Error(err)
+	ctx = ContextWithClaims(context.Background(), jwt.MapClaims{"scope": 42.0})
+	_, err = ScopeFromContext(ctx)
+	rt.Error(err)
+}
@@ -0,0 +1,163 @@
+package middleware
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/filewatch"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+SecretSet holds the HMAC secrets accepted for HS256/HS384/HS512
+tokens, indexed by `kid`, so a secret can be rotated without
+invalidating the tokens already signed with the old one.
+
+One secret is the primary: tokens without a kid are verified
+(and new tokens are signed) with it. The file is re-read
+periodically by Watch.
+*/
+type SecretSet struct {
+	file string
+
+	mu       sync.RWMutex
+	secrets  map[string][]byte
+	primary  string
+	snapshot filewatch.Snapshot
+}
+
+// Secret is a single entry of the secrets file
+type Secret struct {
+	Kid     string `yaml:"kid"`
+	Secret  string `yaml:"secret"`
+	Primary bool   `yaml:"primary"`
+}
+
+/*
+LoadSecretSet reads HMAC secrets from a YAML file:
+
+  - kid: "2026-10"
+    secret: "..."
+    primary: true
+  - kid: "2026-07"
+    secret: "..."
+
+A file with a single secret doesn't need to mark it primary
+*/
+func LoadSecretSet(path string) (*SecretSet, error) {
+	s := &SecretSet{file: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads the secrets file. On error the current secrets are kept
+func (s *SecretSet) Reload() error {
+	files, err := filewatch.Take(s.file)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	var entries []Secret
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("%s: %v", s.file, err)
+	}
+	secrets, primary, err := parseSecrets(entries)
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.file, err)
+	}
+
+	s.mu.Lock()
+	s.secrets = secrets
+	s.primary = primary
+	s.snapshot = files
+	s.mu.Unlock()
+
+	return nil
+}
+
+func parseSecrets(entries []Secret) (map[string][]byte, string, error) {
+	if len(entries) == 0 {
+		return nil, "", fmt.Errorf("No secrets found")
+	}
+	secrets := map[string][]byte{}
+	primary := ""
+	for i, e := range entries {
+		if e.Kid == "" {
+			return nil, "", fmt.Errorf("Secret %d: kid is required", i)
+		}
+		if e.Secret == "" {
+			return nil, "", fmt.Errorf("Secret %q: secret is required", e.Kid)
+		}
+		if _, ok := secrets[e.Kid]; ok {
+			return nil, "", fmt.Errorf("Secret %q: duplicate kid", e.Kid)
+		}
+		secrets[e.Kid] = []byte(e.Secret)
+		if e.Primary {
+			if primary != "" {
+				return nil, "", fmt.Errorf("Secret %q: only one secret may be primary", e.Kid)
+			}
+			primary = e.Kid
+		}
+	}
+	if primary == "" {
+		if len(entries) > 1 {
+			return nil, "", fmt.Errorf("One secret must be primary")
+		}
+		primary = entries[0].Kid
+	}
+	return secrets, primary, nil
+}
+
+// Watch reloads the secrets file whenever it changes, checking every interval
+func (s *SecretSet) Watch(interval time.Duration) {
+	filewatch.Watcher{
+		What:    "JWT secrets",
+		Metric:  "jwt_secret",
+		Changed: s.changed,
+		Reload:  s.Reload,
+		Fields:  func() log.Fields { return log.Fields{"secrets": s.Len()} },
+	}.Watch(interval)
+}
+
+// Len returns the number of secrets loaded
+func (s *SecretSet) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.secrets)
+}
+
+// Secret returns the secret for a kid (the primary for no kid), and the kid it resolved to
+func (s *SecretSet) Secret(kid string) ([]byte, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if kid == "" {
+		kid = s.primary
+	}
+	secret, ok := s.secrets[kid]
+	if !ok {
+		return nil, "", fmt.Errorf("Unknown kid %q", kid)
+	}
+	return secret, kid, nil
+}
+
+// Primary returns the kid and secret new tokens should be signed with
+func (s *SecretSet) Primary() (string, []byte) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.primary, s.secrets[s.primary]
+}
+
+func (s *SecretSet) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.snapshot.Changed()
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecrets = `
+- kid: new
+  secret: new-secret
+  primary: true
+- kid: old
+  secret: old-secret
+`
+
+func writeSecrets(t *testing.T, path string, content string) {
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+}
+
+func TestParseSecretsValidation(t *testing.T) {
+	rt := require.New(t)
+
+	_, primary, err := parseSecrets([]Secret{{Kid: "only", Secret: "s"}})
+	rt.NoError(err)
+	rt.Equal("only", primary)
+
+	_, _, err = parseSecrets([]Secret{{Kid: "a", Secret: "s"}, {Kid: "b", Secret: "s"}})
+	rt.Error(err)
+	_, _, err = parseSecrets([]Secret{{Kid: "a", Secret: "s", Primary: true}, {Kid: "b", Secret: "s", Primary: true}})
+	rt.Error(err)
+	_, _, err = parseSecrets([]Secret{{Kid: "a", Secret: "s", Primary: true}, {Kid: "a", Secret: "t"}})
+	rt.Error(err)
+	_, _, err = parseSecrets([]Secret{{Kid: "a"}})
+	rt.Error(err)
+	_, _, err = parseSecrets(nil)
+	rt.Error(err)
+}
+
+func TestSecretSetVerifiesByKid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.yaml")
+	writeSecrets(t, path, testSecrets)
+	secrets, err := LoadSecretSet(path)
+	require.NoError(t, err)
+	v := NewTokenValidator("", secrets, nil, ClaimsPolicy{}, nil, nil, nil)
+	rt := require.New(t)
+
+	_, err = v.Parse(signToken(t, jwt.SigningMethodHS256, "new", []byte("new-secret")))
+	rt.NoError(err)
+	_, err = v.Parse(signToken(t, jwt.SigningMethodHS256, "old", []byte("old-secret")))
+	rt.NoError(err)
+	// no kid is the primary
+	_, err = v.Parse(signToken(t, jwt.SigningMethodHS256, "", []byte("new-secret")))
+	rt.NoError(err)
+	_, err = v.Parse(signToken(t, jwt.SigningMethodHS256, "", []byte("old-secret")))
+	rt.Error(err)
+	_, err = v.Parse(signToken(t, jwt.SigningMethodHS256, "old", []byte("new-secret")))
+	rt.Error(err)
+	_, err = v.Parse(signToken(t, jwt.SigningMethodHS256, "retired", []byte("old-secret")))
+	rt.Error(err)
+}
+
+func TestSecretSetReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.yaml")
+	writeSecrets(t, path, testSecrets)
+	secrets, err := LoadSecretSet(path)
+	require.NoError(t, err)
+	rt := require.New(t)
+	rt.False(secrets.changed())
+
+	// retire the old secret
+	writeSecrets(t, path, "- kid: new\n  secret: new-secret\n")
+	future := time.Now().Add(time.Minute)
+	rt.NoError(os.Chtimes(path, future, future))
+	rt.True(secrets.changed())
+	rt.NoError(secrets.Reload())
+	rt.Equal(1, secrets.Len())
+	_, _, err = secrets.Secret("old")
+	rt.Error(err)
+
+	// a broken file keeps the current secrets
+	writeSecrets(t, path, "- kid: a\n- kid: b\n")
+	rt.Error(secrets.Reload())
+	kid, secret := secrets.Primary()
+	rt.Equal("new", kid)
+	rt.Equal([]byte("new-secret"), secret)
+}
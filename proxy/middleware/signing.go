@@ -0,0 +1,283 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/filewatch"
+	"github.com/golang-jwt/jwt"
+	"gopkg.in/yaml.v3"
+)
+
+// SignatureScheme starts the Authorization header of a signed request
+const SignatureScheme = "HMAC-SHA256"
+
+const maxNonceLength = 128
+
+// signed bodies are hashed in memory, so they're kept to a sane size (5 MB)
+const maxSignedBodySize = 5 * 1024 * 1024
+
+// SigningKey is a single entry of the signing keys file
+type SigningKey struct {
+	ID     string `yaml:"id"`
+	Secret string `yaml:"secret"`
+	// metric name prefixes the key may write (any, if empty)
+	Prefixes []string `yaml:"prefixes"`
+	// metric types the key may write (any, if empty)
+	Types []string `yaml:"types"`
+}
+
+// SignatureError is a rejected request signature
+type SignatureError struct {
+	// short, low-cardinality reason for internal metrics
+	Reason string
+	msg    string
+}
+
+func (e *SignatureError) Error() string {
+	return e.msg
+}
+
+/*
+SigningKeySet verifies requests signed by servers that share a key with
+us, so a captured request can't be replayed the way a bearer token can.
+Keys come from a YAML file that's re-read when it changes:
+
+  - id: billing-worker
+    secret: "a long random secret"
+    prefixes: ["billing."]
+
+A signed request carries
+
+	Authorization: HMAC-SHA256 KeyId=<id>, Timestamp=<unix seconds>, Nonce=<random>, Signature=<hex>
+
+where the signature is the HMAC-SHA256 of StringToSign. Timestamps must
+be within the window of our clock, and nonces can't be reused within it
+*/
+type SigningKeySet struct {
+	file   string
+	window time.Duration
+
+	mu       sync.RWMutex
+	keys     map[string]SigningKey
+	snapshot filewatch.Snapshot
+
+	nonceMu   sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+// LoadSigningKeySet reads signing keys from a file. window is how far request timestamps may be from now
+func LoadSigningKeySet(path string, window time.Duration) (*SigningKeySet, error) {
+	s := &SigningKeySet{
+		file:      path,
+		window:    window,
+		nonces:    map[string]time.Time{},
+		lastSweep: time.Now(),
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads the signing keys file. On error the current keys are kept
+func (s *SigningKeySet) Reload() error {
+	files, err := filewatch.Take(s.file)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	var list []SigningKey
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("%s: %v", s.file, err)
+	}
+
+	keys := map[string]SigningKey{}
+	for i, k := range list {
+		if k.ID == "" || k.Secret == "" {
+			return fmt.Errorf("%s: signing key %d: id and secret are required", s.file, i)
+		}
+		if _, ok := keys[k.ID]; ok {
+			return fmt.Errorf("%s: signing key %q: duplicate id", s.file, k.ID)
+		}
+		keys[k.ID] = k
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.snapshot = files
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Watch reloads the signing keys file whenever it changes, checking every interval
+func (s *SigningKeySet) Watch(interval time.Duration) {
+	filewatch.Watcher{What: "signing keys", Metric: "signing_key", Changed: s.changed, Reload: s.Reload}.Watch(interval)
+}
+
+// IsSignedRequest is true when a request claims to be signed (it may still fail to verify)
+func IsSignedRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), SignatureScheme+" ")
+}
+
+/*
+StringToSign is what a request's signature covers: the scheme,
+timestamp, nonce, method, escaped path, raw query string and the
+hex sha256 of the body, one per line
+*/
+func StringToSign(timestamp string, nonce string, method string, path string, query string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return strings.Join([]string{
+		SignatureScheme,
+		timestamp,
+		nonce,
+		strings.ToUpper(method),
+		path,
+		query,
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+}
+
+// SignRequest signs a request the way Verify expects, for Go clients (and tests)
+func SignRequest(r *http.Request, keyID string, secret string, now time.Time, nonce string) error {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(StringToSign(timestamp, nonce, r.Method, r.URL.EscapedPath(), r.URL.RawQuery, body)))
+	r.Header.Set("Authorization", fmt.Sprintf("%s KeyId=%s, Timestamp=%s, Nonce=%s, Signature=%s",
+		SignatureScheme, keyID, timestamp, nonce, hex.EncodeToString(mac.Sum(nil))))
+	return nil
+}
+
+/*
+Verify checks a signed request, returning claims standing in for a
+token's: the key id (as `signed:<id>`) is the subject, and its prefixes
+and types are its scope. The body is read and replaced, so handlers
+can still read it. Failures are counted per key
+*/
+func (s *SigningKeySet) Verify(r *http.Request, now time.Time) (jwt.MapClaims, error) {
+	params := parseSignatureParams(strings.TrimPrefix(r.Header.Get("Authorization"), SignatureScheme+" "))
+	keyID, timestamp, nonce, signature := params["KeyId"], params["Timestamp"], params["Nonce"], params["Signature"]
+	if keyID == "" || timestamp == "" || nonce == "" || signature == "" || len(nonce) > maxNonceLength {
+		return nil, s.reject("", "malformed", "Malformed request signature")
+	}
+
+	s.mu.RLock()
+	key, ok := s.keys[keyID]
+	s.mu.RUnlock()
+	if !ok {
+		// unknown ids aren't used as labels, anyone can make them up
+		return nil, s.reject("", "unknown_key", "Unknown signing key")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, s.reject(keyID, "malformed", "Malformed request signature")
+	}
+	signedAt := time.Unix(seconds, 0)
+	if signedAt.Before(now.Add(-s.window)) || signedAt.After(now.Add(s.window)) {
+		return nil, s.reject(keyID, "stale", "Request signature timestamp is outside the allowed window")
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxSignedBodySize+1))
+		if err != nil {
+			return nil, s.reject(keyID, "malformed", "Cannot read request body")
+		}
+		if len(body) > maxSignedBodySize {
+			return nil, s.reject(keyID, "too_large", "Signed request body is too large")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	mac := hmac.New(sha256.New, []byte(key.Secret))
+	mac.Write([]byte(StringToSign(timestamp, nonce, r.Method, r.URL.EscapedPath(), r.URL.RawQuery, body)))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return nil, s.reject(keyID, "bad_signature", "Invalid request signature")
+	}
+
+	// only remembered once the signature is good, so nobody else can burn nonces
+	if !s.useNonce(keyID+"\n"+nonce, signedAt.Add(s.window), now) {
+		return nil, s.reject(keyID, "replayed", "Request nonce has already been used")
+	}
+
+	vmmetrics.GetOrCreateCounter(fmt.Sprintf("signed_reqs_total{key=%q}", keyID)).Inc()
+	claims := jwt.MapClaims{"sub": "signed:" + keyID}
+	if scope := keyScope(key.Prefixes, key.Types); scope != nil {
+		claims["scope"] = scope
+	}
+	return claims, nil
+}
+
+/*
+useNonce records a nonce until it expires, returning false if it's
+already recorded. Requests with expired nonces fail the timestamp check
+anyway, so those are swept (at most once per window)
+*/
+func (s *SigningKeySet) useNonce(nonce string, expires time.Time, now time.Time) bool {
+	s.nonceMu.Lock()
+	defer s.nonceMu.Unlock()
+
+	if now.Sub(s.lastSweep) > s.window {
+		for n, e := range s.nonces {
+			if now.After(e) {
+				delete(s.nonces, n)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if _, ok := s.nonces[nonce]; ok {
+		return false
+	}
+	s.nonces[nonce] = expires
+	return true
+}
+
+func (s *SigningKeySet) reject(keyID string, reason string, msg string) error {
+	vmmetrics.GetOrCreateCounter(fmt.Sprintf("signed_reqs_rejected_total{key=%q,reason=%q}", keyID, reason)).Inc()
+	return &SignatureError{Reason: reason, msg: msg}
+}
+
+func (s *SigningKeySet) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.snapshot.Changed()
+}
+
+// parseSignatureParams splits `A=1, B=2` into a map
+func parseSignatureParams(header string) map[string]string {
+	params := map[string]string{}
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		}
+	}
+	return params
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func loadTestSigningKeys(t *testing.T) *SigningKeySet {
+	path := filepath.Join(t.TempDir(), "signing-keys.yaml")
+	content := `
+- id: billing-worker
+  secret: billing-secret
+  prefixes: ["billing."]
+- id: backfill
+  secret: backfill-secret
+`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	keys, err := LoadSigningKeySet(path, time.Minute)
+	require.NoError(t, err)
+	return keys
+}
+
+func signedRequest(t *testing.T, keyID string, secret string, signedAt time.Time, nonce string) *http.Request {
+	req := httptest.NewRequest("POST", "/batch?source=cron", strings.NewReader(`[{"metric":"billing.runs","metric_type":"c","value":1}]`))
+	require.NoError(t, SignRequest(req, keyID, secret, signedAt, nonce))
+	return req
+}
+
+func TestSigningKeySetVerify(t *testing.T) {
+	keys := loadTestSigningKeys(t)
+	now := time.Now()
+	rt := require.New(t)
+
+	req := signedRequest(t, "billing-worker", "billing-secret", now, "n1")
+	rt.True(IsSignedRequest(req))
+	claims, err := keys.Verify(req, now)
+	rt.NoError(err)
+	rt.Equal("signed:billing-worker", claims["sub"])
+	rt.NotNil(claims["scope"])
+	// handlers still get the body
+	body, _ := io.ReadAll(req.Body)
+	rt.Contains(string(body), "billing.runs")
+
+	reason := func(req *http.Request) string {
+		_, err := keys.Verify(req, now)
+		rt.Error(err)
+		return err.(*SignatureError).Reason
+	}
+
+	rt.Equal("replayed", reason(signedRequest(t, "billing-worker", "billing-secret", now, "n1")))
+	// the same nonce is fine for another key
+	_, err = keys.Verify(signedRequest(t, "backfill", "backfill-secret", now, "n1"), now)
+	rt.NoError(err)
+
+	rt.Equal("stale", reason(signedRequest(t, "billing-worker", "billing-secret", now.Add(-2*time.Minute), "n2")))
+	rt.Equal("stale", reason(signedRequest(t, "billing-worker", "billing-secret", now.Add(2*time.Minute), "n3")))
+	rt.Equal("bad_signature", reason(signedRequest(t, "billing-worker", "wrong-secret", now, "n4")))
+	rt.Equal("unknown_key", reason(signedRequest(t, "someone", "billing-secret", now, "n5")))
+
+	tampered := signedRequest(t, "billing-worker", "billing-secret", now, "n6")
+	tampered.Body = io.NopCloser(strings.NewReader(`[{"metric":"billing.runs","metric_type":"c","value":1000}]`))
+	rt.Equal("bad_signature", reason(tampered))
+
+	moved := signedRequest(t, "billing-worker", "billing-secret", now, "n7")
+	moved.URL.Path = "/count/billing.runs"
+	rt.Equal("bad_signature", reason(moved))
+
+	malformed := httptest.NewRequest("POST", "/batch", nil)
+	malformed.Header.Set("Authorization", SignatureScheme+" KeyId=billing-worker")
+	rt.Equal("malformed", reason(malformed))
+}
+
+func TestNonceSweep(t *testing.T) {
+	keys := loadTestSigningKeys(t)
+	now := time.Now()
+
+	require.True(t, keys.useNonce("a", now.Add(time.Minute), now))
+	require.False(t, keys.useNonce("a", now.Add(time.Minute), now))
+	later := now.Add(3 * time.Minute)
+	require.True(t, keys.useNonce("b", later.Add(time.Minute), later))
+	require.Len(t, keys.nonces, 1)
+}
+
+func TestValidateTokenAcceptsSignedRequests(t *testing.T) {
+	v := NewTokenValidator(VALID_TOKEN_SECTET, nil, nil, ClaimsPolicy{}, nil, nil, loadTestSigningKeys(t))
+	handler := ValidateToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}), v)
+	rt := require.New(t)
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(signedRequest(t, "backfill", "backfill-secret", time.Now(), "handler-1"))
+	rt.Equal(200, rr.Code)
+	rt.Contains(rr.Body.String(), "billing.runs")
+	rt.Equal(403, serve(signedRequest(t, "backfill", "backfill-secret", time.Now(), "handler-1")).Code)
+	rt.Equal(403, serve(signedRequest(t, "backfill", "wrong-secret", time.Now(), "handler-2")).Code)
+}
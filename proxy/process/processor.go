@@ -1,26 +1,33 @@
 package processor
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
 
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/cardinality"
 	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/defaulttags"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/metrictypes"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/relabel"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/sampling"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/schema"
 	"github.com/civic-eagle/statsd-http-proxy/proxy/statsdclient"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/tagformat"
 	log "github.com/sirupsen/logrus"
-	vmmetrics "github.com/VictoriaMetrics/metrics"
 )
 
 var (
 	allowedNames     = regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9_:]*$")
 	allowedFirstChar = regexp.MustCompile("^[a-zA-Z]")
 	replaceChars     = regexp.MustCompile("[^a-zA-Z0-9_:]")
-	allowedTagKeys   = regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9_]*$")
 
-	counters = vmmetrics.NewCounter("counters_added_total")
-	gauges = vmmetrics.NewCounter("gauges_added_total")
-	timings = vmmetrics.NewCounter("timing_added_total")
-	sets = vmmetrics.NewCounter("set_added_total")
+	counters    = vmmetrics.NewCounter("counters_added_total")
+	gauges      = vmmetrics.NewCounter("gauges_added_total")
+	timings     = vmmetrics.NewCounter("timing_added_total")
+	sets        = vmmetrics.NewCounter("set_added_total")
 	droppedTags = vmmetrics.NewCounter("metrics_tags_dropped_total")
 )
 
@@ -28,23 +35,43 @@ var (
 type Processor struct {
 	statsdClient statsdclient.StatsdClientInterface
 	metricPrefix string
-	promFilter bool
-	normalize bool
+	promFilter   bool
+	normalize    bool
+	cardinality  *cardinality.Guard
+	relabel      *relabel.Rules
+	schema       *schema.Registry
+	defaultTags  *defaulttags.Defaults
+	sampler      *sampling.Sampler
+	types        *metrictypes.Registry
+}
+
+// Options configures the processing steps. Anything left nil is skipped
+type Options struct {
+	MetricPrefix string
+	PromFilter   bool
+	Normalize    bool
+	Cardinality  *cardinality.Guard
+	Relabel      *relabel.Rules
+	Schema       *schema.Registry
+	DefaultTags  *defaulttags.Defaults
+	Sampler      *sampling.Sampler
+	Types        *metrictypes.Registry
 }
 
 // NewProcessor creates tool to process metrics as they are submitted async
-func NewProcessor(
-	statsdClient statsdclient.StatsdClientInterface,
-	metricPrefix string,
-	promFilter bool,
-	normalize bool,
-) *Processor {
+func NewProcessor(statsdClient statsdclient.StatsdClientInterface, opts Options) *Processor {
 	// build processor
 	processor := Processor{
 		statsdClient,
-		metricPrefix,
-		promFilter,
-		normalize,
+		opts.MetricPrefix,
+		opts.PromFilter,
+		opts.Normalize,
+		opts.Cardinality,
+		opts.Relabel,
+		opts.Schema,
+		opts.DefaultTags,
+		opts.Sampler,
+		opts.Types,
 	}
 
 	return &processor
@@ -53,7 +80,30 @@ func NewProcessor(
 func (Processor *Processor) Process() {
 	for msg := range config.ProcessChan {
 		m, err := Processor.processMetric(msg)
-		if err != nil {
+		var schemaErr *schema.ValidationError
+		var rateErr *sampling.RateError
+		if errors.As(err, &rateErr) {
+			log.WithFields(log.Fields{"metric": msg.Metric, "sampleRate": msg.SampleRate}).Debug("Dropped metric with a disallowed sample rate")
+			config.DroppedMetrics.Inc()
+			continue
+		} else if errors.As(err, &schemaErr) {
+			// counted by reason
+			log.WithFields(log.Fields{"metric": msg.Metric, "reason": schemaErr.Reason}).Debug("Dropped metric not matching the schema")
+			config.DroppedMetrics.Inc()
+			continue
+		} else if errors.Is(err, metrictypes.ErrConflict) {
+			log.WithFields(log.Fields{"metric": msg.Metric, "type": msg.MetricType}).Debug("Dropped metric with a conflicting type")
+			config.DroppedMetrics.Inc()
+			continue
+		} else if errors.Is(err, cardinality.ErrLimited) {
+			// there may be a lot of these, they're counted instead
+			log.WithFields(log.Fields{"metric": msg.Metric}).Debug("Dropped metric over cardinality limits")
+			config.DroppedMetrics.Inc()
+			continue
+		} else if errors.Is(err, relabel.ErrDropped) {
+			// filtered on purpose, and counted by rule
+			continue
+		} else if err != nil {
 			log.WithFields(log.Fields{"error": err}).Error("Failed to process metric")
 			continue
 		}
@@ -64,11 +114,11 @@ func (Processor *Processor) Process() {
 
 func (Processor *Processor) sendMetric(metricType string, key string, value int64, sampleRate float32) {
 	/*
-	Since we have two incoming handler paths for metrics
-	we need a common switch case to actually process each metric
-	once we've formatted it consistently
-	Simply actually increment the correct values in our internal
-	statsd client (and bump related internal metrics)
+		Since we have two incoming handler paths for metrics
+		we need a common switch case to actually process each metric
+		once we've formatted it consistently
+		Simply actually increment the correct values in our internal
+		statsd client (and bump related internal metrics)
 	*/
 	switch metricType {
 	case "count":
@@ -91,44 +141,80 @@ func (Processor *Processor) sendMetric(metricType string, key string, value int6
 
 func (Processor *Processor) processMetric(m config.MetricRequest) (config.MetricRequest, error) {
 	var err error
-	if Processor.metricPrefix != "" {
-		m.Metric = Processor.metricPrefix + m.Metric
-	}
 
 	// An empty sample rate === a full sample rate
 	if m.SampleRate == 0 {
 		m.SampleRate = 1
 	}
+	// anything else has to make sense to StatsD
+	m, err = Processor.sampler.CheckRate(m)
+	if err != nil {
+		return config.MetricRequest{}, err
+	}
+
+	// the schema declares what clients send, so it's checked before anything changes
+	if !m.Validated {
+		if err = Processor.schema.Validate(m); err != nil {
+			return config.MetricRequest{}, err
+		}
+	}
+
+	// ours, rather than the client's, so not part of the schema
+	m.Tags = Processor.defaultTags.Apply(m.Tags)
 
 	if Processor.normalize {
 		m.Metric = strings.ToLower(m.Metric)
 		m.Tags = strings.ToLower(m.Tags)
 	}
 
+	// rules match what clients send (normalized), without our prefix
+	m, err = Processor.relabel.Apply(m)
+	if err != nil {
+		return config.MetricRequest{}, err
+	}
+	// the same goes for sampling, and the statsd client drops at the lowered rate
+	m = Processor.sampler.Apply(m)
+
+	if Processor.metricPrefix != "" {
+		m.Metric = Processor.metricPrefix + m.Metric
+	}
+
 	if Processor.promFilter {
 		m, err = filterPromMetric(m)
 		if err != nil {
 			return config.MetricRequest{}, err
 		}
 	}
+	// limits apply to what we'd send, so after normalizing
+	m.Tags, err = Processor.cardinality.Apply(m.Metric, m.Tags)
+	if err != nil {
+		return config.MetricRequest{}, err
+	}
+	var tags string
 	if m.Tags != "" {
-		m.Metric += processTags(m.Tags)
+		tags = processTags(m.Tags)
+	}
+	// statsd keys are the name and tags, and mixing types under one is garbage
+	m.Metric, err = Processor.types.Apply(m.Metric, tags, m.MetricType)
+	if err != nil {
+		return config.MetricRequest{}, err
 	}
+	m.Metric += tags
 
 	return m, nil
 }
 
 func processTags(tagsList string) string {
 	/*
-	Process tags for a metric.
-	Starting with a string of comma-separated key=value pairs,
-	we need to ensure that:
-	1. each pair contains two items, one on each side of a '='
-	2. that both the key and the value strings have actual content ('=value' and 'key=' are not allowed)
+		Process tags for a metric.
+		Starting with a string of comma-separated key=value pairs,
+		we need to ensure that:
+		1. each pair contains two items, one on each side of a '='
+		2. that both the key and the value strings have actual content ('=value' and 'key=' are not allowed)
 
-	Then return the resulting pairs to a string
+		Then return the resulting pairs to a string
 
-	Any failures means the metric gets no tags
+		Any failures means the metric gets no tags
 	*/
 	list := strings.Split(strings.TrimSpace(tagsList), ",")
 	if len(list) == 0 {
@@ -158,8 +244,8 @@ func processTags(tagsList string) string {
 
 func filterPromMetric(m config.MetricRequest) (config.MetricRequest, error) {
 	/*
-	Remove/Replace any characters that don't meet the Prometheus
-	data model requirements: https://prometheus.io/docs/concepts/data_model/
+		Remove/Replace any characters that don't meet the Prometheus
+		data model requirements: https://prometheus.io/docs/concepts/data_model/
 	*/
 	metric := config.MetricRequest{
 		Metric: "", Value: m.Value, Tags: "", SampleRate: m.SampleRate,
@@ -185,7 +271,7 @@ func filterPromMetric(m config.MetricRequest) (config.MetricRequest, error) {
 					log.WithFields(log.Fields{"Tags": list, "pair": tagPair}).Debug("Invalid tag set")
 					continue
 				}
-				if !allowedTagKeys.MatchString(tagPair[0]) {
+				if !tagformat.ValidKey(tagPair[0]) {
 					tagKey := replaceChars.ReplaceAllString(tagPair[0], "_")
 					finalTags += fmt.Sprintf("%s=%s,", tagKey, tagPair[1])
 				} else {
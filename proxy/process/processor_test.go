@@ -0,0 +1,41 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/middleware"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/schema"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedTagsSurviveNormalize(t *testing.T) {
+	processor := NewProcessor(nil, Options{Normalize: true})
+	trusted := middleware.Tags{{"tenant", "acme"}}
+	rt := require.New(t)
+
+	// a client can't get a second tenant tag by changing its case
+	m, err := processor.processMetric(config.MetricRequest{
+		Metric:     "Web.Clicks",
+		Value:      1,
+		Tags:       trusted.Apply("TENANT=evil,Page=Home"),
+		MetricType: "count",
+	})
+	rt.NoError(err)
+	rt.Equal("web.clicks,page=home,tenant=acme", m.Metric)
+}
+
+func TestValidatedMetricsArentCheckedAgain(t *testing.T) {
+	registry, err := schema.New(schema.File{Metrics: []schema.Metric{{Name: "web.paid", Type: "count"}}}, schema.Enforce, "")
+	require.NoError(t, err)
+	processor := NewProcessor(nil, Options{Schema: registry})
+	rt := require.New(t)
+
+	_, err = processor.processMetric(config.MetricRequest{Metric: "web.unknown", Value: 1, MetricType: "count"})
+	rt.Error(err)
+
+	// the router already checked it, so the result stands
+	m, err := processor.processMetric(config.MetricRequest{Metric: "web.unknown", Value: 1, MetricType: "count", Validated: true})
+	rt.NoError(err)
+	rt.Equal("web.unknown", m.Metric)
+}
@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a simple token bucket. Tokens refill continuously at `rate`
+// per second up to `burst`, and each call to Allow consumes `n` tokens.
+type Bucket struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	lastFill time.Time
+}
+
+// NewBucket creates a full token bucket
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{
+		rate:     rate,
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		lastFill: time.Now(),
+	}
+}
+
+// Allow reports whether n tokens are available, consuming them if so
+func (b *Bucket) Allow(n int) bool {
+	ok, _ := b.Reserve(n)
+	return ok
+}
+
+// Reserve consumes n tokens if they are available. When they aren't,
+// it returns how long the caller should wait before trying again.
+func (b *Bucket) Reserve(n int) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.refill(now)
+
+	/*
+		A request bigger than the burst could never succeed, so we let
+		it through when the bucket is full and leave the bucket in debt
+	*/
+	need := float64(n)
+	threshold := need
+	if threshold > b.burst {
+		threshold = b.burst
+	}
+	if b.tokens >= threshold {
+		b.tokens -= need
+		return true, 0
+	}
+	if b.rate <= 0 {
+		return false, time.Duration(1<<63 - 1)
+	}
+	wait := time.Duration((threshold - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
+
+// Return gives back n tokens taken by Reserve for something that didn't happen after all
+func (b *Bucket) Return(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens += float64(n)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// LastUsed returns the last time the bucket was touched
+func (b *Bucket) LastUsed() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lastFill
+}
+
+func (b *Bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.lastFill).Seconds()
+	b.lastFill = now
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
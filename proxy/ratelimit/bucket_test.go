@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketAllowsBurst(t *testing.T) {
+	b := NewBucket(1, 5)
+	rt := require.New(t)
+
+	rt.True(b.Allow(3))
+	rt.True(b.Allow(2))
+	rt.False(b.Allow(1))
+}
+
+func TestBucketReserveReturnsWait(t *testing.T) {
+	b := NewBucket(10, 10)
+	rt := require.New(t)
+
+	rt.True(b.Allow(10))
+	ok, wait := b.Reserve(5)
+	rt.False(ok)
+	rt.InDelta(0.5, wait.Seconds(), 0.05)
+}
+
+func TestBucketOversizedRequest(t *testing.T) {
+	b := NewBucket(1, 2)
+	rt := require.New(t)
+
+	rt.True(b.Allow(10))
+	ok, wait := b.Reserve(1)
+	rt.False(ok)
+	rt.InDelta(9.0, wait.Seconds(), 0.05)
+}
+
+func TestBucketReturn(t *testing.T) {
+	b := NewBucket(0.001, 2)
+
+	require.True(t, b.Allow(2))
+	require.False(t, b.Allow(1))
+	b.Return(1)
+	require.True(t, b.Allow(1))
+	// never past the burst
+	b.Return(5)
+	require.True(t, b.Allow(2))
+	require.False(t, b.Allow(1))
+}
@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter keeps a token bucket per key (a client, a token subject...),
+// forgetting buckets that haven't been used for a while to bound memory.
+type Limiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     int
+	idle      time.Duration
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+// NewLimiter creates a limiter whose buckets are dropped after idle,
+// which should be long enough for an empty bucket to refill
+func NewLimiter(rate float64, burst int, idle time.Duration) *Limiter {
+	return &Limiter{
+		rate:      rate,
+		burst:     burst,
+		idle:      idle,
+		buckets:   map[string]*Bucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Reserve consumes n tokens from key's bucket, see Bucket.Reserve
+func (l *Limiter) Reserve(key string, n int) (bool, time.Duration) {
+	return l.bucket(key).Reserve(n)
+}
+
+// Len returns the number of buckets being tracked
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+func (l *Limiter) bucket(key string) *Bucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// sweeping at most once per idle period keeps this cheap
+	now := time.Now()
+	if now.Sub(l.lastSweep) > l.idle {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = NewBucket(l.rate, l.burst)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// an idle bucket has refilled, so forgetting it changes nothing
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.LastUsed()) > l.idle {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
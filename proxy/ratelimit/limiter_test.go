@@ -0,0 +1,34 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterKeysBucketsSeparately(t *testing.T) {
+	l := NewLimiter(1, 2, time.Minute)
+	rt := require.New(t)
+
+	ok, _ := l.Reserve("a", 2)
+	rt.True(ok)
+	ok, wait := l.Reserve("a", 1)
+	rt.False(ok)
+	rt.InDelta(1.0, wait.Seconds(), 0.05)
+	ok, _ = l.Reserve("b", 1)
+	rt.True(ok)
+	rt.Equal(2, l.Len())
+}
+
+func TestLimiterEvictsIdleBuckets(t *testing.T) {
+	l := NewLimiter(1, 1, 10*time.Millisecond)
+	rt := require.New(t)
+
+	l.Reserve("a", 1)
+	l.Reserve("b", 1)
+	time.Sleep(20 * time.Millisecond)
+	l.Reserve("c", 1)
+
+	rt.Equal(1, l.Len())
+}
@@ -0,0 +1,279 @@
+package relabel
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"gopkg.in/yaml.v3"
+)
+
+// pseudo-labels for the parts of a metric that aren't tags
+const (
+	NameLabel = "__name__"
+	TypeLabel = "__type__"
+)
+
+// ErrDropped is returned for metrics a keep or drop rule filtered out
+var ErrDropped = errors.New("Dropped by relabeling")
+
+// Rule is a single entry of the rules file, as in Prometheus' relabel_config
+type Rule struct {
+	// for the hit counter (the rule's position, if empty)
+	Name         string   `yaml:"name"`
+	SourceLabels []string `yaml:"source_labels"`
+	// joins the source label values (default ;)
+	Separator *string `yaml:"separator"`
+	// matched against the whole joined value (default (.*))
+	Regex       *string `yaml:"regex"`
+	TargetLabel string  `yaml:"target_label"`
+	// $1-style expansion of the regex (default $1)
+	Replacement *string `yaml:"replacement"`
+	Modulus     uint64  `yaml:"modulus"`
+	// replace (the default), keep, drop, labelmap, labeldrop or hashmod
+	Action string `yaml:"action"`
+}
+
+type rule struct {
+	name         string
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	modulus      uint64
+	action       string
+	hits         *vmmetrics.Counter
+}
+
+// Rules rewrite metrics in order, before they're sent
+type Rules struct {
+	rules []*rule
+}
+
+/*
+Load reads rules from a YAML file:
+
+  - source_labels: [__name__]
+    regex: "checkout\\.(.*)"
+    target_label: service
+    replacement: checkout
+  - action: labeldrop
+    regex: "session_id|request_id"
+
+An empty path means no rules
+*/
+func Load(path string) (*Rules, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []Rule
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	return New(list)
+}
+
+// New validates rules, filling in Prometheus' defaults
+func New(list []Rule) (*Rules, error) {
+	rules := &Rules{}
+	for i, r := range list {
+		compiled := &rule{
+			name:         r.Name,
+			sourceLabels: r.SourceLabels,
+			separator:    ";",
+			targetLabel:  r.TargetLabel,
+			replacement:  "$1",
+			modulus:      r.Modulus,
+			action:       r.Action,
+		}
+		if compiled.name == "" {
+			compiled.name = strconv.Itoa(i)
+		}
+		if r.Separator != nil {
+			compiled.separator = *r.Separator
+		}
+		if r.Replacement != nil {
+			compiled.replacement = *r.Replacement
+		}
+		expr := "(.*)"
+		if r.Regex != nil {
+			expr = *r.Regex
+		}
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("Relabel rule %s: invalid regex: %v", compiled.name, err)
+		}
+		compiled.regex = re
+
+		switch compiled.action {
+		case "":
+			compiled.action = "replace"
+			fallthrough
+		case "replace":
+			if compiled.targetLabel == "" {
+				return nil, fmt.Errorf("Relabel rule %s: replace needs a target_label", compiled.name)
+			}
+		case "hashmod":
+			if compiled.targetLabel == "" || compiled.modulus == 0 {
+				return nil, fmt.Errorf("Relabel rule %s: hashmod needs a target_label and a modulus", compiled.name)
+			}
+		case "keep", "drop":
+			if len(compiled.sourceLabels) == 0 {
+				return nil, fmt.Errorf("Relabel rule %s: %s needs source_labels", compiled.name, compiled.action)
+			}
+		case "labelmap", "labeldrop":
+		default:
+			return nil, fmt.Errorf("Relabel rule %s: unknown action %q", compiled.name, compiled.action)
+		}
+		compiled.hits = vmmetrics.GetOrCreateCounter(fmt.Sprintf("relabel_rule_hits_total{rule=%q}", compiled.name))
+		rules.rules = append(rules.rules, compiled)
+	}
+	return rules, nil
+}
+
+// labels are a metric's tags plus its pseudo-labels, in order
+type labels [][2]string
+
+func (l labels) get(name string) string {
+	for _, label := range l {
+		if label[0] == name {
+			return label[1]
+		}
+	}
+	return ""
+}
+
+// set replaces a label (in place), adds it, or deletes it if value is empty
+func (l labels) set(name string, value string) labels {
+	for i, label := range l {
+		if label[0] == name {
+			if value == "" {
+				return append(l[:i], l[i+1:]...)
+			}
+			l[i][1] = value
+			return l
+		}
+	}
+	if value == "" {
+		return l
+	}
+	return append(l, [2]string{name, value})
+}
+
+/*
+Apply runs the rules over a metric in order, rewriting its name, type
+and tags. ErrDropped means a keep or drop rule filtered it out.
+Rules can't remove a metric's name or type, only change them
+*/
+func (r *Rules) Apply(m config.MetricRequest) (config.MetricRequest, error) {
+	if r == nil || len(r.rules) == 0 {
+		return m, nil
+	}
+
+	l := labels{{NameLabel, m.Metric}, {TypeLabel, m.MetricType}}
+	for _, pair := range strings.Split(m.Tags, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 && kv[0] != "" {
+			l = append(l, [2]string{kv[0], kv[1]})
+		}
+	}
+
+	for _, rule := range r.rules {
+		var dropped bool
+		l, dropped = rule.apply(l)
+		if dropped {
+			return m, ErrDropped
+		}
+	}
+
+	if name := l.get(NameLabel); name != "" {
+		m.Metric = name
+	}
+	if metricType := l.get(TypeLabel); metricType != "" {
+		m.MetricType = metricType
+	}
+	var tags []string
+	for _, label := range l {
+		if label[0] != NameLabel && label[0] != TypeLabel {
+			tags = append(tags, label[0]+"="+label[1])
+		}
+	}
+	m.Tags = strings.Join(tags, ",")
+	return m, nil
+}
+
+// apply runs a single rule, counting a hit whenever it matches
+func (r *rule) apply(l labels) (labels, bool) {
+	values := make([]string, len(r.sourceLabels))
+	for i, name := range r.sourceLabels {
+		values[i] = l.get(name)
+	}
+	value := strings.Join(values, r.separator)
+
+	switch r.action {
+	case "replace":
+		match := r.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return l, false
+		}
+		r.hits.Inc()
+		target := string(r.regex.ExpandString(nil, r.targetLabel, value, match))
+		replacement := string(r.regex.ExpandString(nil, r.replacement, value, match))
+		return l.set(target, replacement), false
+	case "keep":
+		if !r.regex.MatchString(value) {
+			r.hits.Inc()
+			return l, true
+		}
+	case "drop":
+		if r.regex.MatchString(value) {
+			r.hits.Inc()
+			return l, true
+		}
+	case "hashmod":
+		r.hits.Inc()
+		sum := md5.Sum([]byte(value))
+		return l.set(r.targetLabel, strconv.FormatUint(binary.BigEndian.Uint64(sum[8:])%r.modulus, 10)), false
+	case "labelmap":
+		var mapped labels
+		for _, label := range l {
+			if match := r.regex.FindStringSubmatchIndex(label[0]); match != nil && !isPseudo(label[0]) {
+				mapped = append(mapped, [2]string{string(r.regex.ExpandString(nil, r.replacement, label[0], match)), label[1]})
+			}
+		}
+		if len(mapped) > 0 {
+			r.hits.Inc()
+		}
+		for _, label := range mapped {
+			l = l.set(label[0], label[1])
+		}
+	case "labeldrop":
+		kept := labels{}
+		for _, label := range l {
+			if isPseudo(label[0]) || !r.regex.MatchString(label[0]) {
+				kept = append(kept, label)
+			}
+		}
+		if len(kept) < len(l) {
+			r.hits.Inc()
+		}
+		return kept, false
+	}
+	return l, false
+}
+
+func isPseudo(name string) bool {
+	return name == NameLabel || name == TypeLabel
+}
@@ -0,0 +1,126 @@
+package relabel
+
+import (
+	"testing"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func parseRules(t *testing.T, content string) *Rules {
+	var list []Rule
+	require.NoError(t, yaml.Unmarshal([]byte(content), &list))
+	rules, err := New(list)
+	require.NoError(t, err)
+	return rules
+}
+
+func metric(name string, tags string) config.MetricRequest {
+	return config.MetricRequest{Metric: name, MetricType: "count", Tags: tags, Value: 1}
+}
+
+func TestReplace(t *testing.T) {
+	rules := parseRules(t, `
+- source_labels: [__name__]
+  regex: "checkout\\.(.*)"
+  target_label: __name__
+  replacement: "shop.checkout_$1"
+- source_labels: [__name__, env]
+  regex: "shop\\..*;prod"
+  target_label: tier
+  replacement: critical
+- source_labels: [host]
+  regex: "(.*)\\.internal"
+  target_label: host
+`)
+	rt := require.New(t)
+
+	m, err := rules.Apply(metric("checkout.paid", "env=prod,host=web1.internal"))
+	rt.NoError(err)
+	rt.Equal("shop.checkout_paid", m.Metric)
+	rt.Equal("env=prod,host=web1,tier=critical", m.Tags)
+	rt.Equal("count", m.MetricType)
+
+	m, err = rules.Apply(metric("search.hits", "env=dev"))
+	rt.NoError(err)
+	rt.Equal("search.hits", m.Metric)
+	rt.Equal("env=dev", m.Tags)
+}
+
+func TestReplaceWithEmptyValueDeletesTag(t *testing.T) {
+	rules := parseRules(t, `
+- source_labels: [__type__]
+  regex: gauge
+  target_label: debug
+  replacement: ""
+`)
+	m, err := rules.Apply(config.MetricRequest{Metric: "queue", MetricType: "gauge", Tags: "debug=1,env=prod"})
+	require.NoError(t, err)
+	require.Equal(t, "env=prod", m.Tags)
+}
+
+func TestKeepAndDrop(t *testing.T) {
+	rules := parseRules(t, `
+- action: keep
+  source_labels: [__name__]
+  regex: "app\\..*"
+- action: drop
+  source_labels: [env]
+  regex: test
+`)
+	rt := require.New(t)
+
+	_, err := rules.Apply(metric("app.logins", "env=prod"))
+	rt.NoError(err)
+	_, err = rules.Apply(metric("other.logins", "env=prod"))
+	rt.ErrorIs(err, ErrDropped)
+	_, err = rules.Apply(metric("app.logins", "env=test"))
+	rt.ErrorIs(err, ErrDropped)
+}
+
+func TestLabelmapAndLabeldrop(t *testing.T) {
+	rules := parseRules(t, `
+- action: labelmap
+  regex: "k8s_(.*)"
+- action: labeldrop
+  regex: "k8s_.*|session_id"
+`)
+	m, err := rules.Apply(metric("requests", "k8s_pod=web-1,session_id=abc,env=prod"))
+	require.NoError(t, err)
+	require.Equal(t, "env=prod,pod=web-1", m.Tags)
+	require.Equal(t, "requests", m.Metric)
+}
+
+func TestHashmod(t *testing.T) {
+	rules := parseRules(t, `
+- action: hashmod
+  source_labels: [user]
+  target_label: shard
+  modulus: 4
+`)
+	first, err := rules.Apply(metric("logins", "user=42"))
+	require.NoError(t, err)
+	again, _ := rules.Apply(metric("logins", "user=42"))
+	require.Equal(t, first.Tags, again.Tags)
+	require.Regexp(t, `^user=42,shard=[0-3]$`, first.Tags)
+}
+
+func TestNewValidation(t *testing.T) {
+	bad := "("
+	for _, r := range []Rule{
+		{SourceLabels: []string{"a"}},
+		{Action: "keep"},
+		{Action: "hashmod", TargetLabel: "shard"},
+		{Action: "explode"},
+		{Action: "labeldrop", Regex: &bad},
+	} {
+		_, err := New([]Rule{r})
+		require.Error(t, err, r)
+	}
+
+	var none *Rules
+	m, err := none.Apply(metric("a", "b=c"))
+	require.NoError(t, err)
+	require.Equal(t, metric("a", "b=c"), m)
+}
@@ -0,0 +1,136 @@
+package reports
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/tagformat"
+)
+
+const (
+	// Reporting API (https://w3c.github.io/reporting/)
+	ReportsContentType = "application/reports+json"
+	// legacy CSP report-uri
+	CSPReportContentType = "application/csp-report"
+
+	reportMetricName = "browser_reports"
+)
+
+// Report is a single Reporting API report, in the form we count it
+type Report struct {
+	Type string
+	Body map[string]interface{}
+	// the report exactly as the browser sent it
+	Raw json.RawMessage
+}
+
+/*
+Parse decodes a reports document.
+
+application/reports+json is a list of {type, age, url, user_agent, body}
+objects, while application/csp-report is a single {"csp-report": {...}}
+object using the older hyphenated field names
+*/
+func Parse(contentType string, body []byte) ([]Report, error) {
+	switch contentType {
+	case ReportsContentType:
+		var raw []json.RawMessage
+		if err := json.Unmarshal(body, &raw); err != nil {
+			return nil, err
+		}
+		reports := make([]Report, 0, len(raw))
+		for _, r := range raw {
+			var report struct {
+				Type string                 `json:"type"`
+				Body map[string]interface{} `json:"body"`
+			}
+			if err := json.Unmarshal(r, &report); err != nil {
+				return nil, err
+			}
+			reports = append(reports, Report{Type: report.Type, Body: report.Body, Raw: r})
+		}
+		return reports, nil
+	case CSPReportContentType:
+		var report struct {
+			CSPReport map[string]interface{} `json:"csp-report"`
+		}
+		if err := json.Unmarshal(body, &report); err != nil {
+			return nil, err
+		}
+		if report.CSPReport == nil {
+			return nil, fmt.Errorf("Missing csp-report object")
+		}
+		return []Report{{Type: "csp-violation", Body: report.CSPReport, Raw: body}}, nil
+	}
+	return nil, fmt.Errorf("Unsupported content type %v", contentType)
+}
+
+// ToMetric counts the report, tagged with whatever is useful for its type
+func (r Report) ToMetric() config.MetricRequest {
+	tags := []string{"type=" + tagValue(r.Type)}
+	switch r.Type {
+	case "csp-violation":
+		directive := r.field("effectiveDirective", "effective-directive")
+		if directive == "" {
+			// violated-directive may include the policy's source list
+			directive = strings.SplitN(r.field("violated-directive"), " ", 2)[0]
+		}
+		tags = append(tags,
+			"directive="+tagValue(directive),
+			"blocked_host="+tagValue(blockedHost(r.field("blockedURL", "blocked-uri"))),
+			"disposition="+tagValue(r.field("disposition")),
+		)
+	case "deprecation", "intervention":
+		tags = append(tags, "id="+tagValue(r.field("id")))
+	case "network-error":
+		tags = append(tags,
+			"error_type="+tagValue(r.field("type")),
+			"phase="+tagValue(r.field("phase")),
+		)
+	}
+
+	return config.MetricRequest{
+		Metric:     reportMetricName,
+		Value:      1,
+		Tags:       strings.Join(tags, ","),
+		MetricType: "count",
+	}
+}
+
+// field returns the first of the named body fields that's a non-empty string
+func (r Report) field(names ...string) string {
+	for _, name := range names {
+		if v, ok := r.Body[name].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+/*
+blockedHost reduces a blocked URI to something low-cardinality:
+the host for real URLs, otherwise the keyword/scheme
+("inline", "eval", "data", "blob", ...)
+*/
+func blockedHost(blocked string) string {
+	if u, err := url.Parse(blocked); err == nil {
+		if u.Host != "" {
+			return strings.ToLower(u.Hostname())
+		}
+		if u.Scheme != "" {
+			return strings.ToLower(u.Scheme)
+		}
+	}
+	return strings.ToLower(blocked)
+}
+
+func tagValue(v string) string {
+	v = tagformat.Escape(strings.TrimSpace(v))
+	if v == "" {
+		return "none"
+	}
+	return v
+}
@@ -0,0 +1,65 @@
+package reports
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const reportsBody = `[
+  {"type": "csp-violation", "age": 10, "url": "https://example.com/", "body": {
+    "documentURL": "https://example.com/", "blockedURL": "https://evil.example.net/x.js",
+    "effectiveDirective": "script-src-elem", "disposition": "enforce"}},
+  {"type": "deprecation", "body": {"id": "websql", "message": "WebSQL is deprecated"}},
+  {"type": "network-error", "body": {"type": "tcp.timed_out", "phase": "connection"}}
+]`
+
+func TestParseReportsJSON(t *testing.T) {
+	rt := require.New(t)
+
+	reports, err := Parse(ReportsContentType, []byte(reportsBody))
+	rt.NoError(err)
+	rt.Len(reports, 3)
+
+	rt.Equal("type=csp-violation,directive=script-src-elem,blocked_host=evil.example.net,disposition=enforce", reports[0].ToMetric().Tags)
+	rt.Equal("type=deprecation,id=websql", reports[1].ToMetric().Tags)
+	rt.Equal("type=network-error,error_type=tcp.timed_out,phase=connection", reports[2].ToMetric().Tags)
+	rt.Equal("count", reports[0].ToMetric().MetricType)
+}
+
+func TestParseLegacyCSPReport(t *testing.T) {
+	rt := require.New(t)
+
+	reports, err := Parse(CSPReportContentType, []byte(`{"csp-report": {
+		"document-uri": "https://example.com/", "blocked-uri": "inline",
+		"violated-directive": "style-src 'self'", "disposition": "report"}}`))
+	rt.NoError(err)
+	rt.Len(reports, 1)
+	rt.Equal("type=csp-violation,directive=style-src,blocked_host=inline,disposition=report", reports[0].ToMetric().Tags)
+
+	_, err = Parse(CSPReportContentType, []byte(`{}`))
+	rt.Error(err)
+	_, err = Parse("application/json", []byte(`{}`))
+	rt.Error(err)
+}
+
+func TestWriterAppendsJSONL(t *testing.T) {
+	rt := require.New(t)
+	path := filepath.Join(t.TempDir(), "reports.jsonl")
+
+	w, err := NewWriter(path)
+	rt.NoError(err)
+	reports, err := Parse(ReportsContentType, []byte(reportsBody))
+	rt.NoError(err)
+	rt.NoError(w.Write(reports))
+	rt.NoError(w.Close())
+
+	content, err := os.ReadFile(path)
+	rt.NoError(err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	rt.Len(lines, 3)
+	rt.True(strings.HasPrefix(lines[0], `{"type":"csp-violation"`))
+}
@@ -0,0 +1,49 @@
+package reports
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// Writer appends raw reports to a JSONL file for later forensic review
+type Writer struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewWriter opens (or creates) the file reports are appended to
+func NewWriter(path string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{file: f}, nil
+}
+
+// Write appends each report as a single line
+func (w *Writer) Write(reports []Report) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, r := range reports {
+		// a JSONL line can't contain newlines, so re-encode compactly
+		var line bytes.Buffer
+		if err := json.Compact(&line, r.Raw); err != nil {
+			return err
+		}
+		line.WriteByte('\n')
+		if _, err := w.file.Write(line.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying file
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
@@ -0,0 +1,78 @@
+package router
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/graphite"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/middleware"
+)
+
+// media type for pickle payloads (without the TCP length framing)
+const graphitePickleContentType = "application/python-pickle"
+
+/*
+newGraphiteHandler accepts Graphite plaintext or pickle payloads over
+HTTP. The payload is rejected whole if any sample maps to a metric
+with a name we can't forward, or outside the token's scope
+*/
+func newGraphiteHandler(mapper *graphite.Mapper) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := procBodyOf(r, "text/plain", graphitePickleContentType)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		var samples []graphite.Sample
+		if contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); contentType == graphitePickleContentType {
+			samples, err = graphite.ParsePickle(body)
+			if err != nil {
+				graphite.Invalid([]error{err})
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		} else {
+			var errs []error
+			samples, errs = graphite.ParsePlaintext(body)
+			// bad lines are skipped (and counted), like carbon does
+			graphite.Invalid(errs)
+		}
+
+		scope, err := middleware.ScopeFromContext(r.Context())
+		if err != nil {
+			rejectMetric(w, err)
+			return
+		}
+		metrics := mapper.ToMetrics(samples)
+		for _, m := range metrics {
+			if err := checkName(m); err != nil {
+				config.DroppedMetrics.Add(len(metrics) - 1)
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		var scopeErr error
+		outOfScope := 0
+		for _, m := range metrics {
+			if err := checkScope(scope, m); err != nil {
+				outOfScope++
+				if scopeErr == nil {
+					scopeErr = err
+				}
+			}
+		}
+		if scopeErr != nil {
+			// the out of scope ones were counted already
+			config.DroppedMetrics.Add(len(metrics) - outOfScope)
+			http.Error(w, scopeErr.Error(), http.StatusForbidden)
+			return
+		}
+
+		if !reserveMetrics(w, r, len(metrics)) {
+			return
+		}
+		enqueueBatch(scope, middleware.TagsFromContext(r.Context()), nil, metrics)
+	})
+}
@@ -0,0 +1,85 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/graphite"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/middleware"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+// drain empties the processing queue, returning what was in it
+func drain() []config.MetricRequest {
+	var metrics []config.MetricRequest
+	for {
+		select {
+		case m := <-config.ProcessChan:
+			metrics = append(metrics, m)
+		default:
+			return metrics
+		}
+	}
+}
+
+func postGraphite(handler http.Handler, claims jwt.MapClaims, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/graphite", strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/plain")
+	if claims != nil {
+		req = req.WithContext(middleware.ContextWithClaims(context.Background(), claims))
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestGraphiteHandlerScope(t *testing.T) {
+	mapper, err := graphite.NewMapper([]graphite.Rule{{Match: "web.checkout.*", Type: "count"}, {Match: "backend.*", Type: "count"}})
+	require.NoError(t, err)
+	handler := newGraphiteHandler(mapper)
+	claims := jwt.MapClaims{"scope": map[string]interface{}{
+		"metrics": []interface{}{"web.checkout.*"},
+		"types":   []interface{}{"count"},
+	}}
+	rt := require.New(t)
+	drain()
+
+	w := postGraphite(handler, claims, "web.checkout.paid 1 1700000000\n")
+	rt.Equal(http.StatusOK, w.Code)
+	metrics := drain()
+	rt.Len(metrics, 1)
+	rt.Equal("web.checkout.paid", metrics[0].Metric)
+	rt.Equal("count", metrics[0].MetricType)
+
+	// a name outside the scope rejects the whole payload
+	w = postGraphite(handler, claims, "web.checkout.paid 1 1700000000\nbackend.queue 5 1700000000\n")
+	rt.Equal(http.StatusForbidden, w.Code)
+	rt.Contains(w.Body.String(), "backend.queue")
+	rt.Empty(drain())
+
+	// as does a type outside it (unmatched paths are gauges)
+	w = postGraphite(handler, claims, "web.checkout.step.one 1 1700000000\n")
+	rt.Equal(http.StatusForbidden, w.Code)
+	rt.Empty(drain())
+
+	// tokens without a scope may write anything
+	w = postGraphite(handler, nil, "backend.queue 5 1700000000\n")
+	rt.Equal(http.StatusOK, w.Code)
+	rt.Len(drain(), 1)
+}
+
+func TestGraphiteHandlerRejectsForgedTags(t *testing.T) {
+	mapper, err := graphite.NewMapper(nil)
+	require.NoError(t, err)
+	rt := require.New(t)
+	drain()
+
+	w := postGraphite(newGraphiteHandler(mapper), nil, "web.ok 1 1700000000\nweb.paid,tenant=victim 1 1700000000\n")
+	rt.Equal(http.StatusBadRequest, w.Code)
+	rt.Empty(drain())
+}
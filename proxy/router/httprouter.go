@@ -3,26 +3,63 @@ package router
 import (
 	"fmt"
 	"net/http"
+	"time"
 
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/dedup"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/graphite"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/issuer"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/metrictypes"
 	"github.com/civic-eagle/statsd-http-proxy/proxy/middleware"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/reports"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/rum"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/schema"
 	"github.com/julienschmidt/httprouter"
-	log "github.com/sirupsen/logrus"
-	vmmetrics "github.com/VictoriaMetrics/metrics"
 )
 
+// Options configures the HTTP routes. Anything left nil is off
+type Options struct {
+	TokenValidator *middleware.TokenValidator
+	// metrics per second accepted on one websocket (unlimited, if 0)
+	WSRateLimit int
+	// how long a websocket may stay silent (forever, if 0)
+	WSIdleTimeout     time.Duration
+	RUMRouteTemplates []string
+	ReportsWriter     *reports.Writer
+	GraphiteMapper    *graphite.Mapper
+	Enricher          *middleware.Enricher
+	Revocations       *middleware.RevocationList
+	TokenIssuer       *issuer.Issuer
+	CORSPolicy        *middleware.CORSPolicy
+	ClientLimiter     *middleware.ClientLimiter
+	Schema            *schema.Registry
+	// idempotency keys of recent batches
+	Batches      *dedup.Cache
+	TypeRegistry *metrictypes.Registry
+}
+
 // NewHTTPRouter creates julienschmidt's HTTP router
-func NewHTTPRouter(
-	tokenSecret string,
-) http.Handler {
+func NewHTTPRouter(opts Options) http.Handler {
+	tokenValidator := opts.TokenValidator
+	enricher := opts.Enricher
+	clientLimiter := opts.ClientLimiter
+	corsPolicy := opts.CORSPolicy
+	schemaRegistry := opts.Schema
+
 	// build router
 	router := httprouter.New()
 
+	// every browser-facing route shares one origin policy
+	cors := func(next http.Handler) http.Handler {
+		return middleware.ValidateOrigin(next, corsPolicy)
+	}
+
 	// register http request handlers
 	router.Handler(
 		http.MethodGet,
 		"/heartbeat",
 		middleware.Instrument(
-			middleware.ValidateCORS(
+			cors(
 				http.HandlerFunc(
 					func(w http.ResponseWriter, r *http.Request) {
 						fmt.Fprint(w, "OK")
@@ -36,7 +73,7 @@ func NewHTTPRouter(
 		http.MethodGet,
 		"/metrics",
 		middleware.Instrument(
-			middleware.ValidateCORS(
+			cors(
 				http.HandlerFunc(
 					func(w http.ResponseWriter, r *http.Request) {
 						vmmetrics.WritePrometheus(w, true)
@@ -50,61 +87,158 @@ func NewHTTPRouter(
 		http.MethodPost,
 		"/batch",
 		middleware.Instrument(
-			middleware.ValidateCORS(
-				middleware.ValidateJWT(
-					http.HandlerFunc(
-						func(w http.ResponseWriter, r *http.Request) {
-							// get variables from path
-							body, err := procBody(r)
-							if err != nil {
-								http.Error(w, err.Error(), 400)
-								return
-							}
-							unMarshalBatch(w, r, body)
-						},
+			cors(
+				middleware.ValidateToken(
+					middleware.RateLimit(
+						middleware.Enrich(
+							http.HandlerFunc(
+								func(w http.ResponseWriter, r *http.Request) {
+									// get variables from path
+									body, err := procBody(r)
+									if err != nil {
+										http.Error(w, err.Error(), 400)
+										return
+									}
+									unMarshalBatch(w, r, body, schemaRegistry, opts.Batches)
+								},
+							),
+							enricher,
+						),
+						clientLimiter,
 					),
-					tokenSecret,
+					tokenValidator,
 				),
 			),
 		),
 	)
 
 	/*
-	There's a lot of "duplicate" code here, but it follows
-	from a bug (https://github.com/julienschmidt/httprouter/issues/183)
-	in the httprouter package from 2017.
+		Long-lived streaming clients authenticate once at upgrade time.
+		Browsers can't set headers on a websocket, so they'll generally
+		pass the JWT in the query string
+	*/
+	router.Handler(
+		http.MethodGet,
+		"/ws",
+		middleware.Instrument(
+			cors(
+				middleware.ValidateToken(
+					middleware.RateLimit(
+						middleware.Enrich(
+							newWebsocketHandler(opts),
+							enricher,
+						),
+						clientLimiter,
+					),
+					tokenValidator,
+				),
+			),
+		),
+	)
 
-	Until we can say:
 	router.Handler(
 		http.MethodPost,
-		"/batch",
-		...
+		"/rum/vitals",
+		middleware.Instrument(
+			cors(
+				middleware.ValidateToken(
+					middleware.RateLimit(
+						middleware.Enrich(
+							newVitalsHandler(rum.NewRouteNormalizer(opts.RUMRouteTemplates)),
+							enricher,
+						),
+						clientLimiter,
+					),
+					tokenValidator,
+				),
+			),
+		),
+	)
+
+	/*
+		Browsers can't add headers to reports, so the JWT has
+		to be part of the report-to/report-uri URL
+	*/
+	router.Handler(
+		http.MethodPost,
+		"/reports",
+		middleware.Instrument(
+			cors(
+				middleware.ValidateToken(
+					middleware.RateLimit(
+						middleware.Enrich(
+							newReportsHandler(opts.ReportsWriter),
+							enricher,
+						),
+						clientLimiter,
+					),
+					tokenValidator,
+				),
+			),
+		),
 	)
+
 	router.Handler(
 		http.MethodPost,
-		"/:type",
-		...
+		"/graphite",
+		middleware.Instrument(
+			cors(
+				middleware.ValidateToken(
+					middleware.RateLimit(
+						middleware.Enrich(
+							newGraphiteHandler(opts.GraphiteMapper),
+							enricher,
+						),
+						clientLimiter,
+					),
+					tokenValidator,
+				),
+			),
+		),
 	)
 
-	We'll need all these extra paths...
+	/*
+		There's a lot of "duplicate" code here, but it follows
+		from a bug (https://github.com/julienschmidt/httprouter/issues/183)
+		in the httprouter package from 2017.
+
+		Until we can say:
+		router.Handler(
+			http.MethodPost,
+			"/batch",
+			...
+		)
+		router.Handler(
+			http.MethodPost,
+			"/:type",
+			...
+		)
+
+		We'll need all these extra paths...
 	*/
 	router.Handler(
 		http.MethodPost,
 		"/count",
 		middleware.Instrument(
-			middleware.ValidateCORS(
-				middleware.ValidateJWT(
-					http.HandlerFunc(
-						func(w http.ResponseWriter, r *http.Request) {
-							body, err := procBody(r)
-							if err != nil {
-								http.Error(w, err.Error(), 400)
-								return
-							}
-							unMarshalMetric(w, r, body, "count")
-						},
+			cors(
+				middleware.ValidateToken(
+					middleware.RateLimit(
+						middleware.Enrich(
+							http.HandlerFunc(
+								func(w http.ResponseWriter, r *http.Request) {
+									body, err := procBody(r)
+									if err != nil {
+										http.Error(w, err.Error(), 400)
+										return
+									}
+									unMarshalMetric(w, r, body, "count", schemaRegistry)
+								},
+							),
+							enricher,
+						),
+						clientLimiter,
 					),
-					tokenSecret,
+					tokenValidator,
 				),
 			),
 		),
@@ -114,19 +248,25 @@ func NewHTTPRouter(
 		http.MethodPost,
 		"/gauge",
 		middleware.Instrument(
-			middleware.ValidateCORS(
-				middleware.ValidateJWT(
-					http.HandlerFunc(
-						func(w http.ResponseWriter, r *http.Request) {
-							body, err := procBody(r)
-							if err != nil {
-								http.Error(w, err.Error(), 400)
-								return
-							}
-							unMarshalMetric(w, r, body, "gauge")
-						},
+			cors(
+				middleware.ValidateToken(
+					middleware.RateLimit(
+						middleware.Enrich(
+							http.HandlerFunc(
+								func(w http.ResponseWriter, r *http.Request) {
+									body, err := procBody(r)
+									if err != nil {
+										http.Error(w, err.Error(), 400)
+										return
+									}
+									unMarshalMetric(w, r, body, "gauge", schemaRegistry)
+								},
+							),
+							enricher,
+						),
+						clientLimiter,
 					),
-					tokenSecret,
+					tokenValidator,
 				),
 			),
 		),
@@ -136,19 +276,25 @@ func NewHTTPRouter(
 		http.MethodPost,
 		"/timing",
 		middleware.Instrument(
-			middleware.ValidateCORS(
-				middleware.ValidateJWT(
-					http.HandlerFunc(
-						func(w http.ResponseWriter, r *http.Request) {
-							body, err := procBody(r)
-							if err != nil {
-								http.Error(w, err.Error(), 400)
-								return
-							}
-							unMarshalMetric(w, r, body, "timing")
-						},
+			cors(
+				middleware.ValidateToken(
+					middleware.RateLimit(
+						middleware.Enrich(
+							http.HandlerFunc(
+								func(w http.ResponseWriter, r *http.Request) {
+									body, err := procBody(r)
+									if err != nil {
+										http.Error(w, err.Error(), 400)
+										return
+									}
+									unMarshalMetric(w, r, body, "timing", schemaRegistry)
+								},
+							),
+							enricher,
+						),
+						clientLimiter,
 					),
-					tokenSecret,
+					tokenValidator,
 				),
 			),
 		),
@@ -158,20 +304,26 @@ func NewHTTPRouter(
 		http.MethodPost,
 		"/set",
 		middleware.Instrument(
-			middleware.ValidateCORS(
-				middleware.ValidateJWT(
-					http.HandlerFunc(
-						func(w http.ResponseWriter, r *http.Request) {
-							// get variables from path
-							body, err := procBody(r)
-							if err != nil {
-								http.Error(w, err.Error(), 400)
-								return
-							}
-							unMarshalMetric(w, r, body, "set")
-						},
+			cors(
+				middleware.ValidateToken(
+					middleware.RateLimit(
+						middleware.Enrich(
+							http.HandlerFunc(
+								func(w http.ResponseWriter, r *http.Request) {
+									// get variables from path
+									body, err := procBody(r)
+									if err != nil {
+										http.Error(w, err.Error(), 400)
+										return
+									}
+									unMarshalMetric(w, r, body, "set", schemaRegistry)
+								},
+							),
+							enricher,
+						),
+						clientLimiter,
 					),
-					tokenSecret,
+					tokenValidator,
 				),
 			),
 		),
@@ -181,22 +333,28 @@ func NewHTTPRouter(
 		http.MethodPost,
 		"/count/:metric",
 		middleware.Instrument(
-			middleware.ValidateCORS(
-				middleware.ValidateJWT(
-					http.HandlerFunc(
-						func(w http.ResponseWriter, r *http.Request) {
-							// get variables from path
-							params := httprouter.ParamsFromContext(r.Context())
-							metricName := params.ByName("metric")
-							body, err := procBody(r)
-							if err != nil {
-								http.Error(w, err.Error(), 400)
-								return
-							}
-							unMarshalMetricName(w, r, body, "count", metricName)
-						},
+			cors(
+				middleware.ValidateToken(
+					middleware.RateLimit(
+						middleware.Enrich(
+							http.HandlerFunc(
+								func(w http.ResponseWriter, r *http.Request) {
+									// get variables from path
+									params := httprouter.ParamsFromContext(r.Context())
+									metricName := params.ByName("metric")
+									body, err := procBody(r)
+									if err != nil {
+										http.Error(w, err.Error(), 400)
+										return
+									}
+									unMarshalMetricName(w, r, body, "count", metricName, schemaRegistry)
+								},
+							),
+							enricher,
+						),
+						clientLimiter,
 					),
-					tokenSecret,
+					tokenValidator,
 				),
 			),
 		),
@@ -206,22 +364,28 @@ func NewHTTPRouter(
 		http.MethodPost,
 		"/gauge/:metric",
 		middleware.Instrument(
-			middleware.ValidateCORS(
-				middleware.ValidateJWT(
-					http.HandlerFunc(
-						func(w http.ResponseWriter, r *http.Request) {
-							// get variables from path
-							params := httprouter.ParamsFromContext(r.Context())
-							metricName := params.ByName("metric")
-							body, err := procBody(r)
-							if err != nil {
-								http.Error(w, err.Error(), 400)
-								return
-							}
-							unMarshalMetricName(w, r, body, "gauge", metricName)
-						},
+			cors(
+				middleware.ValidateToken(
+					middleware.RateLimit(
+						middleware.Enrich(
+							http.HandlerFunc(
+								func(w http.ResponseWriter, r *http.Request) {
+									// get variables from path
+									params := httprouter.ParamsFromContext(r.Context())
+									metricName := params.ByName("metric")
+									body, err := procBody(r)
+									if err != nil {
+										http.Error(w, err.Error(), 400)
+										return
+									}
+									unMarshalMetricName(w, r, body, "gauge", metricName, schemaRegistry)
+								},
+							),
+							enricher,
+						),
+						clientLimiter,
 					),
-					tokenSecret,
+					tokenValidator,
 				),
 			),
 		),
@@ -231,22 +395,28 @@ func NewHTTPRouter(
 		http.MethodPost,
 		"/timing/:metric",
 		middleware.Instrument(
-			middleware.ValidateCORS(
-				middleware.ValidateJWT(
-					http.HandlerFunc(
-						func(w http.ResponseWriter, r *http.Request) {
-							// get variables from path
-							params := httprouter.ParamsFromContext(r.Context())
-							metricName := params.ByName("metric")
-							body, err := procBody(r)
-							if err != nil {
-								http.Error(w, err.Error(), 400)
-								return
-							}
-							unMarshalMetricName(w, r, body, "timing", metricName)
-						},
+			cors(
+				middleware.ValidateToken(
+					middleware.RateLimit(
+						middleware.Enrich(
+							http.HandlerFunc(
+								func(w http.ResponseWriter, r *http.Request) {
+									// get variables from path
+									params := httprouter.ParamsFromContext(r.Context())
+									metricName := params.ByName("metric")
+									body, err := procBody(r)
+									if err != nil {
+										http.Error(w, err.Error(), 400)
+										return
+									}
+									unMarshalMetricName(w, r, body, "timing", metricName, schemaRegistry)
+								},
+							),
+							enricher,
+						),
+						clientLimiter,
 					),
-					tokenSecret,
+					tokenValidator,
 				),
 			),
 		),
@@ -256,44 +426,87 @@ func NewHTTPRouter(
 		http.MethodPost,
 		"/set/:metric",
 		middleware.Instrument(
-			middleware.ValidateCORS(
-				middleware.ValidateJWT(
-					http.HandlerFunc(
-						func(w http.ResponseWriter, r *http.Request) {
-							// get variables from path
-							params := httprouter.ParamsFromContext(r.Context())
-							metricName := params.ByName("metric")
-							body, err := procBody(r)
-							if err != nil {
-								http.Error(w, err.Error(), 400)
-								return
-							}
-							unMarshalMetricName(w, r, body, "set", metricName)
-						},
+			cors(
+				middleware.ValidateToken(
+					middleware.RateLimit(
+						middleware.Enrich(
+							http.HandlerFunc(
+								func(w http.ResponseWriter, r *http.Request) {
+									// get variables from path
+									params := httprouter.ParamsFromContext(r.Context())
+									metricName := params.ByName("metric")
+									body, err := procBody(r)
+									if err != nil {
+										http.Error(w, err.Error(), 400)
+										return
+									}
+									unMarshalMetricName(w, r, body, "set", metricName, schemaRegistry)
+								},
+							),
+							enricher,
+						),
+						clientLimiter,
 					),
-					tokenSecret,
+					tokenValidator,
 				),
 			),
 		),
 	)
 
-	// Handle pre-flight CORS requests
-	router.GlobalOPTIONS = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.WithFields(log.Fields{"path": r.URL.Path}).Debug("Pre-flight function")
-		if r.Header.Get("Access-Control-Request-Method") == "" {
-			return
-		}
+	/*
+		Browsers trade a session (proven by our app) for a short-lived
+		token, so no secret needs to ship in client code
+	*/
+	if opts.TokenIssuer != nil {
+		router.Handler(
+			http.MethodPost,
+			"/token",
+			middleware.Instrument(
+				cors(
+					newTokenHandler(opts.TokenIssuer),
+				),
+			),
+		)
+	}
 
-		origin := r.Header.Get("Origin")
-		if origin != "" {
-			w.Header().Add("Access-Control-Allow-Origin", origin)
-			w.Header().Add("Access-Control-Allow-Headers", middleware.JwtHeaderName+", X-Requested-With, Origin, Accept, Content-Type, Authentication")
-			w.Header().Add("Access-Control-Allow-Methods", "GET, POST, HEAD, OPTIONS")
+	/*
+		Admin routes are for operators, not browsers, so they skip
+		CORS and need a token with the admin claim
+	*/
+	if opts.Revocations != nil {
+		for _, method := range []string{http.MethodGet, http.MethodPost} {
+			router.Handler(
+				method,
+				"/admin/revocations",
+				middleware.Instrument(
+					middleware.ValidateToken(
+						middleware.RequireAdmin(
+							newRevocationsHandler(opts.Revocations),
+						),
+						tokenValidator,
+					),
+				),
+			)
 		}
+	}
 
-		// Adjust status code to 204
-		w.WriteHeader(http.StatusNoContent)
-	})
+	if opts.TypeRegistry != nil {
+		router.Handler(
+			http.MethodGet,
+			"/admin/type-conflicts",
+			middleware.Instrument(
+				middleware.ValidateToken(
+					middleware.RequireAdmin(
+						newTypeConflictsHandler(opts.TypeRegistry),
+					),
+					tokenValidator,
+				),
+			),
+		)
+	}
+
+	// Handle pre-flight CORS requests
+	router.GlobalOPTIONS = middleware.Preflight(corsPolicy)
 
 	return router
 }
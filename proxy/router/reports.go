@@ -0,0 +1,47 @@
+package router
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/middleware"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/reports"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+newReportsHandler counts browser Reporting API and CSP reports.
+If writer is set, the raw reports are also kept for later review
+*/
+func newReportsHandler(writer *reports.Writer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := procBodyOf(r, reports.ReportsContentType, reports.CSPReportContentType)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		parsed, err := reports.Parse(contentType, body)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		if !reserveMetrics(w, r, len(parsed)) {
+			return
+		}
+		metrics := make([]config.MetricRequest, 0, len(parsed))
+		for _, report := range parsed {
+			metrics = append(metrics, report.ToMetric())
+		}
+		// report names are ours, so they aren't subject to token scopes
+		enqueueBatch(nil, middleware.TagsFromContext(r.Context()), nil, metrics)
+
+		if writer != nil {
+			if err := writer.Write(parsed); err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Failed to write browser reports")
+			}
+		}
+	})
+}
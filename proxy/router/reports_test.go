@@ -0,0 +1,26 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/reports"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportsCannotForgeTags(t *testing.T) {
+	rt := require.New(t)
+	drain()
+
+	req := httptest.NewRequest("POST", "/reports", strings.NewReader(`{"csp-report": {"effective-directive": "script-src,tenant=victim"}}`))
+	req.Header.Set("Content-Type", reports.CSPReportContentType)
+	w := httptest.NewRecorder()
+	newReportsHandler(nil).ServeHTTP(w, req)
+	rt.Equal(http.StatusOK, w.Code)
+	metrics := drain()
+	rt.Len(metrics, 1)
+	rt.NotContains(metrics[0].Metric, ",")
+	rt.NotContains(metrics[0].Tags, "tenant=victim")
+}
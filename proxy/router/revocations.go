@@ -0,0 +1,73 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/middleware"
+	"github.com/golang-jwt/jwt"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+revocationRequest is either an explicit revocation, or the leaked
+token itself, which saves looking up its jti and exp by hand
+*/
+type revocationRequest struct {
+	middleware.Revocation
+	Token string `json:"token,omitempty"`
+}
+
+// newRevocationsHandler lists (GET) and adds (POST) token revocations
+func newRevocationsHandler(revocations *middleware.RevocationList) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(revocations.List())
+			return
+		}
+
+		body, err := procBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		var req revocationRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		revocation := req.Revocation
+		if req.Token != "" {
+			// the token may well be forged or expired, we only want its jti and exp
+			claims := jwt.MapClaims{}
+			if _, _, err := new(jwt.Parser).ParseUnverified(req.Token, claims); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			jti, _ := claims["jti"].(string)
+			if jti == "" {
+				http.Error(w, "Token has no jti, revoke its sub instead", 400)
+				return
+			}
+			revocation = middleware.Revocation{Jti: jti}
+			if exp, ok := claims["exp"].(float64); ok {
+				revocation.Expires = int64(exp)
+			}
+		}
+
+		if err := revocation.Validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		// the revocation is in effect even if it couldn't be saved
+		if err := revocations.Add(revocation); err != nil {
+			log.WithFields(log.Fields{"error": err, "jti": revocation.Jti, "sub": revocation.Sub}).Error("Failed to save revocation")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.WithFields(log.Fields{"jti": revocation.Jti, "sub": revocation.Sub}).Info("Token revoked")
+		w.WriteHeader(http.StatusCreated)
+	})
+}
@@ -0,0 +1,54 @@
+package router
+
+import (
+	"net/http"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/middleware"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/rum"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+newVitalsHandler accepts the web-vitals library's native payload
+(and Navigation Timing entries) and turns it into tagged timings.
+
+navigator.sendBeacon() posts strings as text/plain (which also
+avoids a CORS pre-flight), so we accept that alongside JSON
+*/
+func newVitalsHandler(normalizer *rum.RouteNormalizer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := procBodyOf(r, "application/json", "text/plain")
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		reports, err := rum.ParseReports(body)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		scope, err := middleware.ScopeFromContext(r.Context())
+		if err != nil {
+			rejectMetric(w, err)
+			return
+		}
+
+		var metrics []config.MetricRequest
+		for _, report := range reports {
+			m, err := normalizer.ToMetrics(report, r.Referer())
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Debug("Dropping web vitals report")
+				config.DroppedMetrics.Inc()
+				continue
+			}
+			metrics = append(metrics, m...)
+		}
+		if !reserveMetrics(w, r, len(metrics)) {
+			return
+		}
+		// the names are ours, but a token only scoped to other metrics shouldn't be able to write them
+		enqueueBatch(scope, middleware.TagsFromContext(r.Context()), nil, metrics)
+	})
+}
@@ -0,0 +1,57 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/rum"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func postVitals(body string) *httptest.ResponseRecorder {
+	return postVitalsWith(nil, body)
+}
+
+func postVitalsWith(claims jwt.MapClaims, body string) *httptest.ResponseRecorder {
+	return postJSON("/rum/vitals", claims, body, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		newVitalsHandler(rum.NewRouteNormalizer(nil)).ServeHTTP(w, r)
+	})
+}
+
+func TestVitalsRejectsForgedTags(t *testing.T) {
+	rt := require.New(t)
+	drain()
+
+	w := postVitals(`[{"name": "LCP,tenant=victim", "value": 1200}, {"name": "LCP", "value": 1200, "page": "/"}]`)
+	rt.Equal(http.StatusOK, w.Code)
+	metrics := drain()
+	rt.Len(metrics, 1)
+	rt.Equal("web_vitals_lcp", metrics[0].Metric)
+	rt.NotContains(metrics[0].Tags, "tenant")
+}
+
+func TestVitalsAreScoped(t *testing.T) {
+	rt := require.New(t)
+	drain()
+	body := `[{"name": "LCP", "value": 1200, "page": "/"}, {"name": "CLS", "value": 0.01, "page": "/"}]`
+
+	// web.* doesn't cover the vitals
+	w := postVitalsWith(webScope, body)
+	rt.Equal(http.StatusOK, w.Code)
+	rt.Empty(drain())
+
+	w = postVitalsWith(jwt.MapClaims{"scope": map[string]interface{}{
+		"metrics": []interface{}{"web_vitals_lcp"},
+		"types":   []interface{}{"timing"},
+	}}, body)
+	rt.Equal(http.StatusOK, w.Code)
+	metrics := drain()
+	rt.Len(metrics, 1)
+	rt.Equal("web_vitals_lcp", metrics[0].Metric)
+
+	w = postVitalsWith(jwt.MapClaims{"scope": []interface{}{"web_vitals_lcp"}}, body)
+	rt.Equal(http.StatusForbidden, w.Code)
+	rt.Empty(drain())
+}
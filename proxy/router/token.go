@@ -0,0 +1,45 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/issuer"
+	log "github.com/sirupsen/logrus"
+)
+
+type tokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// newTokenHandler mints short-lived tokens for browsers with a proven session
+func newTokenHandler(tokenIssuer *issuer.Issuer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, expires, err := tokenIssuer.Issue(r)
+
+		var issueErr *issuer.IssueError
+		if errors.As(err, &issueErr) {
+			log.WithFields(log.Fields{"error": err, "reason": issueErr.Reason}).Debug("Token request refused")
+			vmmetrics.GetOrCreateCounter(fmt.Sprintf("token_requests_rejected_total{reason=%q}", issueErr.Reason)).Inc()
+			if issueErr.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(issueErr.RetryAfter.Seconds()))))
+			}
+			http.Error(w, issueErr.Error(), issueErr.Status)
+			return
+		} else if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Failed to issue token")
+			http.Error(w, "Failed to issue token", 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(tokenResponse{token, expires.Unix()})
+	})
+}
@@ -0,0 +1,16 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/metrictypes"
+)
+
+// newTypeConflictsHandler lists the metric keys recently sent with conflicting types
+func newTypeConflictsHandler(typeRegistry *metrictypes.Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(typeRegistry.Conflicts())
+	})
+}
@@ -1,42 +1,188 @@
 package router
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 
+	vmmetrics "github.com/VictoriaMetrics/metrics"
 	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/dedup"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/middleware"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/schema"
 	log "github.com/sirupsen/logrus"
 )
 
-func unMarshalBatch(w http.ResponseWriter, r *http.Request, body []byte) {
-	var reqs []config.MetricRequest
-	if err := json.Unmarshal(body, &reqs); err != nil {
+// idempotencyKeyHeader names a batch, so retries of it aren't counted twice
+const idempotencyKeyHeader = "Idempotency-Key"
+
+const maxIdempotencyKeyLength = 255
+
+// batchRequest is the object form of a batch, which can name it with a batch_id instead of the header
+type batchRequest struct {
+	BatchID string                 `json:"batch_id"`
+	Metrics []config.MetricRequest `json:"metrics"`
+}
+
+// batchResult tells batch clients what was (and wasn't) accepted
+type batchResult struct {
+	Accepted int         `json:"accepted"`
+	Rejected []rejection `json:"rejected,omitempty"`
+}
+
+// rejection explains why a single metric in a batch was dropped
+type rejection struct {
+	Index  int    `json:"index"`
+	Metric string `json:"metric"`
+	Error  string `json:"error"`
+}
+
+func unMarshalBatch(w http.ResponseWriter, r *http.Request, body []byte, registry *schema.Registry, batches *dedup.Cache) {
+	var batch batchRequest
+	var err error
+	// a plain list of metrics is the original format
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		err = json.Unmarshal(body, &batch)
+	} else {
+		err = json.Unmarshal(body, &batch.Metrics)
+	}
+	if err != nil {
 		http.Error(w, err.Error(), 400)
 		return
 	}
-	for _, m := range reqs {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" {
+		key = batch.BatchID
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		http.Error(w, "Idempotency key too long", 400)
+		return
+	}
+
+	// rejections answer the request without caching anything, so they're settled before deduplicating
+	scope, err := middleware.ScopeFromContext(r.Context())
+	if err != nil {
+		rejectMetric(w, err)
+		return
+	}
+	if !reserveMetrics(w, r, len(batch.Metrics)) {
+		return
+	}
+
+	send := func() ([]byte, bool) {
+		result, err := json.Marshal(enqueueBatch(scope, middleware.TagsFromContext(r.Context()), registry, batch.Metrics))
+		return append(result, '\n'), err == nil
+	}
+
+	var result []byte
+	var ok bool
+	if key != "" && batches != nil {
+		// the result of a retry is the first attempt's, and its metrics aren't sent again
+		var replayed bool
+		result, ok, replayed = batches.Do(batchKey(r, key), send)
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+	} else {
+		result, ok = send()
+	}
+	if !ok {
+		return
+	}
+
+	// metrics are accepted (or not) individually, so the batch itself always succeeds
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+// batchKey keeps clients' idempotency keys apart, by their token's subject
+func batchKey(r *http.Request, key string) string {
+	claims, _ := middleware.ClaimsFromContext(r.Context())
+	sub, _ := claims["sub"].(string)
+	return sub + " " + key
+}
+
+/*
+enqueueBatch forwards a list of typed metrics (within scope) to the
+processor, adding trusted tags. An enforced schema is checked here too,
+so clients hear why a metric was rejected
+*/
+func enqueueBatch(scope *middleware.Scope, tags middleware.Tags, registry *schema.Registry, reqs []config.MetricRequest) batchResult {
+	result := batchResult{}
+	for i, m := range reqs {
 		if m.MetricType == "" {
 			log.WithFields(log.Fields{"metric": m}).Error("Metric in batch missing type, cannot forward")
 			config.DroppedMetrics.Inc()
+			result.Rejected = append(result.Rejected, rejection{i, m.Metric, "Missing metric_type"})
 			continue
 		}
+		if err := checkName(m); err != nil {
+			result.Rejected = append(result.Rejected, rejection{i, m.Metric, err.Error()})
+			continue
+		}
+		if err := checkScope(scope, m); err != nil {
+			result.Rejected = append(result.Rejected, rejection{i, m.Metric, err.Error()})
+			continue
+		}
+		m.Tags = tags.Apply(m.Tags)
+		if registry.Enforcing() {
+			if err := registry.Validate(m); err != nil {
+				config.DroppedMetrics.Inc()
+				result.Rejected = append(result.Rejected, rejection{i, m.Metric, err.Error()})
+				continue
+			}
+			m.Validated = true
+		}
 		config.ProcessChan <- m
+		result.Accepted++
+	}
+	return result
+}
+
+// checkName counts (and logs) any metric whose name would forge tags
+func checkName(m config.MetricRequest) error {
+	err := config.CheckMetricName(m.Metric)
+	if err != nil {
+		log.WithFields(log.Fields{"metric": m.Metric}).Debug("Metric name not allowed")
+		config.DroppedMetrics.Inc()
+		vmmetrics.GetOrCreateCounter(`metrics_rejected_total{reason="invalid_name"}`).Inc()
+	}
+	return err
+}
+
+// checkScope counts (and logs) any metric the token isn't allowed to write
+func checkScope(scope *middleware.Scope, m config.MetricRequest) error {
+	err := scope.Check(m.Metric, m.MetricType)
+	if scopeErr, ok := err.(*middleware.ScopeError); ok {
+		log.WithFields(log.Fields{"metric": m.Metric, "type": m.MetricType, "reason": scopeErr.Reason}).Debug("Metric outside token scope")
+		config.DroppedMetrics.Inc()
+		vmmetrics.GetOrCreateCounter(fmt.Sprintf("metrics_rejected_total{reason=%q}", scopeErr.Reason)).Inc()
+	}
+	return err
+}
+
+func rejectMetric(w http.ResponseWriter, err error) {
+	if scopeErr, ok := err.(*middleware.ScopeError); ok {
+		config.DroppedMetrics.Inc()
+		vmmetrics.GetOrCreateCounter(fmt.Sprintf("metrics_rejected_total{reason=%q}", scopeErr.Reason)).Inc()
 	}
+	http.Error(w, err.Error(), http.StatusForbidden)
 }
 
-func unMarshalMetric(w http.ResponseWriter, r *http.Request, body []byte, metricType string) {
+func unMarshalMetric(w http.ResponseWriter, r *http.Request, body []byte, metricType string, registry *schema.Registry) {
 	var req config.MetricRequest
 	if err := json.Unmarshal(body, &req); err != nil {
 		http.Error(w, err.Error(), 400)
 		return
 	}
 	req.MetricType = metricType
-	config.ProcessChan <- req
+	enqueueMetric(w, r, req, registry)
 }
 
-func unMarshalMetricName(w http.ResponseWriter, r *http.Request, body []byte, metricType string, metricName string) {
+func unMarshalMetricName(w http.ResponseWriter, r *http.Request, body []byte, metricType string, metricName string, registry *schema.Registry) {
 	var req config.MetricRequest
 	if err := json.Unmarshal(body, &req); err != nil {
 		http.Error(w, err.Error(), 400)
@@ -44,9 +190,52 @@ func unMarshalMetricName(w http.ResponseWriter, r *http.Request, body []byte, me
 	}
 	req.Metric = metricName
 	req.MetricType = metricType
+	enqueueMetric(w, r, req, registry)
+}
+
+/*
+enqueueMetric forwards a single metric from the per-type routes, if it's
+within the token's scope and matches an enforced schema
+*/
+func enqueueMetric(w http.ResponseWriter, r *http.Request, req config.MetricRequest, registry *schema.Registry) {
+	scope, err := middleware.ScopeFromContext(r.Context())
+	if err != nil {
+		rejectMetric(w, err)
+		return
+	}
+	if err := checkName(req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := checkScope(scope, req); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if !reserveMetrics(w, r, 1) {
+		return
+	}
+	req.Tags = middleware.TagsFromContext(r.Context()).Apply(req.Tags)
+	if registry.Enforcing() {
+		if err := registry.Validate(req); err != nil {
+			config.DroppedMetrics.Inc()
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		req.Validated = true
+	}
 	config.ProcessChan <- req
 }
 
+// reserveMetrics applies the client's metric rate limit to n metrics, answering 429 when it's exceeded
+func reserveMetrics(w http.ResponseWriter, r *http.Request, n int) bool {
+	ok, wait := middleware.ReserveMetrics(r.Context(), n)
+	if !ok {
+		config.DroppedMetrics.Add(n)
+		middleware.TooManyRequests(w, "Metric rate limit exceeded", wait)
+	}
+	return ok
+}
+
 func procBody(r *http.Request) ([]byte, error) {
 	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
 		return []byte{}, fmt.Errorf("Unsupported content type %v", r.Header.Get("Content-Type"))
@@ -60,3 +249,29 @@ func procBody(r *http.Request) ([]byte, error) {
 
 	return body, nil
 }
+
+// procBodyOf reads the request body if its media type is one of mediaTypes
+func procBodyOf(r *http.Request, mediaTypes ...string) ([]byte, error) {
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return []byte{}, fmt.Errorf("Unsupported content type %v", r.Header.Get("Content-Type"))
+	}
+	supported := false
+	for _, m := range mediaTypes {
+		if contentType == m {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return []byte{}, fmt.Errorf("Unsupported content type %v", r.Header.Get("Content-Type"))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, config.MaxBodySize))
+	if err != nil {
+		return []byte{}, err
+	}
+	r.Body.Close()
+
+	return body, nil
+}
@@ -0,0 +1,137 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/dedup"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/middleware"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/schema"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+var webScope = jwt.MapClaims{"scope": map[string]interface{}{
+	"metrics": []interface{}{"web.*"},
+	"types":   []interface{}{"count"},
+}}
+
+func postJSON(path string, claims jwt.MapClaims, body string, handle func(w http.ResponseWriter, r *http.Request, body []byte)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if claims != nil {
+		req = req.WithContext(middleware.ContextWithClaims(context.Background(), claims))
+	}
+	w := httptest.NewRecorder()
+	handle(w, req, []byte(body))
+	return w
+}
+
+func TestBatchRejectsForgedTags(t *testing.T) {
+	rt := require.New(t)
+	drain()
+
+	w := postJSON("/batch", webScope, `[
+		{"metric": "web.checkout.paid,tenant=victim", "value": 1, "metric_type": "count"},
+		{"metric": "web.checkout.paid tenant=victim", "value": 1, "metric_type": "count"},
+		{"metric": "web.checkout.paid", "value": 1, "metric_type": "count"}
+	]`, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		unMarshalBatch(w, r, body, nil, nil)
+	})
+	rt.Equal(http.StatusOK, w.Code)
+	rt.Contains(w.Body.String(), `"accepted":1`)
+	rt.Contains(w.Body.String(), "can't contain commas")
+	metrics := drain()
+	rt.Len(metrics, 1)
+	rt.Equal("web.checkout.paid", metrics[0].Metric)
+}
+
+func TestMetricRouteRejectsForgedTags(t *testing.T) {
+	rt := require.New(t)
+	drain()
+
+	w := postJSON("/count/web.paid,tenant=victim", webScope, `{"value": 1}`, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		unMarshalMetricName(w, r, body, "count", "web.paid,tenant=victim", nil)
+	})
+	rt.Equal(http.StatusBadRequest, w.Code)
+	rt.Empty(drain())
+
+	w = postJSON("/count", webScope, `{"metric": "web.paid=1", "value": 1}`, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		unMarshalMetric(w, r, body, "count", nil)
+	})
+	rt.Equal(http.StatusBadRequest, w.Code)
+	rt.Empty(drain())
+}
+
+func TestBatchQuotaIsCheckedBeforeDeduplicating(t *testing.T) {
+	rt := require.New(t)
+	drain()
+	batches := dedup.NewCache(time.Minute, 10)
+	body := `[{"metric": "a", "value": 1, "metric_type": "count"}]`
+
+	post := func(ctx context.Context) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/batch", strings.NewReader(body)).WithContext(ctx)
+		req.Header.Set(idempotencyKeyHeader, "batch-1")
+		w := httptest.NewRecorder()
+		unMarshalBatch(w, req, []byte(body), nil, batches)
+		return w
+	}
+	// the same client, with and without any quota left
+	withQuota := func(left bool) context.Context {
+		limiter, err := middleware.NewClientLimiter(0, 0, 0.001, 1, "sub", nil)
+		rt.NoError(err)
+		ctx, ok, _ := limiter.Limit(middleware.ContextWithClaims(context.Background(), jwt.MapClaims{"sub": "a"}), "127.0.0.1")
+		rt.True(ok)
+		if !left {
+			ok, _ = middleware.ReserveMetrics(ctx, 1)
+			rt.True(ok)
+		}
+		return ctx
+	}
+
+	// over quota, so the key isn't taken
+	w := post(withQuota(false))
+	rt.Equal(http.StatusTooManyRequests, w.Code)
+	rt.Empty(drain())
+
+	w = post(withQuota(true))
+	rt.Equal(http.StatusOK, w.Code)
+	rt.Empty(w.Header().Get("Idempotent-Replayed"))
+	rt.Len(drain(), 1)
+
+	w = post(withQuota(true))
+	rt.Equal(http.StatusOK, w.Code)
+	rt.Equal("true", w.Header().Get("Idempotent-Replayed"))
+	rt.Empty(drain())
+}
+
+func TestMetricRouteEnforcesSchema(t *testing.T) {
+	rt := require.New(t)
+	drain()
+	max := int64(100)
+	registry, err := schema.New(schema.File{Metrics: []schema.Metric{{Name: "web.paid", Type: "count", Max: &max}}}, schema.Enforce, "")
+	rt.NoError(err)
+
+	w := postJSON("/count/web.paid", webScope, `{"value": 1000}`, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		unMarshalMetricName(w, r, body, "count", "web.paid", registry)
+	})
+	rt.Equal(http.StatusBadRequest, w.Code)
+	rt.Contains(w.Body.String(), `Value 1000 of metric "web.paid" is above 100`)
+	rt.Empty(drain())
+
+	w = postJSON("/count", webScope, `{"metric": "web.unknown", "value": 1}`, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		unMarshalMetric(w, r, body, "count", registry)
+	})
+	rt.Equal(http.StatusBadRequest, w.Code)
+	rt.Empty(drain())
+
+	w = postJSON("/count/web.paid", webScope, `{"value": 10}`, func(w http.ResponseWriter, r *http.Request, body []byte) {
+		unMarshalMetricName(w, r, body, "count", "web.paid", registry)
+	})
+	rt.Equal(http.StatusOK, w.Code)
+	rt.Len(drain(), 1)
+}
@@ -0,0 +1,264 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/middleware"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/ratelimit"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/schema"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// largest single frame we'll accept from a client (1 MB)
+const wsMaxFrameSize = 1024 * 1024
+
+// how long we'll wait on a slow client to read an ack
+const wsWriteTimeout = 5 * time.Second
+
+var (
+	wsOpenConnections int64
+	// handlers of open connections, which the HTTP server stops tracking once they're upgraded
+	wsStreams sync.WaitGroup
+
+	wsConnections       = vmmetrics.NewCounter("ws_connections_total")
+	wsFrames            = vmmetrics.NewCounter("ws_frames_total")
+	wsFramesInvalid     = vmmetrics.NewCounter("ws_frames_invalid_total")
+	wsFramesRateLimited = vmmetrics.NewCounter("ws_frames_rate_limited_total")
+)
+
+func init() {
+	_ = vmmetrics.NewGauge("ws_connections_open",
+		func() float64 {
+			return float64(atomic.LoadInt64(&wsOpenConnections))
+		})
+}
+
+// wsFrame is a single message from a streaming client
+type wsFrame struct {
+	Seq     uint64                 `json:"seq"`
+	Metrics []config.MetricRequest `json:"metrics"`
+}
+
+// wsAck acknowledges a frame back to the client by sequence number
+type wsAck struct {
+	Seq      uint64      `json:"seq"`
+	Accepted int         `json:"accepted"`
+	Rejected []rejection `json:"rejected,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+/*
+newWebsocketHandler upgrades a (pre-authenticated) request into a
+long-lived stream of metric frames.
+
+Each connection gets its own token bucket, sized in metrics per second,
+so a single chatty tab can't starve everyone else. A rate of 0 disables
+the limit, and an idle timeout of 0 lets connections stay silent for
+as long as they like.
+
+Connections are closed when the request's context is cancelled, which
+is how the server stops them on shutdown, and (with a policy violation)
+when the token expires or is revoked.
+*/
+func newWebsocketHandler(opts Options) http.Handler {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 1024,
+		// browsers don't apply CORS to websockets, so the origin is checked here too
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" || opts.CORSPolicy.Allowed(origin) {
+				return true
+			}
+			log.WithFields(log.Fields{"origin": origin}).Warn("Websocket origin rejected")
+			vmmetrics.GetOrCreateCounter("cors_rejected_origins_total").Inc()
+			return false
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the token is only checked once, so its scope holds for the whole connection
+		scope, err := middleware.ScopeFromContext(r.Context())
+		if err != nil {
+			rejectMetric(w, err)
+			return
+		}
+
+		wsStreams.Add(1)
+		defer wsStreams.Done()
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade has already written an error response
+			log.WithFields(log.Fields{"error": err}).Debug("Failed websocket upgrade")
+			return
+		}
+		defer conn.Close()
+
+		wsConnections.Inc()
+		atomic.AddInt64(&wsOpenConnections, 1)
+		defer atomic.AddInt64(&wsOpenConnections, -1)
+
+		var bucket *ratelimit.Bucket
+		if opts.WSRateLimit > 0 {
+			bucket = ratelimit.NewBucket(float64(opts.WSRateLimit), opts.WSRateLimit)
+		}
+
+		claims, _ := middleware.ClaimsFromContext(r.Context())
+		stream := &wsStream{
+			conn:        conn,
+			scope:       scope,
+			tags:        middleware.TagsFromContext(r.Context()),
+			claims:      claims,
+			validator:   opts.TokenValidator,
+			registry:    opts.Schema,
+			bucket:      bucket,
+			idleTimeout: opts.WSIdleTimeout,
+		}
+		stream.serve(r.Context())
+	})
+}
+
+// WaitForStreams waits for the handlers of open websocket connections to return
+func WaitForStreams() {
+	wsStreams.Wait()
+}
+
+// wsStream is one open connection, and what its token allows
+type wsStream struct {
+	conn        *websocket.Conn
+	scope       *middleware.Scope
+	tags        middleware.Tags
+	claims      jwt.MapClaims
+	validator   *middleware.TokenValidator
+	registry    *schema.Registry
+	bucket      *ratelimit.Bucket
+	idleTimeout time.Duration
+}
+
+func (s *wsStream) serve(ctx context.Context) {
+	conn := s.conn
+	extendDeadline := func() error {
+		if s.idleTimeout <= 0 {
+			return nil
+		}
+		return conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+	}
+	conn.SetReadLimit(wsMaxFrameSize)
+	extendDeadline()
+	conn.SetPongHandler(func(string) error {
+		return extendDeadline()
+	})
+
+	// the token is only validated at upgrade time, so the connection can't outlive it
+	var expired <-chan time.Time
+	if exp, ok := middleware.ExpiresAt(s.claims); ok {
+		timer := time.NewTimer(time.Until(exp))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	// keep idle (but healthy) connections open with pings, until the context is cancelled or the token expires
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		var pings <-chan time.Time
+		if s.idleTimeout > 0 {
+			ticker := time.NewTicker(s.idleTimeout / 2)
+			defer ticker.Stop()
+			pings = ticker.C
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				// closing the connection ends the read loop
+				s.close(websocket.CloseGoingAway, "server shutting down")
+				return
+			case <-expired:
+				s.close(websocket.ClosePolicyViolation, "token expired")
+				return
+			case <-pings:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.WithFields(log.Fields{"error": err}).Debug("Websocket closed unexpectedly")
+			}
+			return
+		}
+		extendDeadline()
+		wsFrames.Inc()
+
+		// revocations apply to open connections too
+		if err := s.validator.Revoked(s.claims); err != nil {
+			s.close(websocket.ClosePolicyViolation, err.Error())
+			return
+		}
+
+		var frame wsFrame
+		var ack wsAck
+		if err := json.Unmarshal(msg, &frame); err != nil {
+			wsFramesInvalid.Inc()
+			ack.Error = err.Error()
+		} else if !allowFrame(ctx, s.bucket, len(frame.Metrics)) {
+			wsFramesRateLimited.Inc()
+			config.DroppedMetrics.Add(len(frame.Metrics))
+			ack.Seq = frame.Seq
+			ack.Error = "rate limit exceeded"
+		} else {
+			result := enqueueBatch(s.scope, s.tags, s.registry, frame.Metrics)
+			ack.Seq = frame.Seq
+			ack.Accepted = result.Accepted
+			ack.Rejected = result.Rejected
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err := conn.WriteJSON(ack); err != nil {
+			log.WithFields(log.Fields{"error": err}).Debug("Failed to acknowledge websocket frame")
+			return
+		}
+	}
+}
+
+// close tells the client why we're hanging up, then does
+func (s *wsStream) close(code int, reason string) {
+	s.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	s.conn.Close()
+}
+
+/*
+allowFrame applies the connection's rate limit, then the client's
+metric rate limit. A frame the client's limit refuses gives its
+tokens back to the connection, as nothing was sent
+*/
+func allowFrame(ctx context.Context, bucket *ratelimit.Bucket, n int) bool {
+	if bucket != nil && !bucket.Allow(n) {
+		return false
+	}
+	if ok, _ := middleware.ReserveMetrics(ctx, n); !ok {
+		if bucket != nil {
+			bucket.Return(n)
+		}
+		return false
+	}
+	return true
+}
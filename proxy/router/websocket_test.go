@@ -0,0 +1,240 @@
+package router
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/middleware"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/ratelimit"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/schema"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// newWebsocketServer serves /ws for a token with a scope, stopping streams when ctx is cancelled
+func newWebsocketServer(ctx context.Context, idleTimeout time.Duration) *httptest.Server {
+	return newWebsocketServerWith(ctx, Options{WSIdleTimeout: idleTimeout}, nil)
+}
+
+// newWebsocketServerWith serves /ws with opts, for claims (or a token with a scope)
+func newWebsocketServerWith(ctx context.Context, opts Options, claims jwt.MapClaims) *httptest.Server {
+	if claims == nil {
+		claims = jwt.MapClaims{"scope": map[string]interface{}{
+			"metrics": []interface{}{"web.*"},
+			"types":   []interface{}{"count"},
+		}}
+	}
+	handler := newWebsocketHandler(opts)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(middleware.ContextWithClaims(r.Context(), claims)))
+	}))
+	server.Config.BaseContext = func(net.Listener) context.Context { return ctx }
+	server.Start()
+	return server
+}
+
+func dialWebsocket(t *testing.T, server *httptest.Server) *websocket.Conn {
+	conn, resp, err := dialWebsocketFrom(server, "")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	return conn
+}
+
+func dialWebsocketFrom(server *httptest.Server, origin string) (*websocket.Conn, *http.Response, error) {
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", header)
+}
+
+func TestWebsocketFrames(t *testing.T) {
+	server := newWebsocketServer(context.Background(), time.Minute)
+	defer server.Close()
+	conn := dialWebsocket(t, server)
+	defer conn.Close()
+	rt := require.New(t)
+	drain()
+
+	rt.NoError(conn.WriteJSON(wsFrame{Seq: 1, Metrics: []config.MetricRequest{
+		{Metric: "web.clicks", Value: 1, MetricType: "count"},
+		{Metric: "backend.queue", Value: 5, MetricType: "count"},
+		{Metric: "web.load", Value: 250, MetricType: "timing"},
+	}}))
+	var ack wsAck
+	rt.NoError(conn.ReadJSON(&ack))
+	rt.Equal(uint64(1), ack.Seq)
+	rt.Equal(1, ack.Accepted)
+	rt.Equal([]rejection{
+		{1, "backend.queue", `Metric "backend.queue" is outside the token's scope`},
+		{2, "web.load", `Metric type "timing" is outside the token's scope`},
+	}, ack.Rejected)
+	metrics := drain()
+	rt.Len(metrics, 1)
+	rt.Equal("web.clicks", metrics[0].Metric)
+
+	rt.NoError(conn.WriteMessage(websocket.TextMessage, []byte("not json")))
+	ack = wsAck{}
+	rt.NoError(conn.ReadJSON(&ack))
+	rt.NotEmpty(ack.Error)
+	rt.Empty(drain())
+}
+
+func TestWebsocketWithoutIdleTimeout(t *testing.T) {
+	server := newWebsocketServer(context.Background(), 0)
+	defer server.Close()
+	conn := dialWebsocket(t, server)
+	defer conn.Close()
+	rt := require.New(t)
+	drain()
+
+	rt.NoError(conn.WriteJSON(wsFrame{Seq: 7, Metrics: []config.MetricRequest{{Metric: "web.clicks", Value: 1, MetricType: "count"}}}))
+	var ack wsAck
+	rt.NoError(conn.ReadJSON(&ack))
+	rt.Equal(uint64(7), ack.Seq)
+	rt.Equal(1, ack.Accepted)
+	drain()
+}
+
+func TestWebsocketShutdown(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	server := newWebsocketServer(ctx, time.Minute)
+	defer server.Close()
+	conn := dialWebsocket(t, server)
+	defer conn.Close()
+
+	stop()
+	_, _, err := conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "%v", err)
+
+	waited := make(chan struct{})
+	go func() {
+		WaitForStreams()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("websocket handler still running after shutdown")
+	}
+}
+
+func TestWebsocketRejectsForgedTags(t *testing.T) {
+	server := newWebsocketServer(context.Background(), time.Minute)
+	defer server.Close()
+	conn := dialWebsocket(t, server)
+	defer conn.Close()
+	rt := require.New(t)
+	drain()
+
+	rt.NoError(conn.WriteJSON(wsFrame{Seq: 1, Metrics: []config.MetricRequest{
+		{Metric: "web.checkout.paid,tenant=victim", Value: 1, MetricType: "count"},
+	}}))
+	var ack wsAck
+	rt.NoError(conn.ReadJSON(&ack))
+	rt.Equal(0, ack.Accepted)
+	rt.Len(ack.Rejected, 1)
+	rt.Empty(drain())
+}
+
+func TestWebsocketEnforcesSchema(t *testing.T) {
+	registry, err := schema.New(schema.File{Metrics: []schema.Metric{{Name: "web.paid", Type: "count"}}}, schema.Enforce, "")
+	require.NoError(t, err)
+	server := newWebsocketServerWith(context.Background(), Options{WSIdleTimeout: time.Minute, Schema: registry}, nil)
+	defer server.Close()
+	conn := dialWebsocket(t, server)
+	defer conn.Close()
+	rt := require.New(t)
+	drain()
+
+	rt.NoError(conn.WriteJSON(wsFrame{Seq: 1, Metrics: []config.MetricRequest{
+		{Metric: "web.paid", Value: 1, MetricType: "count"},
+		{Metric: "web.unknown", Value: 1, MetricType: "count"},
+	}}))
+	var ack wsAck
+	rt.NoError(conn.ReadJSON(&ack))
+	rt.Equal(1, ack.Accepted)
+	rt.Len(ack.Rejected, 1)
+	rt.Equal("web.unknown", ack.Rejected[0].Metric)
+	metrics := drain()
+	rt.Len(metrics, 1)
+	rt.Equal("web.paid", metrics[0].Metric)
+}
+
+func TestWebsocketOrigin(t *testing.T) {
+	policy, err := middleware.NewCORSPolicy(middleware.CORSConfig{Origins: []string{"https://app.example.com"}})
+	require.NoError(t, err)
+	server := newWebsocketServerWith(context.Background(), Options{CORSPolicy: policy}, nil)
+	defer server.Close()
+	rt := require.New(t)
+
+	conn, _, err := dialWebsocketFrom(server, "https://app.example.com")
+	rt.NoError(err)
+	conn.Close()
+
+	_, resp, err := dialWebsocketFrom(server, "https://evil.example.net")
+	rt.Error(err)
+	rt.Equal(http.StatusForbidden, resp.StatusCode)
+}
+
+func TestAllowFrameReturnsRefusedTokens(t *testing.T) {
+	limiter, err := middleware.NewClientLimiter(0, 0, 0.001, 1, "ip", nil)
+	require.NoError(t, err)
+	var ctx context.Context
+	middleware.RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = r.Context()
+	}), limiter).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ws", nil))
+	bucket := ratelimit.NewBucket(0.001, 2)
+	rt := require.New(t)
+
+	rt.True(allowFrame(ctx, bucket, 1))
+	// the client is out of metrics, so the connection keeps its token
+	rt.False(allowFrame(ctx, bucket, 1))
+	rt.True(bucket.Allow(1))
+}
+
+func TestWebsocketClosesWhenTokenExpires(t *testing.T) {
+	claims := jwt.MapClaims{"exp": float64(time.Now().Add(time.Second).Unix())}
+	server := newWebsocketServerWith(context.Background(), Options{}, claims)
+	defer server.Close()
+	conn := dialWebsocket(t, server)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "%v", err)
+}
+
+func TestWebsocketClosesWhenTokenRevoked(t *testing.T) {
+	revocations, err := middleware.LoadRevocationList(filepath.Join(t.TempDir(), "revocations.yaml"), 0)
+	require.NoError(t, err)
+	validator := middleware.NewTokenValidator("secret", nil, nil, middleware.ClaimsPolicy{}, revocations, nil, nil)
+	claims := jwt.MapClaims{"jti": "leaked"}
+	server := newWebsocketServerWith(context.Background(), Options{TokenValidator: validator}, claims)
+	defer server.Close()
+	conn := dialWebsocket(t, server)
+	defer conn.Close()
+	rt := require.New(t)
+	drain()
+
+	frame := wsFrame{Seq: 1, Metrics: []config.MetricRequest{{Metric: "web.clicks", Value: 1, MetricType: "count"}}}
+	rt.NoError(conn.WriteJSON(frame))
+	var ack wsAck
+	rt.NoError(conn.ReadJSON(&ack))
+	rt.Equal(1, ack.Accepted)
+	drain()
+
+	rt.NoError(revocations.Add(middleware.Revocation{Jti: "leaked"}))
+	rt.NoError(conn.WriteJSON(frame))
+	_, _, err = conn.ReadMessage()
+	rt.True(websocket.IsCloseError(err, websocket.ClosePolicyViolation), "%v", err)
+	rt.Empty(drain())
+}
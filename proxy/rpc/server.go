@@ -0,0 +1,349 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/middleware"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/rpc/pb"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/schema"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// metricsService implements pb.MetricsServer on top of the processing queue
+type metricsService struct {
+	pb.UnimplementedMetricsServer
+	enricher *middleware.Enricher
+	schema   *schema.Registry
+}
+
+// Options configures the gRPC server. Anything left nil is off
+type Options struct {
+	TokenValidator *middleware.TokenValidator
+	Enricher       *middleware.Enricher
+	TLSConfig      *tls.Config
+	ClientLimiter  *middleware.ClientLimiter
+	Schema         *schema.Registry
+}
+
+// NewServer creates a gRPC server exposing the Metrics service
+func NewServer(opts Options) *grpc.Server {
+	serverOpts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(instrumentUnary, authUnary(opts.TokenValidator), rateLimitUnary(opts.ClientLimiter)),
+		grpc.ChainStreamInterceptor(instrumentStream, authStream(opts.TokenValidator), rateLimitStream(opts.ClientLimiter)),
+	}
+	if opts.TLSConfig != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(opts.TLSConfig)))
+	}
+
+	grpcServer := grpc.NewServer(serverOpts...)
+	pb.RegisterMetricsServer(grpcServer, &metricsService{enricher: opts.Enricher, schema: opts.Schema})
+
+	return grpcServer
+}
+
+// Send queues a single metric
+func (s *metricsService) Send(ctx context.Context, m *pb.Metric) (*pb.SendResponse, error) {
+	if m.MetricType == "" {
+		config.DroppedMetrics.Inc()
+		return nil, status.Error(codes.InvalidArgument, "metric_type is required")
+	}
+	if err := checkName(m); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	scope, err := middleware.ScopeFromContext(ctx)
+	if err == nil {
+		err = checkScope(scope, m)
+	}
+	if err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	if ok, _ := middleware.ReserveMetrics(ctx, 1); !ok {
+		config.DroppedMetrics.Inc()
+		return nil, status.Error(codes.ResourceExhausted, "Metric rate limit exceeded")
+	}
+	req := toMetricRequest(m, s.tags(ctx))
+	if err := s.validate(&req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	config.ProcessChan <- req
+	return &pb.SendResponse{Accepted: 1}, nil
+}
+
+// SendStream queues metrics until the client closes the stream
+func (s *metricsService) SendStream(stream pb.Metrics_SendStreamServer) error {
+	scope, err := middleware.ScopeFromContext(stream.Context())
+	if err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	tags := s.tags(stream.Context())
+
+	var accepted uint64
+	for {
+		m, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&pb.SendResponse{Accepted: accepted})
+		}
+		if err != nil {
+			return err
+		}
+		if m.MetricType == "" {
+			log.WithFields(log.Fields{"metric": m.Metric}).Error("Metric in stream missing type, cannot forward")
+			config.DroppedMetrics.Inc()
+			continue
+		}
+		// like a batch, bad or out of scope metrics are skipped rather than failing the stream
+		if checkName(m) != nil || checkScope(scope, m) != nil {
+			continue
+		}
+		if ok, _ := middleware.ReserveMetrics(stream.Context(), 1); !ok {
+			config.DroppedMetrics.Inc()
+			return status.Error(codes.ResourceExhausted, "Metric rate limit exceeded")
+		}
+		req := toMetricRequest(m, tags)
+		if s.validate(&req) != nil {
+			continue
+		}
+		config.ProcessChan <- req
+		accepted++
+	}
+}
+
+// checkName counts any metric whose name would forge tags
+func checkName(m *pb.Metric) error {
+	err := config.CheckMetricName(m.Metric)
+	if err != nil {
+		config.DroppedMetrics.Inc()
+		vmmetrics.GetOrCreateCounter(`metrics_rejected_total{reason="invalid_name"}`).Inc()
+	}
+	return err
+}
+
+// checkScope counts any metric the token isn't allowed to write
+func checkScope(scope *middleware.Scope, m *pb.Metric) error {
+	err := scope.Check(m.Metric, m.MetricType)
+	if scopeErr, ok := err.(*middleware.ScopeError); ok {
+		config.DroppedMetrics.Inc()
+		vmmetrics.GetOrCreateCounter(fmt.Sprintf("metrics_rejected_total{reason=%q}", scopeErr.Reason)).Inc()
+	}
+	return err
+}
+
+// validate checks a metric against an enforced schema, counting any it rejects and marking any it accepts
+func (s *metricsService) validate(m *config.MetricRequest) error {
+	if !s.schema.Enforcing() {
+		return nil
+	}
+	err := s.schema.Validate(*m)
+	if err != nil {
+		config.DroppedMetrics.Inc()
+		return err
+	}
+	m.Validated = true
+	return nil
+}
+
+// tags reads enrichment tags from the token's claims and the request metadata
+func (s *metricsService) tags(ctx context.Context) middleware.Tags {
+	if s.enricher == nil {
+		return nil
+	}
+	claims, _ := middleware.ClaimsFromContext(ctx)
+	identity, _ := middleware.ClientIdentityFromContext(ctx)
+	md, _ := metadata.FromIncomingContext(ctx)
+	return s.enricher.Tags(claims, identity, func(name string) string {
+		if vals := md.Get(name); len(vals) > 0 {
+			return vals[0]
+		}
+		return ""
+	})
+}
+
+func toMetricRequest(m *pb.Metric, tags middleware.Tags) config.MetricRequest {
+	return config.MetricRequest{
+		Metric:     m.Metric,
+		Value:      m.Value,
+		Tags:       tags.Apply(m.Tags),
+		MetricType: m.MetricType,
+		SampleRate: m.SampleRate,
+	}
+}
+
+/*
+Authentication mirrors middleware.ValidateToken: a validator with
+nothing configured accepts everything, otherwise the token is read
+from the same metadata keys as HTTP headers (see
+middleware.CredentialsFrom), or an API key or a verified client
+certificate is used instead.
+Validated claims are stored in the returned context
+*/
+func authenticate(ctx context.Context, tokenValidator *middleware.TokenValidator) (context.Context, error) {
+	var identity string
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			if id, ok := middleware.TLSIdentity(&tlsInfo.State); ok {
+				identity = id
+				ctx = middleware.ContextWithClientIdentity(ctx, identity)
+			}
+		}
+	}
+
+	if !tokenValidator.Enabled() {
+		return ctx, nil
+	}
+
+	// the same headers as HTTP, as metadata
+	md, _ := metadata.FromIncomingContext(ctx)
+	creds := middleware.CredentialsFrom(func(name string) string {
+		if vals := md.Get(name); len(vals) > 0 {
+			return vals[0]
+		}
+		return ""
+	})
+	tokenString, apiKey := creds.Token, creds.APIKey
+
+	if tokenString == "" && apiKey != "" {
+		claims, err := tokenValidator.APIKeyClaims(apiKey)
+		var keyErr *middleware.APIKeyError
+		if errors.As(err, &keyErr) && keyErr.Reason == "rate_limited" {
+			return ctx, status.Error(codes.ResourceExhausted, keyErr.Error())
+		} else if err != nil {
+			vmmetrics.GetOrCreateCounter("auth_reqs_bad_api_key_total").Inc()
+			return ctx, status.Error(codes.PermissionDenied, err.Error())
+		}
+		vmmetrics.GetOrCreateCounter("auth_reqs_api_key_total").Inc()
+		return middleware.ContextWithClaims(ctx, claims), nil
+	}
+
+	if tokenString == "" && identity != "" {
+		claims, err := tokenValidator.CertificateClaims(identity)
+		if err != nil {
+			vmmetrics.GetOrCreateCounter("auth_reqs_bad_client_cert_total").Inc()
+			return ctx, status.Error(codes.PermissionDenied, err.Error())
+		}
+		vmmetrics.GetOrCreateCounter("auth_reqs_client_cert_total").Inc()
+		return middleware.ContextWithClaims(ctx, claims), nil
+	}
+
+	if tokenString == "" {
+		vmmetrics.GetOrCreateCounter("auth_reqs_without_token_total").Inc()
+		return ctx, status.Error(codes.Unauthenticated, "Token not specified")
+	}
+
+	claims, err := tokenValidator.Parse(tokenString)
+	var claimsErr *middleware.ClaimsError
+	if errors.As(err, &claimsErr) {
+		vmmetrics.GetOrCreateCounter(fmt.Sprintf("auth_reqs_rejected_claims_total{reason=%q}", claimsErr.Reason)).Inc()
+		return ctx, status.Error(codes.PermissionDenied, claimsErr.Error())
+	} else if err != nil {
+		vmmetrics.GetOrCreateCounter("auth_reqs_bad_token_total").Inc()
+		return ctx, status.Error(codes.PermissionDenied, "Error parsing token")
+	}
+	return middleware.ContextWithClaims(ctx, claims), nil
+}
+
+// authenticatedStream carries the authenticated context through to stream handlers
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func authUnary(tokenValidator *middleware.TokenValidator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, tokenValidator)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func authStream(tokenValidator *middleware.TokenValidator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), tokenValidator)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ss, ctx})
+	}
+}
+
+// rateLimitUnary applies the client's request rate limit, and its metric quota, to a call
+func rateLimitUnary(limiter *middleware.ClientLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := rateLimit(ctx, limiter)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func rateLimitStream(limiter *middleware.ClientLimiter) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := rateLimit(ss.Context(), limiter)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ss, ctx})
+	}
+}
+
+// rateLimit mirrors middleware.RateLimit, telling anonymous clients apart by their address
+func rateLimit(ctx context.Context, limiter *middleware.ClientLimiter) (context.Context, error) {
+	if limiter == nil {
+		return ctx, nil
+	}
+	var ip string
+	if p, ok := peer.FromContext(ctx); ok {
+		ip = p.Addr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+	}
+	ctx, ok, _ := limiter.Limit(ctx, ip)
+	if !ok {
+		return ctx, status.Error(codes.ResourceExhausted, "Request rate limit exceeded")
+	}
+	return ctx, nil
+}
+
+// track per-RPC status the same way middleware.Instrument tracks HTTP requests
+func observe(method string, start time.Time, err error) {
+	code := status.Code(err).String()
+	reqStr := fmt.Sprintf("grpc_requests_total{method=%q,status_code=%q}", method, code)
+	vmmetrics.GetOrCreateCounter(reqStr).Inc()
+	takenStr := fmt.Sprintf("grpc_request_time_secs_total{method=%q,status_code=%q}", method, code)
+	vmmetrics.GetOrCreateSummary(takenStr).UpdateDuration(start)
+}
+
+func instrumentUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observe(info.FullMethod, start, err)
+	return resp, err
+}
+
+func instrumentStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observe(info.FullMethod, start, err)
+	return err
+}
@@ -0,0 +1,110 @@
+package rum
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/tagformat"
+)
+
+// deepest path we'll report before collapsing the remainder
+const maxRouteDepth = 5
+
+var (
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegment    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegment     = regexp.MustCompile(`^[0-9a-fA-F]{8,}$`)
+	hasDigit       = regexp.MustCompile(`[0-9]`)
+)
+
+// RouteNormalizer turns page URLs into low-cardinality route templates
+type RouteNormalizer struct {
+	templates [][]string
+}
+
+/*
+NewRouteNormalizer builds a normalizer from a list of known route templates
+(e.g. "/product/:slug"). Segments starting with ':' match anything.
+Templates are tried in order before falling back to heuristics.
+*/
+func NewRouteNormalizer(templates []string) *RouteNormalizer {
+	n := &RouteNormalizer{}
+	for _, t := range templates {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		n.templates = append(n.templates, splitPath(t))
+	}
+	return n
+}
+
+// Normalize returns the route template for a URL or bare path
+func (n *RouteNormalizer) Normalize(rawURL string) string {
+	path := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		path = u.Path
+	}
+	segments := splitPath(path)
+
+	for _, t := range n.templates {
+		if matchTemplate(t, segments) {
+			return "/" + strings.Join(t, "/")
+		}
+	}
+
+	/*
+		No explicit template, so swap anything that looks like an
+		identifier for a placeholder and cap the depth
+	*/
+	if len(segments) > maxRouteDepth {
+		segments = append(segments[:maxRouteDepth], "*")
+	}
+	for i, s := range segments {
+		segments[i] = normalizeSegment(s)
+	}
+
+	return "/" + strings.Join(segments, "/")
+}
+
+func normalizeSegment(s string) string {
+	switch {
+	case s == "*":
+		return s
+	case numericSegment.MatchString(s):
+		return ":id"
+	case uuidSegment.MatchString(s):
+		return ":uuid"
+	case hexSegment.MatchString(s) && hasDigit.MatchString(s):
+		return ":hash"
+	case len(s) > 32:
+		return ":token"
+	}
+	return tagformat.Escape(strings.ToLower(s))
+}
+
+func matchTemplate(template []string, segments []string) bool {
+	if len(template) != len(segments) {
+		return false
+	}
+	for i, t := range template {
+		if strings.HasPrefix(t, ":") {
+			continue
+		}
+		if !strings.EqualFold(t, segments[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func splitPath(path string) []string {
+	segments := []string{}
+	for _, s := range strings.Split(path, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+	return segments
+}
@@ -0,0 +1,30 @@
+package rum
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeHeuristics(t *testing.T) {
+	n := NewRouteNormalizer(nil)
+	rt := require.New(t)
+
+	rt.Equal("/", n.Normalize("https://example.com"))
+	rt.Equal("/", n.Normalize("https://example.com/?q=1"))
+	rt.Equal("/users/:id/orders", n.Normalize("https://example.com/users/1234/orders?page=2#top"))
+	rt.Equal("/orders/:uuid", n.Normalize("/orders/3f2504e0-4f89-11d3-9a0c-0305e82c3301"))
+	rt.Equal("/assets/:hash", n.Normalize("/assets/9f86d081884c7d65"))
+	rt.Equal("/blog/deadbeef", n.Normalize("/blog/deadbeef"))
+	rt.Equal("/a/b/c/d/e/*", n.Normalize("/a/b/c/d/e/f/g"))
+	rt.Equal("/search/a_b", n.Normalize("/search/a=b"))
+}
+
+func TestNormalizeTemplates(t *testing.T) {
+	n := NewRouteNormalizer([]string{"/product/:slug", " ", "/blog/:year/:slug"})
+	rt := require.New(t)
+
+	rt.Equal("/product/:slug", n.Normalize("https://example.com/product/blue-widget"))
+	rt.Equal("/blog/:year/:slug", n.Normalize("/blog/2022/hello-world"))
+	rt.Equal("/product/blue-widget/reviews", n.Normalize("/product/blue-widget/reviews"))
+}
@@ -0,0 +1,169 @@
+package rum
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+)
+
+const (
+	vitalsMetricPrefix     = "web_vitals_"
+	navigationMetricPrefix = "navigation_timing_"
+)
+
+// good/poor boundaries from https://web.dev/vitals/
+var vitalThresholds = map[string][2]float64{
+	"CLS":  {0.1, 0.25},
+	"FCP":  {1800, 3000},
+	"FID":  {100, 300},
+	"INP":  {200, 500},
+	"LCP":  {2500, 4000},
+	"TTFB": {800, 1800},
+}
+
+/*
+Report is a single entry as sent by the browser: either a web-vitals
+Metric object (https://github.com/GoogleChrome/web-vitals#metric) or a
+PerformanceNavigationTiming entry (entryType "navigation").
+
+web-vitals doesn't include the page, so clients may add `page`
+(otherwise we fall back to the Referer of the request). Its `rating`
+is ignored: we rate the value ourselves, so clients can't mislabel it
+*/
+type Report struct {
+	// web-vitals fields
+	Name           string  `json:"name"`
+	Value          float64 `json:"value"`
+	NavigationType string  `json:"navigationType"`
+	Page           string  `json:"page"`
+
+	// navigation timing fields
+	EntryType                string  `json:"entryType"`
+	Type                     string  `json:"type"`
+	DomainLookupStart        float64 `json:"domainLookupStart"`
+	DomainLookupEnd          float64 `json:"domainLookupEnd"`
+	ConnectStart             float64 `json:"connectStart"`
+	ConnectEnd               float64 `json:"connectEnd"`
+	RequestStart             float64 `json:"requestStart"`
+	ResponseStart            float64 `json:"responseStart"`
+	ResponseEnd              float64 `json:"responseEnd"`
+	DomInteractive           float64 `json:"domInteractive"`
+	DomContentLoadedEventEnd float64 `json:"domContentLoadedEventEnd"`
+	LoadEventEnd             float64 `json:"loadEventEnd"`
+}
+
+// ParseReports accepts either a single report object or a list of them
+func ParseReports(body []byte) ([]Report, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var reports []Report
+		err := json.Unmarshal(body, &reports)
+		return reports, err
+	}
+	var report Report
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, err
+	}
+	return []Report{report}, nil
+}
+
+// ToMetrics converts a report into timing metrics tagged by route, rating and navigation type
+func (n *RouteNormalizer) ToMetrics(r Report, referer string) ([]config.MetricRequest, error) {
+	page := r.Page
+	if page == "" {
+		page = referer
+	}
+	route := n.Normalize(page)
+
+	if r.EntryType == "navigation" {
+		return navigationMetrics(r, route), nil
+	}
+
+	name := strings.ToUpper(r.Name)
+	thresholds, ok := vitalThresholds[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown web vital %q", r.Name)
+	}
+	if r.Value < 0 || math.IsNaN(r.Value) || math.IsInf(r.Value, 0) {
+		return nil, fmt.Errorf("Invalid value for %s", name)
+	}
+
+	rating := rate(r.Value, thresholds)
+
+	// CLS is a unitless score, so scale it up to keep precision as an integer
+	value := r.Value
+	if name == "CLS" {
+		value *= 1000
+	}
+
+	return []config.MetricRequest{{
+		Metric:     vitalsMetricPrefix + strings.ToLower(name),
+		Value:      int64(math.Round(value)),
+		Tags:       buildTags(route, navigationType(r.NavigationType), rating),
+		MetricType: "timing",
+	}}, nil
+}
+
+func navigationMetrics(r Report, route string) []config.MetricRequest {
+	tags := buildTags(route, navigationType(r.Type), "")
+	phases := []struct {
+		name  string
+		value float64
+	}{
+		{"dns", r.DomainLookupEnd - r.DomainLookupStart},
+		{"connect", r.ConnectEnd - r.ConnectStart},
+		{"request", r.ResponseStart - r.RequestStart},
+		{"response", r.ResponseEnd - r.ResponseStart},
+		{"dom_interactive", r.DomInteractive},
+		{"dom_content_loaded", r.DomContentLoadedEventEnd},
+		{"load", r.LoadEventEnd},
+	}
+
+	metrics := []config.MetricRequest{}
+	for _, p := range phases {
+		// phases that haven't happened (or were cached) report as zero/negative
+		if p.value <= 0 {
+			continue
+		}
+		metrics = append(metrics, config.MetricRequest{
+			Metric:     navigationMetricPrefix + p.name,
+			Value:      int64(math.Round(p.value)),
+			Tags:       tags,
+			MetricType: "timing",
+		})
+	}
+	return metrics
+}
+
+func rate(value float64, thresholds [2]float64) string {
+	switch {
+	case value <= thresholds[0]:
+		return "good"
+	case value <= thresholds[1]:
+		return "needs-improvement"
+	}
+	return "poor"
+}
+
+func navigationType(t string) string {
+	switch t {
+	case "navigate", "reload", "back-forward", "back-forward-cache", "prerender", "restore":
+		return t
+	case "back_forward":
+		// PerformanceNavigationTiming spells this one differently
+		return "back-forward"
+	}
+	return "unknown"
+}
+
+func buildTags(route string, navType string, rating string) string {
+	tags := fmt.Sprintf("route=%s,navigation_type=%s", route, navType)
+	if rating != "" {
+		tags += ",rating=" + rating
+	}
+	return tags
+}
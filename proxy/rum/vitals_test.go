@@ -0,0 +1,85 @@
+package rum
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSingleAndListReports(t *testing.T) {
+	rt := require.New(t)
+
+	reports, err := ParseReports([]byte(`{"name":"LCP","value":1234.5,"rating":"good","navigationType":"navigate"}`))
+	rt.NoError(err)
+	rt.Len(reports, 1)
+
+	reports, err = ParseReports([]byte(` [{"name":"LCP","value":1},{"name":"CLS","value":0.2}]`))
+	rt.NoError(err)
+	rt.Len(reports, 2)
+}
+
+func TestWebVitalToMetric(t *testing.T) {
+	n := NewRouteNormalizer(nil)
+	rt := require.New(t)
+
+	metrics, err := n.ToMetrics(Report{Name: "LCP", Value: 1234.5, NavigationType: "reload"}, "https://example.com/users/42")
+	rt.NoError(err)
+	rt.Len(metrics, 1)
+	rt.Equal("web_vitals_lcp", metrics[0].Metric)
+	rt.Equal(int64(1235), metrics[0].Value)
+	rt.Equal("timing", metrics[0].MetricType)
+	rt.Equal("route=/users/:id,navigation_type=reload,rating=good", metrics[0].Tags)
+}
+
+func TestWebVitalRatingAndScaling(t *testing.T) {
+	n := NewRouteNormalizer(nil)
+	rt := require.New(t)
+
+	// the rating is computed, CLS is scaled to keep precision
+	metrics, err := n.ToMetrics(Report{Name: "CLS", Value: 0.15, Page: "/"}, "")
+	rt.NoError(err)
+	rt.Equal(int64(150), metrics[0].Value)
+	rt.Equal("route=/,navigation_type=unknown,rating=needs-improvement", metrics[0].Tags)
+
+	// whatever rating the client claims
+	reports, err := ParseReports([]byte(`{"name": "LCP", "value": 9000, "rating": "good", "page": "/"}`))
+	rt.NoError(err)
+	metrics, err = n.ToMetrics(reports[0], "")
+	rt.NoError(err)
+	rt.Equal("route=/,navigation_type=unknown,rating=poor", metrics[0].Tags)
+
+	_, err = n.ToMetrics(Report{Name: "XYZ", Value: 1}, "")
+	rt.Error(err)
+	_, err = n.ToMetrics(Report{Name: "INP", Value: -1}, "")
+	rt.Error(err)
+}
+
+func TestNavigationTimingToMetrics(t *testing.T) {
+	n := NewRouteNormalizer(nil)
+	rt := require.New(t)
+
+	metrics, err := n.ToMetrics(Report{
+		EntryType:         "navigation",
+		Type:              "back_forward",
+		Page:              "/checkout",
+		DomainLookupStart: 10,
+		DomainLookupEnd:   30,
+		RequestStart:      40,
+		ResponseStart:     140,
+		ResponseEnd:       150,
+		LoadEventEnd:      900,
+	}, "")
+	rt.NoError(err)
+
+	values := map[string]int64{}
+	for _, m := range metrics {
+		rt.Equal("route=/checkout,navigation_type=back-forward", m.Tags)
+		values[m.Metric] = m.Value
+	}
+	rt.Equal(map[string]int64{
+		"navigation_timing_dns":      20,
+		"navigation_timing_request":  100,
+		"navigation_timing_response": 10,
+		"navigation_timing_load":     900,
+	}, values)
+}
@@ -0,0 +1,249 @@
+package sampling
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule samples metrics whose name matches
+type Rule struct {
+	// metric name pattern, where * matches any run of characters
+	Metric string `yaml:"metric"`
+	// share of matching metrics kept, from 0 (exclusive) to 1
+	Rate float64 `yaml:"rate"`
+}
+
+// Dynamic samples every count and timing while the processing queue is backed up
+type Dynamic struct {
+	// queue fill (0 to 1) sampling starts at (off, if 0)
+	Threshold float64 `yaml:"threshold"`
+	// rate when the queue is full, falling linearly from 1 at the threshold (default 0.1)
+	MinRate float64 `yaml:"min_rate"`
+}
+
+// ClientRates decides what happens to sample rates clients send
+type ClientRates struct {
+	// clamp (the default) or reject rates that are out of range or under a minimum
+	Policy string `yaml:"policy"`
+	// lowest rate allowed for metrics whose name matches (the first matching applies)
+	Min []Rule `yaml:"min"`
+}
+
+// Config is the sampling rules file
+type Config struct {
+	Rules       []Rule      `yaml:"rules"`
+	Dynamic     Dynamic     `yaml:"dynamic"`
+	ClientRates ClientRates `yaml:"client_rates"`
+}
+
+// RateError is returned for client sample rates rejected by the policy
+type RateError struct {
+	// short, low-cardinality reason for internal metrics
+	Reason string
+	msg    string
+}
+
+func (e *RateError) Error() string {
+	return e.msg
+}
+
+type rule struct {
+	pattern *regexp.Regexp
+	rate    float64
+	sampled *vmmetrics.Counter
+}
+
+/*
+Sampler sheds load statistically by lowering the sample rate of counts
+and timings. The StatsD client drops metrics at random at their sample
+rate, and tags the ones it sends with it, so StatsD still extrapolates
+the right totals. Sampling before that would count twice.
+Gauges and sets can't be extrapolated, so they're never sampled
+*/
+type Sampler struct {
+	rules     []*rule
+	policy    string
+	minRates  []*rule
+	threshold float64
+	minRate   float64
+	// how full the processing queue is, from 0 to 1
+	fill func() float64
+}
+
+/*
+Load reads sampling rules from a YAML file:
+
+	rules:
+	  - metric: "web.clicks.*"
+	    rate: 0.1
+	dynamic:
+	  threshold: 0.8
+	  min_rate: 0.1
+
+The first matching rule applies. An empty path disables sampling
+*/
+func Load(path string) (*Sampler, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return New(cfg)
+}
+
+// New validates sampling rules
+func New(cfg Config) (*Sampler, error) {
+	s := &Sampler{
+		policy:    cfg.ClientRates.Policy,
+		threshold: cfg.Dynamic.Threshold,
+		minRate:   cfg.Dynamic.MinRate,
+		fill: func() float64 {
+			return float64(len(config.ProcessChan)) / float64(cap(config.ProcessChan))
+		},
+	}
+	for _, r := range cfg.Rules {
+		compiled, err := compileRule(r)
+		if err != nil {
+			return nil, err
+		}
+		compiled.sampled = vmmetrics.GetOrCreateCounter(fmt.Sprintf("metrics_sampled_total{rule=%q}", r.Metric))
+		s.rules = append(s.rules, compiled)
+	}
+	for _, r := range cfg.ClientRates.Min {
+		compiled, err := compileRule(r)
+		if err != nil {
+			return nil, err
+		}
+		s.minRates = append(s.minRates, compiled)
+	}
+	switch s.policy {
+	case "":
+		s.policy = "clamp"
+	case "clamp", "reject":
+	default:
+		return nil, fmt.Errorf("Invalid client sample rate policy %q, must be clamp or reject", s.policy)
+	}
+	if s.threshold < 0 || s.threshold >= 1 {
+		return nil, fmt.Errorf("Dynamic sampling threshold %v must be from 0 to below 1", s.threshold)
+	}
+	if s.minRate == 0 {
+		s.minRate = 0.1
+	}
+	if s.minRate < 0 || s.minRate > 1 {
+		return nil, fmt.Errorf("Dynamic sampling min_rate %v must be above 0 and at most 1", s.minRate)
+	}
+
+	if s.threshold > 0 {
+		vmmetrics.GetOrCreateGauge("sampling_dynamic_rate", func() float64 {
+			return s.DynamicRate()
+		})
+	}
+	return s, nil
+}
+
+func compileRule(r Rule) (*rule, error) {
+	if r.Metric == "" {
+		return nil, fmt.Errorf("Sampling rule without a metric pattern")
+	}
+	if r.Rate <= 0 || r.Rate > 1 {
+		return nil, fmt.Errorf("Sampling rule %q has rate %v, must be above 0 and at most 1", r.Metric, r.Rate)
+	}
+	expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(r.Metric), `\*`, ".*") + "$"
+	return &rule{pattern: regexp.MustCompile(expr), rate: r.Rate}, nil
+}
+
+/*
+CheckRate validates the sample rate a client sent with a count or
+timing (0 being 1). Rates that aren't above 0 and at most 1 would
+distort StatsD's extrapolation, and tiny rates inflate counters, so
+depending on the policy they're clamped (out of range rates to 1, and
+rates under a minimum to it) or rejected with a RateError. Without
+sampling rules, out of range rates are clamped
+*/
+func (s *Sampler) CheckRate(m config.MetricRequest) (config.MetricRequest, error) {
+	if m.MetricType != "count" && m.MetricType != "timing" {
+		return m, nil
+	}
+	policy := "clamp"
+	if s != nil {
+		policy = s.policy
+	}
+
+	var reason string
+	var clamped float64
+	if math.IsNaN(m.SampleRate) || m.SampleRate <= 0 || m.SampleRate > 1 {
+		reason, clamped = "out_of_range", 1
+	} else if s != nil {
+		for _, r := range s.minRates {
+			if r.pattern.MatchString(m.Metric) {
+				if m.SampleRate < r.rate {
+					reason, clamped = "below_min", r.rate
+				}
+				break
+			}
+		}
+	}
+	if reason == "" {
+		return m, nil
+	}
+
+	if policy == "reject" {
+		vmmetrics.GetOrCreateCounter(fmt.Sprintf("client_sample_rates_rejected_total{reason=%q}", reason)).Inc()
+		return m, &RateError{
+			Reason: reason,
+			msg:    fmt.Sprintf("Sample rate %v of metric %q isn't allowed", m.SampleRate, m.Metric),
+		}
+	}
+	vmmetrics.GetOrCreateCounter(fmt.Sprintf("client_sample_rates_clamped_total{reason=%q}", reason)).Inc()
+	m.SampleRate = clamped
+	return m, nil
+}
+
+// DynamicRate is the share of counts and timings dynamic sampling keeps right now
+func (s *Sampler) DynamicRate() float64 {
+	if s == nil || s.threshold == 0 {
+		return 1
+	}
+	fill := s.fill()
+	if fill <= s.threshold {
+		return 1
+	}
+	over := (fill - s.threshold) / (1 - s.threshold)
+	if over > 1 {
+		over = 1
+	}
+	return 1 - over*(1-s.minRate)
+}
+
+// Apply lowers a metric's sample rate by the first matching rule's, and the dynamic rate
+func (s *Sampler) Apply(m config.MetricRequest) config.MetricRequest {
+	if s == nil || (m.MetricType != "count" && m.MetricType != "timing") {
+		return m
+	}
+
+	for _, r := range s.rules {
+		if r.pattern.MatchString(m.Metric) {
+			r.sampled.Inc()
+			m.SampleRate *= r.rate
+			break
+		}
+	}
+	if rate := s.DynamicRate(); rate < 1 {
+		vmmetrics.GetOrCreateCounter(`metrics_sampled_total{rule="dynamic"}`).Inc()
+		m.SampleRate *= rate
+	}
+	return m
+}
@@ -0,0 +1,116 @@
+package sampling
+
+import (
+	"math"
+	"testing"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApply(t *testing.T) {
+	sampler, err := New(Config{Rules: []Rule{
+		{Metric: "web.clicks.*", Rate: 0.1},
+		{Metric: "web.*", Rate: 0.5},
+	}})
+	require.NoError(t, err)
+	rt := require.New(t)
+
+	m := sampler.Apply(config.MetricRequest{Metric: "web.clicks.buy", MetricType: "count", SampleRate: 1})
+	rt.InDelta(0.1, m.SampleRate, 1e-9)
+	// client-side sampling is kept
+	m = sampler.Apply(config.MetricRequest{Metric: "web.lcp", MetricType: "timing", SampleRate: 0.5})
+	rt.InDelta(0.25, m.SampleRate, 1e-9)
+	m = sampler.Apply(config.MetricRequest{Metric: "api.calls", MetricType: "count", SampleRate: 1})
+	rt.Equal(1.0, m.SampleRate)
+	// gauges and sets can't be extrapolated
+	for _, metricType := range []string{"gauge", "set"} {
+		m = sampler.Apply(config.MetricRequest{Metric: "web.clicks.buy", MetricType: metricType, SampleRate: 1})
+		rt.Equal(1.0, m.SampleRate)
+	}
+
+	var none *Sampler
+	rt.Equal(1.0, none.Apply(config.MetricRequest{Metric: "web.lcp", MetricType: "timing", SampleRate: 1}).SampleRate)
+	rt.Equal(1.0, none.DynamicRate())
+}
+
+func TestDynamicRate(t *testing.T) {
+	sampler, err := New(Config{Dynamic: Dynamic{Threshold: 0.5, MinRate: 0.2}})
+	require.NoError(t, err)
+	var fill float64
+	sampler.fill = func() float64 { return fill }
+
+	for _, test := range [][2]float64{{0, 1}, {0.5, 1}, {0.75, 0.6}, {1, 0.2}} {
+		fill = test[0]
+		require.InDelta(t, test[1], sampler.DynamicRate(), 1e-9, fill)
+	}
+
+	fill = 0.75
+	m := sampler.Apply(config.MetricRequest{Metric: "web.lcp", MetricType: "timing", SampleRate: 0.5})
+	require.InDelta(t, 0.3, m.SampleRate, 1e-9)
+	m = sampler.Apply(config.MetricRequest{Metric: "web.cls", MetricType: "gauge", SampleRate: 1})
+	require.Equal(t, 1.0, m.SampleRate)
+
+	// off by default
+	sampler, err = New(Config{})
+	require.NoError(t, err)
+	sampler.fill = func() float64 { return 1 }
+	require.Equal(t, 1.0, sampler.DynamicRate())
+}
+
+func TestNewValidation(t *testing.T) {
+	for _, cfg := range []Config{
+		{Rules: []Rule{{Rate: 0.5}}},
+		{Rules: []Rule{{Metric: "a", Rate: 0}}},
+		{Rules: []Rule{{Metric: "a", Rate: 1.5}}},
+		{Dynamic: Dynamic{Threshold: 1}},
+		{Dynamic: Dynamic{Threshold: 0.5, MinRate: 2}},
+	} {
+		_, err := New(cfg)
+		require.Error(t, err, cfg)
+	}
+}
+
+func TestCheckRate(t *testing.T) {
+	rt := require.New(t)
+
+	// without sampling rules, out of range rates are clamped
+	var none *Sampler
+	for _, rate := range []float64{-1, 1.5, math.NaN()} {
+		m, err := none.CheckRate(config.MetricRequest{Metric: "web.lcp", MetricType: "timing", SampleRate: rate})
+		rt.NoError(err)
+		rt.Equal(1.0, m.SampleRate)
+	}
+	m, err := none.CheckRate(config.MetricRequest{Metric: "web.lcp", MetricType: "timing", SampleRate: 0.0001})
+	rt.NoError(err)
+	rt.Equal(0.0001, m.SampleRate)
+
+	clamp, err := New(Config{ClientRates: ClientRates{Min: []Rule{{Metric: "web.*", Rate: 0.01}}}})
+	rt.NoError(err)
+	m, err = clamp.CheckRate(config.MetricRequest{Metric: "web.clicks", MetricType: "count", SampleRate: 0.0001})
+	rt.NoError(err)
+	rt.Equal(0.01, m.SampleRate)
+	m, err = clamp.CheckRate(config.MetricRequest{Metric: "web.clicks", MetricType: "count", SampleRate: 0.5})
+	rt.NoError(err)
+	rt.Equal(0.5, m.SampleRate)
+	m, err = clamp.CheckRate(config.MetricRequest{Metric: "api.calls", MetricType: "count", SampleRate: 0.0001})
+	rt.NoError(err)
+	rt.Equal(0.0001, m.SampleRate)
+
+	reject, err := New(Config{ClientRates: ClientRates{Policy: "reject", Min: []Rule{{Metric: "web.*", Rate: 0.01}}}})
+	rt.NoError(err)
+	_, err = reject.CheckRate(config.MetricRequest{Metric: "web.clicks", MetricType: "count", SampleRate: 0.0001})
+	rt.Equal("below_min", err.(*RateError).Reason)
+	_, err = reject.CheckRate(config.MetricRequest{Metric: "api.calls", MetricType: "timing", SampleRate: 2})
+	rt.Equal("out_of_range", err.(*RateError).Reason)
+	_, err = reject.CheckRate(config.MetricRequest{Metric: "web.clicks", MetricType: "count", SampleRate: 1})
+	rt.NoError(err)
+
+	// gauges and sets aren't sampled, so their rates don't matter
+	m, err = reject.CheckRate(config.MetricRequest{Metric: "web.queue", MetricType: "gauge", SampleRate: -3})
+	rt.NoError(err)
+	rt.Equal(-3.0, m.SampleRate)
+
+	_, err = New(Config{ClientRates: ClientRates{Policy: "ignore"}})
+	rt.Error(err)
+}
@@ -0,0 +1,394 @@
+package schema
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	vmmetrics "github.com/VictoriaMetrics/metrics"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Modes decide what happens to metrics that don't match the schema
+const (
+	// reject them
+	Enforce = "enforce"
+	// log and count them, but send them anyway
+	Warn = "warn"
+	// send them, and record everything seen as a draft schema
+	Learn = "learn"
+)
+
+const (
+	// learned tags with more distinct values than this allow any value
+	maxLearnedValues = 20
+	// learning stops recording new metrics past this many, and new tag keys on a metric past maxLearnedTags
+	maxLearnedMetrics = 10000
+	maxLearnedTags    = 50
+)
+
+// Metric declares one metric clients may send
+type Metric struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// allowed tag keys, each with its allowed values (any value, if empty)
+	Tags map[string][]string `yaml:"tags,omitempty"`
+	// allowed value range (unbounded, if not set)
+	Min  *int64 `yaml:"min,omitempty"`
+	Max  *int64 `yaml:"max,omitempty"`
+	Unit string `yaml:"unit,omitempty"`
+}
+
+// File is the schema file
+type File struct {
+	Metrics []Metric `yaml:"metrics"`
+}
+
+// ValidationError explains why a metric doesn't match the schema
+type ValidationError struct {
+	// short, low-cardinality reason for internal metrics
+	Reason string
+	msg    string
+}
+
+func (e *ValidationError) Error() string {
+	return e.msg
+}
+
+// definition is a Metric, indexed for checking
+type definition struct {
+	metricType string
+	tags       map[string]map[string]bool
+	min        *int64
+	max        *int64
+	unit       string
+}
+
+// observed is what learn mode has seen of a metric
+type observed struct {
+	metricType string
+	// nil values mean any value
+	tags     map[string]map[string]bool
+	min, max *int64
+	unit     string
+}
+
+// Registry validates metrics against the declared schema
+type Registry struct {
+	mode      string
+	metrics   map[string]*definition
+	draftPath string
+
+	mu    sync.Mutex
+	draft map[string]*observed
+}
+
+/*
+Load reads a schema from a YAML file:
+
+	metrics:
+	  - name: web.checkout.paid
+	    type: count
+	    tags:
+	      env: [prod, staging]
+	      route: []
+	    min: 0
+	    max: 100
+	    unit: orders
+
+An empty path disables validation, except in learn mode, which starts
+from an empty schema. draftPath is where learn mode writes its draft
+*/
+func Load(path string, mode string, draftPath string) (*Registry, error) {
+	var file File
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, err
+		}
+	} else if mode != Learn {
+		return nil, nil
+	}
+	return New(file, mode, draftPath)
+}
+
+// New validates a schema
+func New(file File, mode string, draftPath string) (*Registry, error) {
+	switch mode {
+	case "":
+		mode = Enforce
+	case Enforce, Warn:
+	case Learn:
+		if draftPath == "" {
+			return nil, fmt.Errorf("Schema learn mode needs a draft file")
+		}
+	default:
+		return nil, fmt.Errorf("Invalid schema mode %q, must be enforce, warn or learn", mode)
+	}
+
+	r := &Registry{
+		mode:      mode,
+		metrics:   map[string]*definition{},
+		draftPath: draftPath,
+		draft:     map[string]*observed{},
+	}
+	for _, m := range file.Metrics {
+		if m.Name == "" {
+			return nil, fmt.Errorf("Schema metric without a name")
+		}
+		if _, ok := r.metrics[m.Name]; ok {
+			return nil, fmt.Errorf("Schema metric %q declared twice", m.Name)
+		}
+		switch m.Type {
+		case "count", "gauge", "timing", "set":
+		default:
+			return nil, fmt.Errorf("Schema metric %q has invalid type %q", m.Name, m.Type)
+		}
+		if m.Min != nil && m.Max != nil && *m.Min > *m.Max {
+			return nil, fmt.Errorf("Schema metric %q has min above max", m.Name)
+		}
+
+		def := &definition{metricType: m.Type, tags: map[string]map[string]bool{}, min: m.Min, max: m.Max, unit: m.Unit}
+		// learning widens the draft's range, never the declared one
+		seen := &observed{metricType: m.Type, tags: map[string]map[string]bool{}, min: copyBound(m.Min), max: copyBound(m.Max), unit: m.Unit}
+		for key, values := range m.Tags {
+			def.tags[key] = nil
+			seen.tags[key] = nil
+			if len(values) == 0 {
+				continue
+			}
+			def.tags[key] = map[string]bool{}
+			seen.tags[key] = map[string]bool{}
+			for _, v := range values {
+				def.tags[key][v] = true
+				seen.tags[key][v] = true
+			}
+		}
+		r.metrics[m.Name] = def
+		r.draft[m.Name] = seen
+	}
+	return r, nil
+}
+
+func copyBound(bound *int64) *int64 {
+	if bound == nil {
+		return nil
+	}
+	v := *bound
+	return &v
+}
+
+// Enforcing is true if metrics that don't match are rejected
+func (r *Registry) Enforcing() bool {
+	return r != nil && r.mode == Enforce
+}
+
+func (r *Registry) check(m config.MetricRequest) *ValidationError {
+	if r == nil {
+		return nil
+	}
+	def, ok := r.metrics[m.Metric]
+	if !ok {
+		return &ValidationError{Reason: "unknown_metric", msg: fmt.Sprintf("Metric %q is not in the schema", m.Metric)}
+	}
+	if m.MetricType != def.metricType {
+		return &ValidationError{
+			Reason: "wrong_type",
+			msg:    fmt.Sprintf("Metric %q must be a %s, not a %s", m.Metric, def.metricType, m.MetricType),
+		}
+	}
+	for _, pair := range splitTags(m.Tags) {
+		values, ok := def.tags[pair[0]]
+		if !ok {
+			return &ValidationError{Reason: "unknown_tag", msg: fmt.Sprintf("Tag %q is not allowed on metric %q", pair[0], m.Metric)}
+		}
+		if values != nil && !values[pair[1]] {
+			return &ValidationError{
+				Reason: "tag_value",
+				msg:    fmt.Sprintf("Value %q is not allowed for tag %q on metric %q", pair[1], pair[0], m.Metric),
+			}
+		}
+	}
+	if (def.min != nil && m.Value < *def.min) || (def.max != nil && m.Value > *def.max) {
+		return &ValidationError{
+			Reason: "out_of_range",
+			msg:    fmt.Sprintf("Value %d of metric %q is %s", m.Value, m.Metric, describeRange(def.min, def.max, def.unit)),
+		}
+	}
+	return nil
+}
+
+func describeRange(min *int64, max *int64, unit string) string {
+	var bounds string
+	switch {
+	case min != nil && max != nil:
+		bounds = fmt.Sprintf("outside %d to %d", *min, *max)
+	case min != nil:
+		bounds = fmt.Sprintf("below %d", *min)
+	default:
+		bounds = fmt.Sprintf("above %d", *max)
+	}
+	if unit != "" {
+		bounds += " " + unit
+	}
+	return bounds
+}
+
+// splitTags returns well-formed key=value pairs, leaving malformed ones for the processor to drop
+func splitTags(tags string) [][2]string {
+	var pairs [][2]string
+	for _, pair := range strings.Split(tags, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 && kv[0] != "" {
+			pairs = append(pairs, [2]string{kv[0], kv[1]})
+		}
+	}
+	return pairs
+}
+
+/*
+Validate checks a metric according to the mode, counting any mismatch.
+Only enforce mode returns an error; warn mode logs, and learn mode
+records the metric in the draft
+*/
+func (r *Registry) Validate(m config.MetricRequest) error {
+	if r == nil {
+		return nil
+	}
+	if r.mode == Learn {
+		r.learn(m)
+	}
+	err := r.check(m)
+	if err == nil {
+		return nil
+	}
+	vmmetrics.GetOrCreateCounter(fmt.Sprintf("schema_violations_total{reason=%q,mode=%q}", err.Reason, r.mode)).Inc()
+	switch r.mode {
+	case Enforce:
+		return err
+	case Warn:
+		log.WithFields(log.Fields{"metric": m.Metric, "reason": err.Reason}).Warn(err.Error())
+	}
+	return nil
+}
+
+/*
+learn widens the draft to fit a metric. Clients could send any number
+of names and tag keys, so past a limit new ones are counted rather than
+recorded
+*/
+func (r *Registry) learn(m config.MetricRequest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen, ok := r.draft[m.Metric]
+	if !ok {
+		if len(r.draft) >= maxLearnedMetrics {
+			vmmetrics.GetOrCreateCounter(`schema_learn_overflow_total{kind="metric"}`).Inc()
+			return
+		}
+		min, max := m.Value, m.Value
+		seen = &observed{metricType: m.MetricType, tags: map[string]map[string]bool{}, min: &min, max: &max}
+		r.draft[m.Metric] = seen
+	}
+	if seen.min != nil && m.Value < *seen.min {
+		*seen.min = m.Value
+	}
+	if seen.max != nil && m.Value > *seen.max {
+		*seen.max = m.Value
+	}
+	for _, pair := range splitTags(m.Tags) {
+		values, ok := seen.tags[pair[0]]
+		if !ok {
+			if len(seen.tags) >= maxLearnedTags {
+				vmmetrics.GetOrCreateCounter(`schema_learn_overflow_total{kind="tag"}`).Inc()
+				continue
+			}
+			values = map[string]bool{}
+			seen.tags[pair[0]] = values
+		}
+		if values == nil || values[pair[1]] {
+			continue
+		}
+		if len(values) >= maxLearnedValues {
+			// too many to list, so any value goes
+			seen.tags[pair[0]] = nil
+			continue
+		}
+		values[pair[1]] = true
+	}
+}
+
+// Draft is the schema learned so far: the declared metrics, widened to fit everything seen
+func (r *Registry) Draft() File {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	file := File{Metrics: make([]Metric, 0, len(r.draft))}
+	for name, seen := range r.draft {
+		m := Metric{Name: name, Type: seen.metricType, Unit: seen.unit}
+		m.Min, m.Max = copyBound(seen.min), copyBound(seen.max)
+		if len(seen.tags) > 0 {
+			m.Tags = map[string][]string{}
+			for key, values := range seen.tags {
+				list := []string{}
+				for v := range values {
+					list = append(list, v)
+				}
+				sort.Strings(list)
+				m.Tags[key] = list
+			}
+		}
+		file.Metrics = append(file.Metrics, m)
+	}
+	sort.Slice(file.Metrics, func(i, j int) bool {
+		return file.Metrics[i].Name < file.Metrics[j].Name
+	})
+	return file
+}
+
+// WriteDraft writes the draft schema to the draft file, replacing it whole
+func (r *Registry) WriteDraft() error {
+	data, err := yaml.Marshal(r.Draft())
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.draftPath), filepath.Base(r.draftPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.draftPath)
+}
+
+// WriteDrafts writes the draft schema every interval, in learn mode
+func (r *Registry) WriteDrafts(interval time.Duration) {
+	if r == nil || r.mode != Learn {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := r.WriteDraft(); err != nil {
+			log.WithFields(log.Fields{"error": err, "file": r.draftPath}).Error("Cannot write draft schema")
+			continue
+		}
+		log.WithFields(log.Fields{"file": r.draftPath}).Debug("Wrote draft schema")
+	}
+}
@@ -0,0 +1,176 @@
+package schema
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const testSchema = `
+metrics:
+  - name: web.checkout.paid
+    type: count
+    tags:
+      env: [prod, staging]
+      route: []
+    min: 0
+    max: 100
+    unit: orders
+  - name: web.lcp
+    type: timing
+`
+
+func loadTestSchema(t *testing.T, mode string, draftPath string) *Registry {
+	path := filepath.Join(t.TempDir(), "schema.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(testSchema), 0600))
+	registry, err := Load(path, mode, draftPath)
+	require.NoError(t, err)
+	return registry
+}
+
+func TestCheck(t *testing.T) {
+	registry := loadTestSchema(t, Enforce, "")
+
+	for _, test := range []struct {
+		metric config.MetricRequest
+		reason string
+	}{
+		{config.MetricRequest{Metric: "web.checkout.paid", MetricType: "count", Value: 3, Tags: "env=prod,route=/cart"}, ""},
+		{config.MetricRequest{Metric: "web.lcp", MetricType: "timing", Value: 2500}, ""},
+		{config.MetricRequest{Metric: "web.unknown", MetricType: "count", Value: 1}, "unknown_metric"},
+		{config.MetricRequest{Metric: "web.lcp", MetricType: "gauge", Value: 1}, "wrong_type"},
+		{config.MetricRequest{Metric: "web.checkout.paid", MetricType: "count", Value: 1, Tags: "user=42"}, "unknown_tag"},
+		{config.MetricRequest{Metric: "web.checkout.paid", MetricType: "count", Value: 1, Tags: "env=dev"}, "tag_value"},
+		{config.MetricRequest{Metric: "web.checkout.paid", MetricType: "count", Value: 101}, "out_of_range"},
+		{config.MetricRequest{Metric: "web.checkout.paid", MetricType: "count", Value: -1}, "out_of_range"},
+	} {
+		err := registry.check(test.metric)
+		if test.reason == "" {
+			require.Nil(t, err, test.metric)
+			continue
+		}
+		require.NotNil(t, err, test.metric)
+		require.Equal(t, test.reason, err.Reason, test.metric)
+	}
+
+	err := registry.check(config.MetricRequest{Metric: "web.checkout.paid", MetricType: "count", Value: 101})
+	require.Equal(t, `Value 101 of metric "web.checkout.paid" is outside 0 to 100 orders`, err.Error())
+}
+
+func TestValidateModes(t *testing.T) {
+	bad := config.MetricRequest{Metric: "web.unknown", MetricType: "count", Value: 1}
+
+	enforce := loadTestSchema(t, Enforce, "")
+	require.True(t, enforce.Enforcing())
+	require.Error(t, enforce.Validate(bad))
+
+	warn := loadTestSchema(t, Warn, "")
+	require.False(t, warn.Enforcing())
+	require.NoError(t, warn.Validate(bad))
+
+	var none *Registry
+	require.False(t, none.Enforcing())
+	require.NoError(t, none.Validate(bad))
+	require.Nil(t, none.check(bad))
+}
+
+func TestNewValidation(t *testing.T) {
+	min, max := int64(10), int64(1)
+	for _, file := range []File{
+		{Metrics: []Metric{{Type: "count"}}},
+		{Metrics: []Metric{{Name: "a", Type: "histogram"}}},
+		{Metrics: []Metric{{Name: "a", Type: "count"}, {Name: "a", Type: "gauge"}}},
+		{Metrics: []Metric{{Name: "a", Type: "count", Min: &min, Max: &max}}},
+	} {
+		_, err := New(file, Enforce, "")
+		require.Error(t, err, file)
+	}
+	_, err := New(File{}, "strict", "")
+	require.Error(t, err)
+	_, err = New(File{}, Learn, "")
+	require.Error(t, err)
+
+	registry, err := Load("", Enforce, "")
+	require.NoError(t, err)
+	require.Nil(t, registry)
+}
+
+func TestLearn(t *testing.T) {
+	draftPath := filepath.Join(t.TempDir(), "draft.yaml")
+	registry := loadTestSchema(t, Learn, draftPath)
+
+	// nothing is rejected while learning
+	for _, m := range []config.MetricRequest{
+		{Metric: "web.checkout.paid", MetricType: "count", Value: 250, Tags: "env=dev,route=/cart"},
+		{Metric: "web.cls", MetricType: "gauge", Value: 5, Tags: "page=home"},
+		{Metric: "web.cls", MetricType: "gauge", Value: 2, Tags: "page=cart"},
+	} {
+		require.NoError(t, registry.Validate(m))
+	}
+	for i := 0; i <= maxLearnedValues; i++ {
+		registry.Validate(config.MetricRequest{Metric: "web.clicks", MetricType: "count", Value: 1, Tags: "button=b" + string(rune('a'+i))})
+	}
+	// the declared schema itself is unchanged
+	require.NotNil(t, registry.check(config.MetricRequest{Metric: "web.checkout.paid", MetricType: "count", Value: 250}))
+
+	require.NoError(t, registry.WriteDraft())
+	data, err := os.ReadFile(draftPath)
+	require.NoError(t, err)
+	var draft File
+	require.NoError(t, yaml.Unmarshal(data, &draft))
+	require.Len(t, draft.Metrics, 4)
+
+	paid := draft.Metrics[0]
+	require.Equal(t, "web.checkout.paid", paid.Name)
+	require.Equal(t, []string{"dev", "prod", "staging"}, paid.Tags["env"])
+	require.Empty(t, paid.Tags["route"])
+	require.Equal(t, int64(0), *paid.Min)
+	require.Equal(t, int64(250), *paid.Max)
+	require.Equal(t, "orders", paid.Unit)
+
+	require.Equal(t, "web.clicks", draft.Metrics[1].Name)
+	require.Empty(t, draft.Metrics[1].Tags["button"])
+
+	cls := draft.Metrics[2]
+	require.Equal(t, "web.cls", cls.Name)
+	require.Equal(t, "gauge", cls.Type)
+	require.Equal(t, []string{"cart", "home"}, cls.Tags["page"])
+	require.Equal(t, int64(2), *cls.Min)
+	require.Equal(t, int64(5), *cls.Max)
+
+	require.Nil(t, draft.Metrics[3].Tags)
+
+	// the draft is a valid schema
+	_, err = New(draft, Enforce, "")
+	require.NoError(t, err)
+}
+
+func TestLearnLimits(t *testing.T) {
+	registry, err := New(File{}, Learn, filepath.Join(t.TempDir(), "draft.yaml"))
+	require.NoError(t, err)
+
+	for i := 0; i < maxLearnedMetrics+10; i++ {
+		registry.Validate(config.MetricRequest{Metric: fmt.Sprintf("random.%d", i), MetricType: "count", Value: 1})
+	}
+	for i := 0; i < maxLearnedTags+10; i++ {
+		registry.Validate(config.MetricRequest{Metric: "random.0", MetricType: "count", Value: 1, Tags: fmt.Sprintf("key%d=a", i)})
+	}
+	// metrics already seen are still learned from
+	registry.Validate(config.MetricRequest{Metric: "random.1", MetricType: "count", Value: 7})
+
+	draft := registry.Draft()
+	require.Len(t, draft.Metrics, maxLearnedMetrics)
+	for _, m := range draft.Metrics {
+		switch m.Name {
+		case "random.0":
+			require.Len(t, m.Tags, maxLearnedTags)
+		case "random.1":
+			require.Equal(t, int64(7), *m.Max)
+		}
+	}
+}
@@ -2,59 +2,119 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"github.com/civic-eagle/statsd-http-proxy/proxy/router"
 	"github.com/civic-eagle/statsd-http-proxy/proxy/config"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/graphite"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/router"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/rpc"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 )
 
+// how long open gRPC streams get to finish on shutdown
+const grpcShutdownTimeout = 5 * time.Second
+
 // Server is a proxy server between HTTP REST API and UDP Connection to StatsD
 type Server struct {
 	httpAddress string
 	httpServer  *http.Server
-	tlsCert     string
-	tlsKey      string
+	tlsConfig   *tls.Config
+	grpcAddress string
+	grpcServer  *grpc.Server
+	graphite    []*graphite.Listener
+	// cancels the context of every HTTP request, stopping websocket streams
+	stopStreams context.CancelFunc
+}
+
+// Options configures the proxy's listeners. Ports left at 0 are off
+type Options struct {
+	HTTPHost string
+	HTTPPort int
+	// HTTP timeouts, in seconds
+	HTTPReadTimeout  int
+	HTTPWriteTimeout int
+	HTTPIdleTimeout  int
+	// serves HTTPS and gRPC over TLS, if set
+	TLSConfig *tls.Config
+	GRPCPort  int
+	// Graphite listeners bind here rather than to HTTPHost
+	GraphiteHost       string
+	GraphitePort       int
+	GraphitePicklePort int
+	Routes             router.Options
 }
 
 // NewServer creates new instance of StatsD HTTP Proxy
-func NewServer(
-	httpHost string,
-	httpPort int,
-	httpReadTimeout int,
-	httpWriteTimeout int,
-	httpIdleTimeout int,
-	tlsCert string,
-	tlsKey string,
-	tokenSecret string,
-	verbose bool,
-) *Server {
+func NewServer(opts Options) *Server {
 	// build router
-	httpServerHandler := router.NewHTTPRouter(tokenSecret)
+	httpServerHandler := router.NewHTTPRouter(opts.Routes)
 
 	// get HTTP server address to bind
-	httpAddress := fmt.Sprintf("%s:%d", httpHost, httpPort)
+	httpAddress := fmt.Sprintf("%s:%d", opts.HTTPHost, opts.HTTPPort)
 
 	// create http server
 	httpServer := &http.Server{
 		Addr:           httpAddress,
 		Handler:        httpServerHandler,
-		ReadTimeout:    time.Duration(httpReadTimeout) * time.Second,
-		WriteTimeout:   time.Duration(httpWriteTimeout) * time.Second,
-		IdleTimeout:    time.Duration(httpIdleTimeout) * time.Second,
+		ReadTimeout:    time.Duration(opts.HTTPReadTimeout) * time.Second,
+		WriteTimeout:   time.Duration(opts.HTTPWriteTimeout) * time.Second,
+		IdleTimeout:    time.Duration(opts.HTTPIdleTimeout) * time.Second,
 		MaxHeaderBytes: 1 << 11,
 	}
+	/*
+		Shutdown doesn't wait for websocket connections, as they've been
+		hijacked, so they're stopped by cancelling their requests' context
+	*/
+	streamsCtx, stopStreams := context.WithCancel(context.Background())
+	httpServer.BaseContext = func(net.Listener) context.Context {
+		return streamsCtx
+	}
+
+	// gRPC is optional and lives on its own port
+	var grpcAddress string
+	var grpcServer *grpc.Server
+	if opts.GRPCPort > 0 {
+		grpcAddress = fmt.Sprintf("%s:%d", opts.HTTPHost, opts.GRPCPort)
+		grpcServer = rpc.NewServer(rpc.Options{
+			TokenValidator: opts.Routes.TokenValidator,
+			Enricher:       opts.Routes.Enricher,
+			TLSConfig:      opts.TLSConfig,
+			ClientLimiter:  opts.Routes.ClientLimiter,
+			Schema:         opts.Routes.Schema,
+		})
+	}
+
+	/*
+		Graphite TCP listeners are for legacy jobs on trusted networks
+		and (like carbon) don't authenticate, so they bind to their own
+		(by default local) address rather than the API's
+	*/
+	graphiteListeners := []*graphite.Listener{}
+	if opts.GraphitePort > 0 {
+		graphiteListeners = append(graphiteListeners,
+			graphite.NewListener(fmt.Sprintf("%s:%d", opts.GraphiteHost, opts.GraphitePort), false, opts.Routes.GraphiteMapper))
+	}
+	if opts.GraphitePicklePort > 0 {
+		graphiteListeners = append(graphiteListeners,
+			graphite.NewListener(fmt.Sprintf("%s:%d", opts.GraphiteHost, opts.GraphitePicklePort), true, opts.Routes.GraphiteMapper))
+	}
 
 	statsdHTTPProxyServer := Server{
 		httpAddress,
 		httpServer,
-		tlsCert,
-		tlsKey,
+		opts.TLSConfig,
+		grpcAddress,
+		grpcServer,
+		graphiteListeners,
+		stopStreams,
 	}
 
 	return &statsdHTTPProxyServer
@@ -72,8 +132,10 @@ func (proxyServer *Server) Listen() {
 
 		// open HTTP connection
 		var err error
-		if len(proxyServer.tlsCert) > 0 && len(proxyServer.tlsKey) > 0 {
-			err = proxyServer.httpServer.ListenAndServeTLS(proxyServer.tlsCert, proxyServer.tlsKey)
+		if proxyServer.tlsConfig != nil {
+			// certificates come from the (reloading) config
+			proxyServer.httpServer.TLSConfig = proxyServer.tlsConfig
+			err = proxyServer.httpServer.ListenAndServeTLS("", "")
 		} else {
 			err = proxyServer.httpServer.ListenAndServe()
 		}
@@ -83,11 +145,40 @@ func (proxyServer *Server) Listen() {
 		}
 	}()
 
+	// start gRPC proxy to StatsD
+	if proxyServer.grpcServer != nil {
+		go func() {
+			log.WithFields(log.Fields{"Address": proxyServer.grpcAddress}).Info("Starting gRPC server")
+
+			listener, err := net.Listen("tcp", proxyServer.grpcAddress)
+			if err != nil {
+				log.WithFields(log.Fields{"Error": err}).Fatal("Cannot start gRPC Server")
+			}
+			if err := proxyServer.grpcServer.Serve(listener); err != nil {
+				log.WithFields(log.Fields{"Error": err}).Fatal("Cannot start gRPC Server")
+			}
+		}()
+	}
+
+	// start Graphite listeners
+	for _, listener := range proxyServer.graphite {
+		if err := listener.Listen(); err != nil {
+			log.WithFields(log.Fields{"Error": err}).Fatal("Cannot start Graphite listener")
+		}
+		go listener.Serve()
+	}
+
 	<-gracefullStopSignalHandler
 
 	// Gracefull shutdown
+	for _, listener := range proxyServer.graphite {
+		listener.Close()
+	}
+	if proxyServer.grpcServer != nil {
+		log.Info("Stopping gRPC server")
+		stopGRPC(proxyServer.grpcServer, grpcShutdownTimeout)
+	}
 	log.Info("Stopping HTTP server")
-	close(config.ProcessChan)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer func() {
@@ -97,6 +188,27 @@ func (proxyServer *Server) Listen() {
 	if err := proxyServer.httpServer.Shutdown(ctx); err != nil {
 		log.WithFields(log.Fields{"error": err}).Fatal("HTTP Server Shutdown Failed")
 	}
+	proxyServer.stopStreams()
+	router.WaitForStreams()
+
+	// nothing is left to send metrics
+	close(config.ProcessChan)
 
 	log.Info("HTTP server stopped successfully")
 }
+
+// stopGRPC stops the gRPC server gracefully, unless its streams are still open after timeout
+func stopGRPC(server *grpc.Server, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		log.Warn("gRPC streams still open, stopping gRPC server")
+		server.Stop()
+		<-stopped
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/civic-eagle/statsd-http-proxy/proxy/rpc"
+	"github.com/civic-eagle/statsd-http-proxy/proxy/rpc/pb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestStopGRPCWithOpenStream(t *testing.T) {
+	listener := bufconn.Listen(1024 * 1024)
+	server := rpc.NewServer(rpc.Options{})
+	go server.Serve(listener)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+	stream, err := pb.NewMetricsClient(conn).SendStream(context.Background())
+	require.NoError(t, err)
+	// the stream is open once the server has seen a message
+	require.NoError(t, stream.Send(&pb.Metric{Metric: "a", Value: 1}))
+	time.Sleep(100 * time.Millisecond)
+
+	// the client never closes the stream, so a graceful stop alone would wait forever
+	stopped := make(chan struct{})
+	go func() {
+		stopGRPC(server, 100*time.Millisecond)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("gRPC server still running after its shutdown timeout")
+	}
+}
@@ -1,12 +1,16 @@
 package statsdclient
 
-import GoMetricStatsdClient "github.com/GoMetric/go-statsd-client"
+import (
+	"sync"
+
+	GoMetricStatsdClient "github.com/GoMetric/go-statsd-client"
+)
 
 func NewGoMetricClient(
 	statsdHost string,
 	statsdPort int,
 ) StatsdClientInterface {
-	return GoMetricStatsdClient.NewClient(statsdHost, statsdPort)
+	return &sampledClient{Client: GoMetricStatsdClient.NewClient(statsdHost, statsdPort)}
 }
 
 type StatsdClientInterface interface {
@@ -18,3 +22,29 @@ type StatsdClientInterface interface {
 	GaugeShift(key string, value int)
 	Set(key string, value int)
 }
+
+/*
+sampledClient serializes sampled counts and timings. The client drops
+them using a single random source, which isn't safe for concurrent use,
+and the processor sends from several goroutines
+*/
+type sampledClient struct {
+	*GoMetricStatsdClient.Client
+	mu sync.Mutex
+}
+
+func (c *sampledClient) Count(key string, value int, sampleRate float32) {
+	if sampleRate < 1 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+	}
+	c.Client.Count(key, value, sampleRate)
+}
+
+func (c *sampledClient) Timing(key string, time int64, sampleRate float32) {
+	if sampleRate < 1 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+	}
+	c.Client.Timing(key, time, sampleRate)
+}
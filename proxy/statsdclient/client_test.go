@@ -1,8 +1,8 @@
-
 package statsdclient
 
 import (
 	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -10,6 +10,26 @@ import (
 
 func TestNewGoMetricClient(t *testing.T) {
 	client := NewGoMetricClient("127.0.0.1", 8125)
+	require.Equal(t, "*statsdclient.sampledClient", reflect.TypeOf(client).String())
+	require.Equal(t, "*statsd.Client", reflect.TypeOf(client.(*sampledClient).Client).String())
+}
+
+// run with -race: the client's random source is shared by every sampled metric
+func TestConcurrentSampledMetrics(t *testing.T) {
+	client := NewGoMetricClient("127.0.0.1", 8125)
+	client.Open()
+	defer client.Close()
 
-	require.Equal(t, "*statsd.Client", reflect.TypeOf(client).String())
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				client.Count("sampled.count", 1, 0.5)
+				client.Timing("sampled.timing", 10, 0.5)
+			}
+		}()
+	}
+	wg.Wait()
 }
@@ -0,0 +1,29 @@
+/*
+Package tagformat holds the rules for our name,key=value tag format,
+shared by everything that builds tags from untrusted input
+*/
+package tagformat
+
+import "regexp"
+
+var (
+	// tag keys must survive the processor's (and prometheus') tag handling
+	validKey = regexp.MustCompile("^[a-zA-Z][a-zA-Z0-9_]*$")
+	// characters that would break our key=value tag format
+	unsafeChars = regexp.MustCompile(`[,=\s]`)
+)
+
+// ValidKey is true if key can be used as a tag key
+func ValidKey(key string) bool {
+	return validKey.MatchString(key)
+}
+
+// Unsafe is true if s contains characters that would break the tag format
+func Unsafe(s string) bool {
+	return unsafeChars.MatchString(s)
+}
+
+// Escape replaces the characters that would break the tag format with underscores
+func Escape(s string) string {
+	return unsafeChars.ReplaceAllString(s, "_")
+}
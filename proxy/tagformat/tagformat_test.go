@@ -0,0 +1,22 @@
+package tagformat
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagFormat(t *testing.T) {
+	rt := require.New(t)
+
+	rt.True(ValidKey("tenant_id"))
+	rt.False(ValidKey("1tenant"))
+	rt.False(ValidKey("tenant-id"))
+
+	rt.True(Unsafe("web.paid,tenant=victim"))
+	rt.True(Unsafe("web paid"))
+	rt.False(Unsafe("web.paid"))
+
+	rt.Equal("a_b_c_d", Escape("a,b=c d"))
+	rt.Equal("web.paid", Escape("web.paid"))
+}